@@ -0,0 +1,225 @@
+// Package audit writes a log of what guests do as JSON lines. Each line is an
+// Event so the log can be ingested by tools that expect a fixed schema.
+package audit
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SchemaVersion is the version of the Event schema. Fields are only ever
+// added, a change to an existing field changes the version.
+const SchemaVersion = 1
+
+// The kinds of event
+const (
+	ConnectionRefused = "connection_refused"
+	ConnectionOpened  = "connection_open"
+	ConnectionClosed  = "connection_close"
+	Authentication    = "auth"
+	ChannelOpened     = "channel_open"
+	ChannelRejected   = "channel_reject"
+	ChannelClosed     = "channel_close"
+	Request           = "request"
+	Error             = "error"
+)
+
+// The outcomes of authentication attempts and requests
+const (
+	Success        = "success"
+	Failure        = "failure"
+	PartialSuccess = "partial_success"
+)
+
+// An Event is a line in the audit log
+type Event struct {
+	Version int       `json:"v"`
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	// Identifies the SSH connection the event happened on
+	ConnectionID string `json:"connection_id,omitempty"`
+	// Identifies the channel, it's the session ID for session channels
+	ChannelID   string `json:"channel_id,omitempty"`
+	RemoteAddr  string `json:"remote_addr,omitempty"`
+	User        string `json:"user,omitempty"`
+	Method      string `json:"method,omitempty"`
+	Outcome     string `json:"outcome,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	ChannelType string `json:"channel_type,omitempty"`
+	Request     string `json:"request,omitempty"`
+	Command     string `json:"command,omitempty"`
+	Subsystem   string `json:"subsystem,omitempty"`
+	// The host:port a forwarded connection goes to and comes from
+	Destination string `json:"destination,omitempty"`
+	Originator  string `json:"originator,omitempty"`
+	// The address:port a remote forward listens on
+	Listen string `json:"listen,omitempty"`
+	// Bytes received from and sent to the guest and how long the connection
+	// or channel was open. Only set when it closes.
+	BytesIn    *int64 `json:"bytes_in,omitempty"`
+	BytesOut   *int64 `json:"bytes_out,omitempty"`
+	DurationMs *int64 `json:"duration_ms,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Closed sets the totals for a connection or channel that has closed
+func (e *Event) Closed(bytesIn, bytesOut int64, opened time.Time) {
+	duration := time.Since(opened).Milliseconds()
+	e.BytesIn = &bytesIn
+	e.BytesOut = &bytesOut
+	e.DurationMs = &duration
+}
+
+// ConnectionID returns the ID the audit log uses for the connection
+func ConnectionID(conn ssh.ConnMetadata) string {
+	id := conn.SessionID()
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	return hex.EncodeToString(id)
+}
+
+// The most connections that can have offered a public key without
+// finishing authenticating before the keys are forgotten
+const maxOfferedKeys = 1024
+
+// A Logger writes events to the audit log
+type Logger struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	closer io.Closer
+	now    func() time.Time
+	// The last public key each authenticating connection offered
+	offered map[string]ssh.PublicKey
+	onError func(error)
+}
+
+// NewLogger creates a Logger that writes events to the writer
+func NewLogger(writer io.Writer) *Logger {
+	l := &Logger{
+		writer:  writer,
+		now:     time.Now,
+		offered: map[string]ssh.PublicKey{},
+		onError: func(error) {},
+	}
+	if closer, ok := writer.(io.Closer); ok {
+		l.closer = closer
+	}
+	return l
+}
+
+// Open creates a Logger that appends events to the file
+func Open(filename string) (*Logger, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open audit log %s (%s)", filename, err)
+	}
+	return NewLogger(file), nil
+}
+
+// Log writes the event
+func (l *Logger) Log(event Event) error {
+	event.Version = SchemaVersion
+	if event.Time.IsZero() {
+		event.Time = l.now()
+	}
+	event.Time = event.Time.UTC()
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("Unable to encode audit event (%s)", err)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, err = l.writer.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("Unable to write to the audit log (%s)", err)
+	}
+	return nil
+}
+
+// OnError sets a function that's called when an authentication attempt
+// can't be logged
+func (l *Logger) OnError(handler func(error)) {
+	l.onError = handler
+}
+
+// Close closes the audit log
+func (l *Logger) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// WatchAuthentication logs every authentication attempt. It must be called
+// once the authentication callbacks have been set up.
+func (l *Logger) WatchAuthentication(sshConf *ssh.ServerConfig) {
+	// The log callback isn't given the key so the key that was offered is
+	// remembered
+	if callback := sshConf.PublicKeyCallback; callback != nil {
+		sshConf.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			l.mutex.Lock()
+			if len(l.offered) >= maxOfferedKeys {
+				l.offered = map[string]ssh.PublicKey{}
+			}
+			l.offered[string(conn.SessionID())] = key
+			l.mutex.Unlock()
+			return callback(conn, key)
+		}
+	}
+
+	authLog := sshConf.AuthLogCallback
+	sshConf.AuthLogCallback = func(conn ssh.ConnMetadata, method string, err error) {
+		if authLog != nil {
+			authLog(conn, method, err)
+		}
+		l.logAuthentication(conn, method, err)
+	}
+}
+
+func (l *Logger) logAuthentication(conn ssh.ConnMetadata, method string, err error) {
+	// Clients start by asking which methods are allowed
+	if method == "none" {
+		return
+	}
+	event := Event{
+		Event:        Authentication,
+		ConnectionID: ConnectionID(conn),
+		RemoteAddr:   conn.RemoteAddr().String(),
+		User:         conn.User(),
+		Method:       method,
+		Outcome:      Success,
+	}
+	if err != nil {
+		event.Outcome = Failure
+		event.Error = err.Error()
+		if _, ok := err.(*ssh.PartialSuccessError); ok {
+			event.Outcome = PartialSuccess
+			event.Error = ""
+		}
+	}
+	if method == "publickey" {
+		l.mutex.Lock()
+		key := l.offered[string(conn.SessionID())]
+		delete(l.offered, string(conn.SessionID()))
+		l.mutex.Unlock()
+		if cert, ok := key.(*ssh.Certificate); ok {
+			key = cert.Key
+		}
+		if key != nil {
+			event.Fingerprint = ssh.FingerprintSHA256(key)
+		}
+	}
+	err = l.Log(event)
+	if err != nil {
+		l.onError(err)
+	}
+}
@@ -0,0 +1,156 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func generateSigner(t *testing.T) ssh.Signer {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(private)
+	assert.NoError(t, err)
+	return signer
+}
+
+// readEvents parses the audit log
+func readEvents(t *testing.T, log string) []map[string]interface{} {
+	var events []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(log), "\n") {
+		event := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &event))
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestLogger_WritesJSONLines(t *testing.T) {
+	var output bytes.Buffer
+	logger := NewLogger(&output)
+	logger.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("PST", -8*3600)) }
+
+	assert.NoError(t, logger.Log(Event{Event: Request, ConnectionID: "0a1b", Request: "exec", Command: "ls", Outcome: Success}))
+	closed := Event{Event: ChannelClosed}
+	closed.Closed(10, 0, time.Now())
+	assert.NoError(t, logger.Log(closed))
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	assert.Equal(t, `{"v":1,"time":"2024-01-02T11:04:05Z","event":"request","connection_id":"0a1b","outcome":"success","request":"exec","command":"ls"}`, lines[0])
+	assert.Contains(t, lines[1], `"bytes_in":10,"bytes_out":0,"duration_ms":0`)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestLogger_ReturnsWriteErrors(t *testing.T) {
+	assert.Error(t, NewLogger(failingWriter{}).Log(Event{Event: Error}))
+}
+
+func TestOpen_AppendsToTheLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	filename := path.Join(dir, "audit.log")
+
+	for i := 0; i < 2; i++ {
+		logger, err := Open(filename)
+		assert.NoError(t, err)
+		assert.NoError(t, logger.Log(Event{Event: ConnectionOpened}))
+		assert.NoError(t, logger.Close())
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(data), "connection_open"))
+	info, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+// login connects a client to the server
+func login(t *testing.T, sshConf *ssh.ServerConfig, clientConf *ssh.ClientConfig) error {
+	signer := generateSigner(t)
+	sshConf.AddHostKey(signer)
+	clientConf.HostKeyCallback = ssh.FixedHostKey(signer.PublicKey())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	assert.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+
+	go func() {
+		conn, err := ssh.Dial("tcp", listener.Addr().String(), clientConf)
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+	srv, err := listener.Accept()
+	assert.NoError(t, err)
+	defer func() { _ = srv.Close() }()
+	_, _, _, err = ssh.NewServerConn(srv, sshConf)
+	return err
+}
+
+func TestLogger_LogsAuthenticationAttempts(t *testing.T) {
+	authorized := generateSigner(t)
+	other := generateSigner(t)
+	var logged []string
+	sshConf := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.PublicKey().Marshal()) {
+				return &ssh.Permissions{}, nil
+			}
+			return nil, errors.New("Unauthorized key")
+		},
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return nil, errors.New("Invalid password")
+		},
+		AuthLogCallback: func(conn ssh.ConnMetadata, method string, err error) {
+			logged = append(logged, method)
+		},
+	}
+	var output bytes.Buffer
+	logger := NewLogger(&output)
+	logger.WatchAuthentication(sshConf)
+
+	err := login(t, sshConf, &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{ssh.Password("guess"), ssh.PublicKeys(other, authorized)},
+	})
+	assert.NoError(t, err)
+
+	// The existing callback is still called
+	assert.Equal(t, []string{"none", "password", "publickey", "publickey"}, logged)
+	events := readEvents(t, output.String())
+	assert.Len(t, events, 3)
+	for _, event := range events {
+		assert.Equal(t, "auth", event["event"])
+		assert.Equal(t, "alice", event["user"])
+		assert.Contains(t, event["remote_addr"], "127.0.0.1:")
+		assert.Len(t, event["connection_id"], 16)
+	}
+	assert.Equal(t, "password", events[0]["method"])
+	assert.Equal(t, "failure", events[0]["outcome"])
+	assert.Equal(t, "Invalid password", events[0]["error"])
+	assert.Equal(t, "failure", events[1]["outcome"])
+	assert.Equal(t, ssh.FingerprintSHA256(other.PublicKey()), events[1]["fingerprint"])
+	assert.Equal(t, "publickey", events[2]["method"])
+	assert.Equal(t, "success", events[2]["outcome"])
+	assert.Equal(t, ssh.FingerprintSHA256(authorized.PublicKey()), events[2]["fingerprint"])
+	assert.Empty(t, logger.offered)
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// An ApprovalRequest describes an authenticated login that's waiting for the
+// host's approval
+type ApprovalRequest struct {
+	User       string
+	RemoteAddr string
+	// Method is the authentication method that succeeded
+	Method string
+	// Fingerprint is the SHA256 fingerprint of the client's key, if a key
+	// was used
+	Fingerprint string
+}
+
+func (r *ApprovalRequest) String() string {
+	if r.Fingerprint != "" {
+		return fmt.Sprintf("%s from %s with key %s", r.User, r.RemoteAddr, r.Fingerprint)
+	}
+	return fmt.Sprintf("%s from %s with %s", r.User, r.RemoteAddr, r.Method)
+}
+
+// An Approver returns true if the host allows the login
+type Approver func(request *ApprovalRequest) bool
+
+// An Asker asks the host a question and waits for the answer. It returns false
+// if the host didn't answer in time.
+type Asker interface {
+	Ask(question string, timeout time.Duration) (string, bool)
+}
+
+// CreateConsoleApprover creates an Approver that asks the host to approve
+// each login. Logins are denied unless the host answers yes before the
+// timeout.
+func CreateConsoleApprover(asker Asker, timeout time.Duration) Approver {
+	return func(request *ApprovalRequest) bool {
+		question := fmt.Sprintf("\nAllow %s to log in? (denied in %s) [y/N] ", request, timeout)
+		answer, ok := asker.Ask(question, timeout)
+		if !ok {
+			return false
+		}
+		answer = strings.ToLower(answer)
+		return answer == "y" || answer == "yes"
+	}
+}
+
+func newApprovalRequest(conn ssh.ConnMetadata, method string, key ssh.PublicKey) *ApprovalRequest {
+	request := &ApprovalRequest{
+		User:       conn.User(),
+		RemoteAddr: conn.RemoteAddr().String(),
+		Method:     method,
+	}
+	if key != nil {
+		request.Fingerprint = ssh.FingerprintSHA256(key)
+	}
+	return request
+}
+
+// approved returns a function that asks for the login to be approved once
+// it's complete
+func approved(approver Approver, request *ApprovalRequest) func(*ssh.Permissions) (*ssh.Permissions, error) {
+	return func(perms *ssh.Permissions) (*ssh.Permissions, error) {
+		if !approver(request) {
+			return nil, fmt.Errorf("The host didn't approve the login of %s", request)
+		}
+		return perms, nil
+	}
+}
+
+// CreateApprovedPasswordCallback wraps a password callback so that each
+// login with the correct password must also be approved. If a code is
+// required the host is only asked once it's been entered.
+func CreateApprovedPasswordCallback(callback func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error), approver Approver) func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		perms, err := callback(conn, password)
+		return completed(perms, err, approved(approver, newApprovalRequest(conn, "password", nil)))
+	}
+}
+
+// CreateApprovalCallback wraps a VerifiedPublicKeyCallback, which may be nil,
+// so that each login with a key must be approved. The callback is only
+// called once the client has proven it has the private key. If a code is
+// required the host is only asked once it's been entered.
+func CreateApprovalCallback(verified func(ssh.ConnMetadata, ssh.PublicKey, *ssh.Permissions, string) (*ssh.Permissions, error), approver Approver) func(ssh.ConnMetadata, ssh.PublicKey, *ssh.Permissions, string) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey, perms *ssh.Permissions, signatureAlgorithm string) (*ssh.Permissions, error) {
+		var err error
+		if verified != nil {
+			perms, err = verified(conn, key, perms, signatureAlgorithm)
+		}
+		return completed(perms, err, approved(approver, newApprovalRequest(conn, "publickey", key)))
+	}
+}
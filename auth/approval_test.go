@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAsker answers every question with answer
+type fakeAsker struct {
+	answer    string
+	answered  bool
+	questions []string
+	timeouts  []time.Duration
+}
+
+func (a *fakeAsker) Ask(question string, timeout time.Duration) (string, bool) {
+	a.questions = append(a.questions, question)
+	a.timeouts = append(a.timeouts, timeout)
+	return a.answer, a.answered
+}
+
+func TestCreateConsoleApprover_ApprovesOnYes(t *testing.T) {
+	for _, answer := range []string{"y", "Y", "yes", "YES"} {
+		asker := &fakeAsker{answer: answer, answered: true}
+		approved := CreateConsoleApprover(asker, time.Minute)(&ApprovalRequest{User: "alice", RemoteAddr: "10.0.0.1:22", Method: "password"})
+		assert.True(t, approved, answer)
+		assert.Contains(t, asker.questions[0], "alice from 10.0.0.1:22 with password")
+		assert.Equal(t, []time.Duration{time.Minute}, asker.timeouts)
+	}
+}
+
+func TestCreateConsoleApprover_DeniesByDefault(t *testing.T) {
+	for _, asker := range []*fakeAsker{
+		{answer: "", answered: true},
+		{answer: "no", answered: true},
+		{answer: "sure", answered: true},
+		{answer: "", answered: false},
+	} {
+		assert.False(t, CreateConsoleApprover(asker, time.Minute)(&ApprovalRequest{}))
+	}
+}
+
+func TestApprovalRequest_ShowsKeyFingerprint(t *testing.T) {
+	key, _ := generatePublicKey(t)
+
+	request := newApprovalRequest(connFrom("10.0.0.1"), "publickey", key)
+
+	assert.Equal(t, "guest from 10.0.0.1:1234 with key "+ssh.FingerprintSHA256(key), request.String())
+}
+
+func TestCreateApprovedPasswordCallback_RequiresApproval(t *testing.T) {
+	var requests []*ApprovalRequest
+	approve := false
+	approver := func(request *ApprovalRequest) bool {
+		requests = append(requests, request)
+		return approve
+	}
+	callback := CreateApprovedPasswordCallback(CreatePasswordCallback("hi"), approver)
+
+	_, err := callback(connFrom("127.0.0.1"), []byte("hi"))
+	assert.Error(t, err)
+	approve = true
+	_, err = callback(connFrom("127.0.0.1"), []byte("hi"))
+	assert.NoError(t, err)
+	assert.Len(t, requests, 2)
+	assert.Equal(t, "password", requests[0].Method)
+}
+
+func TestCreateApprovedPasswordCallback_DoesntAskForBadPasswords(t *testing.T) {
+	approver := func(request *ApprovalRequest) bool {
+		assert.Fail(t, "Shouldn't ask for approval")
+		return true
+	}
+
+	_, err := CreateApprovedPasswordCallback(CreatePasswordCallback("hi"), approver)(connFrom("127.0.0.1"), []byte("bad"))
+	assert.Error(t, err)
+}
+
+func TestCreateApprovalCallback_RequiresApproval(t *testing.T) {
+	key, _ := generatePublicKey(t)
+	perms := &ssh.Permissions{}
+	var request *ApprovalRequest
+	approve := false
+	callback := CreateApprovalCallback(nil, func(r *ApprovalRequest) bool {
+		request = r
+		return approve
+	})
+
+	_, err := callback(connFrom("127.0.0.1"), key, perms, ssh.KeyAlgoED25519)
+	assert.Error(t, err)
+	assert.Equal(t, ssh.FingerprintSHA256(key), request.Fingerprint)
+
+	approve = true
+	approved, err := callback(connFrom("127.0.0.1"), key, perms, ssh.KeyAlgoED25519)
+	assert.NoError(t, err)
+	assert.Equal(t, perms, approved)
+}
+
+func TestApproval_AsksOnceTheCodeIsEntered(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	totp := newTOTP(rfcSecret, "gmash", "guest", 1, fixedClock(&now))
+	client := generateSigner(t)
+	var requests []*ApprovalRequest
+	approver := func(request *ApprovalRequest) bool {
+		requests = append(requests, request)
+		return true
+	}
+	newConf := func() *ssh.ServerConfig {
+		sshConf := &ssh.ServerConfig{
+			PasswordCallback:  CreatePasswordCallback("hi"),
+			PublicKeyCallback: CreatePublicKeyCallback([]*AuthorizedKey{{Key: client.PublicKey()}}),
+		}
+		totp.Require(sshConf)
+		sshConf.PasswordCallback = CreateApprovedPasswordCallback(sshConf.PasswordCallback, approver)
+		sshConf.VerifiedPublicKeyCallback = CreateApprovalCallback(sshConf.VerifiedPublicKeyCallback, approver)
+		return sshConf
+	}
+
+	// The host isn't asked about logins with the wrong code
+	_, err := login(t, newConf(), &ssh.ClientConfig{User: "guest", Auth: []ssh.AuthMethod{ssh.Password("hi"), answer("000000")}})
+	assert.Error(t, err)
+	_, err = login(t, newConf(), &ssh.ClientConfig{User: "guest", Auth: []ssh.AuthMethod{ssh.PublicKeys(client), answer("000000")}})
+	assert.Error(t, err)
+	assert.Empty(t, requests)
+
+	_, err = login(t, newConf(), &ssh.ClientConfig{User: "alice", Auth: []ssh.AuthMethod{ssh.Password("hi"), answer("081804")}})
+	assert.NoError(t, err)
+	_, err = login(t, newConf(), &ssh.ClientConfig{User: "bob", Auth: []ssh.AuthMethod{ssh.PublicKeys(client), answer("081804")}})
+	assert.NoError(t, err)
+	assert.Len(t, requests, 2)
+	assert.Equal(t, "password", requests[0].Method)
+	assert.Equal(t, "publickey", requests[1].Method)
+}
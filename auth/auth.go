@@ -1,12 +1,20 @@
 package auth
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base32"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path"
+	"strings"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -21,40 +29,169 @@ func GeneratePassword(len int) (string, error) {
 	return base32.StdEncoding.EncodeToString(buffer), nil
 }
 
-// TryLoadKeys tries to load keys from keyPath. If no key exists generate it and save it
-func TryLoadKeys(keyPath string) (ssh.Signer, error) {
-	generateKey := func() (ssh.Signer, error) {
-		private, err := rsa.GenerateKey(rand.Reader, 2048)
+// A KeyType is a type of host key
+type KeyType string
+
+// The supported host key types
+const (
+	KeyTypeEd25519 KeyType = "ed25519"
+	KeyTypeECDSA   KeyType = "ecdsa"
+	KeyTypeRSA     KeyType = "rsa"
+)
+
+// ParseKeyTypes parses a comma separated list of key types
+func ParseKeyTypes(list string) ([]KeyType, error) {
+	keyTypes := []KeyType{}
+	for _, name := range strings.Split(list, ",") {
+		keyType := KeyType(strings.ToLower(strings.TrimSpace(name)))
+		switch keyType {
+		case KeyTypeEd25519, KeyTypeECDSA, KeyTypeRSA:
+			keyTypes = append(keyTypes, keyType)
+		default:
+			return nil, fmt.Errorf("Unknown host key type %q (expected ed25519, ecdsa or rsa)", name)
+		}
+	}
+	return keyTypes, nil
+}
+
+// matches returns true if the public key is of this type
+func (t KeyType) matches(public ssh.PublicKey) bool {
+	switch t {
+	case KeyTypeEd25519:
+		return public.Type() == ssh.KeyAlgoED25519
+	case KeyTypeECDSA:
+		return strings.HasPrefix(public.Type(), "ecdsa-sha2-")
+	case KeyTypeRSA:
+		return public.Type() == ssh.KeyAlgoRSA
+	}
+	return false
+}
+
+// generatePrivateKey creates a new private key of the given type
+func generatePrivateKey(keyType KeyType) (crypto.PrivateKey, error) {
+	switch keyType {
+	case KeyTypeEd25519:
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		return private, err
+	case KeyTypeECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	}
+	return nil, fmt.Errorf("Unknown host key type %q", keyType)
+}
+
+// GenerateHostKey creates a new host key that isn't saved
+func GenerateHostKey(keyType KeyType) (ssh.Signer, error) {
+	private, err := generatePrivateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(private)
+}
+
+// HostKeyPath returns where the host key of the given type is kept in dir.
+// The RSA key keeps the name gmash has always used.
+func HostKeyPath(dir string, keyType KeyType) string {
+	if keyType == KeyTypeRSA {
+		return path.Join(dir, "key")
+	}
+	return path.Join(dir, "key_"+string(keyType))
+}
+
+// LoadHostKeys loads the host keys of the given types from dir, generating
+// any that don't exist
+func LoadHostKeys(dir string, keyTypes []KeyType) ([]ssh.Signer, error) {
+	signers := []ssh.Signer{}
+	for _, keyType := range keyTypes {
+		signer, err := TryLoadKeys(HostKeyPath(dir, keyType), keyType)
 		if err != nil {
 			return nil, err
 		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
 
-		// Try and save the key to a file
-		bytes := x509.MarshalPKCS1PrivateKey(private)
-
-		err = ioutil.WriteFile(keyPath, bytes, 0400)
+// TryLoadKeys tries to load a key of the given type from keyPath. If no key
+// exists generate it and save it in the OpenSSH format. A key that exists but
+// can't be loaded is an error rather than being replaced, as guests may have
+// pinned its fingerprint.
+func TryLoadKeys(keyPath string, keyType KeyType) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		private, err := generatePrivateKey(keyType)
+		if err != nil {
+			return nil, err
+		}
+		err = saveKey(keyPath, private)
 		if err != nil {
 			return nil, err
 		}
 		return ssh.NewSignerFromKey(private)
 	}
-
-	// Load the key from a file, create a new on on failure
-	der, err := ioutil.ReadFile(keyPath)
 	if err != nil {
-		return generateKey()
+		return nil, fmt.Errorf("Unable to read host key %s (%s)", keyPath, err)
 	}
-	private, err := x509.ParsePKCS1PrivateKey(der)
+
+	private, err := ssh.ParseRawPrivateKey(data)
 	if err != nil {
-		return generateKey()
+		// Older versions of gmash saved the RSA key as PKCS#1 DER so convert
+		// it to keep its fingerprint
+		legacy, lerr := x509.ParsePKCS1PrivateKey(data)
+		if lerr != nil {
+			return nil, fmt.Errorf("Unable to parse host key %s (%s), move it aside to generate a new key", keyPath, err)
+		}
+		private = legacy
+		err = saveKey(keyPath, private)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ed25519Key, ok := private.(*ed25519.PrivateKey); ok {
+		private = *ed25519Key
 	}
 	signer, err := ssh.NewSignerFromKey(private)
 	if err != nil {
-		return generateKey()
+		return nil, fmt.Errorf("Unable to use host key %s (%s)", keyPath, err)
+	}
+	if !keyType.matches(signer.PublicKey()) {
+		return nil, fmt.Errorf("The host key %s is %s not %s", keyPath, signer.PublicKey().Type(), keyType)
 	}
 	return signer, nil
 }
 
+// saveKey writes the private key to keyPath in the OpenSSH format. The key is
+// written to a temporary file first so an existing key is never left half
+// written.
+func saveKey(keyPath string, private crypto.PrivateKey) error {
+	block, err := ssh.MarshalPrivateKey(private, "gmash host key")
+	if err != nil {
+		return fmt.Errorf("Unable to encode host key (%s)", err)
+	}
+
+	file, err := ioutil.TempFile(path.Dir(keyPath), ".key")
+	if err != nil {
+		return fmt.Errorf("Unable to save host key %s (%s)", keyPath, err)
+	}
+	defer func() { _ = os.Remove(file.Name()) }()
+
+	err = pem.Encode(file, block)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0400)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), keyPath)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to save host key %s (%s)", keyPath, err)
+	}
+	return nil
+}
+
 // GetFingerPrint takes returns the keys MD5 fingerprint of the signer
 func GetFingerPrint(signer ssh.Signer) (string, string) {
 	return ssh.FingerprintLegacyMD5(signer.PublicKey()),
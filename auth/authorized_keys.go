@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The permissions granted to a session. These are the standard OpenSSH
+// certificate extensions so certificates and authorized keys are restricted
+// the same way. If ssh.Permissions has no extensions everything is permitted.
+const (
+	PermitPty             = "permit-pty"
+	PermitPortForwarding  = "permit-port-forwarding"
+	PermitAgentForwarding = "permit-agent-forwarding"
+	PermitX11Forwarding   = "permit-X11-forwarding"
+	PermitUserRC          = "permit-user-rc"
+)
+
+// ForceCommand is the critical option with the command a session is
+// restricted to
+const ForceCommand = "force-command"
+
+// An AuthorizedKey is a public key that's allowed to log in along with the
+// restrictions from its authorized_keys options (See sshd(8))
+type AuthorizedKey struct {
+	Key     ssh.PublicKey
+	Comment string
+	// Command is run instead of the client's shell or command (command=)
+	Command string
+	// From restricts the addresses the key can be used from (from=). Patterns
+	// are matched against the client's IP address and may be CIDR ranges or
+	// use * and ? wildcards. A pattern starting with ! rejects matching
+	// addresses.
+	From              []string
+	NoPty             bool
+	NoPortForwarding  bool
+	NoAgentForwarding bool
+	NoX11Forwarding   bool
+	NoUserRC          bool
+}
+
+// ParseAuthorizedKey parses a single line in the authorized_keys format
+func ParseAuthorizedKey(line string) (*AuthorizedKey, error) {
+	key, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse authorized key (%s)", err)
+	}
+	authorizedKey := &AuthorizedKey{Key: key, Comment: comment}
+	for _, option := range options {
+		err = authorizedKey.setOption(option)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return authorizedKey, nil
+}
+
+// ParseAuthorizedKeys parses the contents of an authorized_keys file
+func ParseAuthorizedKeys(data []byte) ([]*AuthorizedKey, error) {
+	var keys []*AuthorizedKey
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, err := ParseAuthorizedKey(string(line))
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %s", i+1, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// LoadAuthorizedKeys loads the keys from an authorized_keys file
+func LoadAuthorizedKeys(keysPath string) ([]*AuthorizedKey, error) {
+	data, err := ioutil.ReadFile(keysPath)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read authorized keys (%s)", err)
+	}
+	keys, err := ParseAuthorizedKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load authorized keys from %s (%s)", keysPath, err)
+	}
+	return keys, nil
+}
+
+func (k *AuthorizedKey) setOption(option string) error {
+	name, value, hasValue := strings.Cut(option, "=")
+	if hasValue {
+		unquoted, err := unquoteOption(value)
+		if err != nil {
+			return fmt.Errorf("Invalid authorized key option %s (%s)", name, err)
+		}
+		value = unquoted
+	}
+
+	switch strings.ToLower(name) {
+	case "command":
+		k.Command = value
+	case "from":
+		k.From = strings.Split(value, ",")
+	case "no-pty":
+		k.NoPty = true
+	case "no-port-forwarding":
+		k.NoPortForwarding = true
+	case "no-agent-forwarding":
+		k.NoAgentForwarding = true
+	case "no-x11-forwarding":
+		k.NoX11Forwarding = true
+	case "no-user-rc":
+		k.NoUserRC = true
+	case "restrict":
+		k.NoPty = true
+		k.NoPortForwarding = true
+		k.NoAgentForwarding = true
+		k.NoX11Forwarding = true
+		k.NoUserRC = true
+	case "pty":
+		k.NoPty = false
+	default:
+		return fmt.Errorf("Unsupported authorized key option %s", name)
+	}
+	return nil
+}
+
+// unquoteOption removes the quotes around an option's value
+func unquoteOption(value string) (string, error) {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return "", fmt.Errorf("Missing quotes")
+	}
+	return strings.ReplaceAll(value[1:len(value)-1], `\"`, `"`), nil
+}
+
+// Permissions returns the permissions for a session authenticated with the
+// key
+func (k *AuthorizedKey) Permissions() *ssh.Permissions {
+	perms := &ssh.Permissions{
+		CriticalOptions: map[string]string{},
+		Extensions:      map[string]string{},
+	}
+	if k.Command != "" {
+		perms.CriticalOptions[ForceCommand] = k.Command
+	}
+	permit := func(extension string, denied bool) {
+		if !denied {
+			perms.Extensions[extension] = ""
+		}
+	}
+	permit(PermitPty, k.NoPty)
+	permit(PermitPortForwarding, k.NoPortForwarding)
+	permit(PermitAgentForwarding, k.NoAgentForwarding)
+	permit(PermitX11Forwarding, k.NoX11Forwarding)
+	permit(PermitUserRC, k.NoUserRC)
+	return perms
+}
+
+// allowedFrom returns true if the key can be used from the remote address
+func (k *AuthorizedKey) allowedFrom(addr net.Addr) bool {
+	if len(k.From) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	return matchAddress(k.From, host)
+}
+
+// matchAddress returns true if the IP address matches a pattern and doesn't
+// match a negated pattern
+func matchAddress(patterns []string, host string) bool {
+	ip := net.ParseIP(host)
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		var match bool
+		if _, ipNet, err := net.ParseCIDR(pattern); err == nil {
+			match = ip != nil && ipNet.Contains(ip)
+		} else {
+			match, _ = path.Match(pattern, host)
+		}
+		if match && negated {
+			return false
+		}
+		matched = matched || match
+	}
+	return matched
+}
+
+// CreatePublicKeyCallback creates a function for authenticating with the
+// authorized keys
+func CreatePublicKeyCallback(keys []*AuthorizedKey) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		marshaled := key.Marshal()
+		wrongAddress := false
+		for _, authorizedKey := range keys {
+			if !bytes.Equal(authorizedKey.Key.Marshal(), marshaled) {
+				continue
+			}
+			// The key may be listed again with different restrictions
+			if !authorizedKey.allowedFrom(conn.RemoteAddr()) {
+				wrongAddress = true
+				continue
+			}
+			return authorizedKey.Permissions(), nil
+		}
+		if wrongAddress {
+			return nil, fmt.Errorf("Key %s isn't allowed from %s", ssh.FingerprintSHA256(key), conn.RemoteAddr())
+		}
+		return nil, fmt.Errorf("Unauthorized key %s", ssh.FingerprintSHA256(key))
+	}
+}
+
+// Permitted returns true if the session's permissions include the extension
+func Permitted(perms *ssh.Permissions, extension string) bool {
+	if perms == nil || perms.Extensions == nil {
+		return true
+	}
+	_, ok := perms.Extensions[extension]
+	return ok
+}
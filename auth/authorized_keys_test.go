@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConnMetadata is the ssh.ConnMetadata of a client at remoteAddr
+type fakeConnMetadata struct {
+	ssh.ConnMetadata
+	user       string
+	remoteAddr net.Addr
+	sessionID  string
+}
+
+func (c fakeConnMetadata) User() string {
+	return c.user
+}
+
+func (c fakeConnMetadata) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c fakeConnMetadata) SessionID() []byte {
+	return []byte(c.sessionID)
+}
+
+func connFrom(ip string) ssh.ConnMetadata {
+	return fakeConnMetadata{user: "guest", remoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}}
+}
+
+func generatePublicKey(t *testing.T) (ssh.PublicKey, string) {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	key, err := ssh.NewPublicKey(public)
+	assert.NoError(t, err)
+	return key, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestParseAuthorizedKey_ParsesOptions(t *testing.T) {
+	key, line := generatePublicKey(t)
+
+	authorizedKey, err := ParseAuthorizedKey(`command="echo \"hi\"",from="10.0.0.0/8,!10.0.0.1",no-pty ` + line + " alice@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, key.Marshal(), authorizedKey.Key.Marshal())
+	assert.Equal(t, "alice@example.com", authorizedKey.Comment)
+	assert.Equal(t, `echo "hi"`, authorizedKey.Command)
+	assert.Equal(t, []string{"10.0.0.0/8", "!10.0.0.1"}, authorizedKey.From)
+	assert.True(t, authorizedKey.NoPty)
+	assert.False(t, authorizedKey.NoPortForwarding)
+}
+
+func TestParseAuthorizedKey_RestrictCanBeRelaxed(t *testing.T) {
+	_, line := generatePublicKey(t)
+
+	authorizedKey, err := ParseAuthorizedKey("restrict,pty " + line)
+	assert.NoError(t, err)
+	assert.False(t, authorizedKey.NoPty)
+	assert.True(t, authorizedKey.NoPortForwarding)
+	assert.True(t, authorizedKey.NoAgentForwarding)
+	assert.True(t, authorizedKey.NoX11Forwarding)
+}
+
+func TestParseAuthorizedKey_RejectsUnsupportedOptions(t *testing.T) {
+	_, line := generatePublicKey(t)
+
+	_, err := ParseAuthorizedKey("tunnel=\"0\" " + line)
+	assert.Error(t, err)
+}
+
+func TestParseAuthorizedKey_RejectsInvalidKeys(t *testing.T) {
+	_, err := ParseAuthorizedKey("ssh-ed25519 bogus")
+	assert.Error(t, err)
+}
+
+func TestLoadAuthorizedKeys_SkipsCommentsAndBlankLines(t *testing.T) {
+	_, line0 := generatePublicKey(t)
+	_, line1 := generatePublicKey(t)
+	dir, err := ioutil.TempDir("", "keys")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	keysPath := path.Join(dir, "authorized_keys")
+	assert.NoError(t, ioutil.WriteFile(keysPath, []byte("# guests\n"+line0+"\n\n  "+line1+"\n"), 0600))
+
+	keys, err := LoadAuthorizedKeys(keysPath)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+}
+
+func TestLoadAuthorizedKeys_ReportsBadLine(t *testing.T) {
+	_, line := generatePublicKey(t)
+
+	_, err := ParseAuthorizedKeys([]byte(line + "\nbogus\n"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Line 2")
+}
+
+func TestLoadAuthorizedKeys_ReturnsErrorForMissingFile(t *testing.T) {
+	_, err := LoadAuthorizedKeys("/does/not/exist")
+	assert.Error(t, err)
+}
+
+func TestCreatePublicKeyCallback_AcceptsAuthorizedKeys(t *testing.T) {
+	key, line := generatePublicKey(t)
+	authorizedKey, err := ParseAuthorizedKey(`command="uptime",no-pty ` + line)
+	assert.NoError(t, err)
+
+	perms, err := CreatePublicKeyCallback([]*AuthorizedKey{authorizedKey})(connFrom("127.0.0.1"), key)
+	assert.NoError(t, err)
+	assert.Equal(t, "uptime", perms.CriticalOptions[ForceCommand])
+	assert.False(t, Permitted(perms, PermitPty))
+	assert.True(t, Permitted(perms, PermitPortForwarding))
+}
+
+func TestCreatePublicKeyCallback_RejectsOtherKeys(t *testing.T) {
+	_, line := generatePublicKey(t)
+	other, _ := generatePublicKey(t)
+	authorizedKey, err := ParseAuthorizedKey(line)
+	assert.NoError(t, err)
+
+	perms, err := CreatePublicKeyCallback([]*AuthorizedKey{authorizedKey})(connFrom("127.0.0.1"), other)
+	assert.Nil(t, perms)
+	assert.Error(t, err)
+}
+
+func TestCreatePublicKeyCallback_EnforcesFrom(t *testing.T) {
+	key, line := generatePublicKey(t)
+	authorizedKey, err := ParseAuthorizedKey(`from="192.168.1.*,10.0.0.0/8,!10.0.0.1" ` + line)
+	assert.NoError(t, err)
+	callback := CreatePublicKeyCallback([]*AuthorizedKey{authorizedKey})
+
+	for _, ip := range []string{"192.168.1.5", "10.1.2.3"} {
+		_, err = callback(connFrom(ip), key)
+		assert.NoError(t, err, ip)
+	}
+	for _, ip := range []string{"192.168.2.5", "10.0.0.1", "127.0.0.1"} {
+		_, err = callback(connFrom(ip), key)
+		assert.Error(t, err, ip)
+	}
+}
+
+func TestPermitted_AllowsEverythingWithoutExtensions(t *testing.T) {
+	assert.True(t, Permitted(nil, PermitPty))
+	assert.True(t, Permitted(&ssh.Permissions{}, PermitPty))
+	assert.False(t, Permitted(&ssh.Permissions{Extensions: map[string]string{}}, PermitPty))
+}
@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SourceAddress is the critical option with the addresses a certificate can
+// be used from
+const SourceAddress = "source-address"
+
+// ParseCAKeys parses certificate authority public keys, one per line, in the
+// format of sshd's TrustedUserCAKeys. Lines may start with the cert-authority
+// option from authorized_keys files.
+func ParseCAKeys(data []byte) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, _, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: Unable to parse CA key (%s)", i+1, err)
+		}
+		for _, option := range options {
+			if option != "cert-authority" {
+				return nil, fmt.Errorf("Line %d: Unsupported CA key option %s", i+1, option)
+			}
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No CA keys found")
+	}
+	return keys, nil
+}
+
+// LoadCAKeys loads the certificate authority public keys from a file
+func LoadCAKeys(keysPath string) ([]ssh.PublicKey, error) {
+	data, err := ioutil.ReadFile(keysPath)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read CA keys (%s)", err)
+	}
+	keys, err := ParseCAKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load CA keys from %s (%s)", keysPath, err)
+	}
+	return keys, nil
+}
+
+// CreateCertificateCallback creates a function for authenticating with user
+// certificates signed by one of the CAs. The certificate must list one of the
+// principals, or the user's login name if there are no principals. Keys that
+// aren't certificates are passed to fallback if it isn't nil.
+func CreateCertificateCallback(caKeys []ssh.PublicKey, principals []string, fallback func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error)) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			marshaled := auth.Marshal()
+			for _, caKey := range caKeys {
+				if bytes.Equal(caKey.Marshal(), marshaled) {
+					return true
+				}
+			}
+			return false
+		},
+		SupportedCriticalOptions: []string{ForceCommand, SourceAddress},
+	}
+
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		cert, ok := key.(*ssh.Certificate)
+		if !ok {
+			if fallback != nil {
+				return fallback(conn, key)
+			}
+			return nil, fmt.Errorf("Key %s isn't a certificate", ssh.FingerprintSHA256(key))
+		}
+		if cert.CertType != ssh.UserCert {
+			return nil, fmt.Errorf("Certificate %s isn't a user certificate", cert.KeyId)
+		}
+		if !checker.IsUserAuthority(cert.SignatureKey) {
+			return nil, fmt.Errorf("Certificate %s isn't signed by a trusted CA", cert.KeyId)
+		}
+
+		allowed := principals
+		if len(allowed) == 0 {
+			allowed = []string{conn.User()}
+		}
+		var err error
+		for _, principal := range allowed {
+			err = checker.CheckCert(principal, cert)
+			if err == nil {
+				break
+			}
+		}
+		if err == nil {
+			err = checkSourceAddress(cert, conn.RemoteAddr())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Certificate %s was rejected (%s)", cert.KeyId, err)
+		}
+		return certificatePermissions(cert), nil
+	}
+}
+
+// checkSourceAddress returns an error if the certificate has a
+// source-address option that doesn't list the remote address. The option is
+// a comma separated list of addresses and CIDR ranges (See OpenSSH's
+// PROTOCOL.certkeys).
+func checkSourceAddress(cert *ssh.Certificate, addr net.Addr) error {
+	sources, ok := cert.CriticalOptions[SourceAddress]
+	if !ok {
+		return nil
+	}
+	ip := net.ParseIP(hostOf(addr))
+	for _, source := range strings.Split(sources, ",") {
+		source = strings.TrimSpace(source)
+		if _, ipNet, err := net.ParseCIDR(source); err == nil {
+			if ip != nil && ipNet.Contains(ip) {
+				return nil
+			}
+			continue
+		}
+		sourceIP := net.ParseIP(source)
+		if sourceIP == nil {
+			return fmt.Errorf("invalid source-address %s", source)
+		}
+		if sourceIP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s isn't an allowed source-address", addr)
+}
+
+// certificatePermissions returns the permissions granted by the certificate.
+// A certificate without extensions grants nothing, unlike a plain key.
+func certificatePermissions(cert *ssh.Certificate) *ssh.Permissions {
+	perms := &ssh.Permissions{
+		CriticalOptions: map[string]string{},
+		Extensions:      map[string]string{},
+	}
+	for name, value := range cert.CriticalOptions {
+		perms.CriticalOptions[name] = value
+	}
+	for name, value := range cert.Extensions {
+		perms.Extensions[name] = value
+	}
+	return perms
+}
+
+// LoadHostCertificate loads a host certificate and pairs it with the host key
+// it certifies
+func LoadHostCertificate(certPath string, signers []ssh.Signer) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read host certificate (%s)", err)
+	}
+	signer, err := NewHostCertSigner(data, signers)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load host certificate %s (%s)", certPath, err)
+	}
+	return signer, nil
+}
+
+// NewHostCertSigner parses a host certificate and pairs it with the host key
+// it certifies
+func NewHostCertSigner(data []byte, signers []ssh.Signer) (ssh.Signer, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't a certificate", key.Type())
+	}
+	if cert.CertType != ssh.HostCert {
+		return nil, fmt.Errorf("%s isn't a host certificate", cert.KeyId)
+	}
+	now := time.Now()
+	if cert.ValidBefore != ssh.CertTimeInfinity && now.After(time.Unix(int64(cert.ValidBefore), 0)) {
+		return nil, fmt.Errorf("%s has expired", cert.KeyId)
+	}
+	if now.Before(time.Unix(int64(cert.ValidAfter), 0)) {
+		return nil, fmt.Errorf("%s isn't valid until %s", cert.KeyId, time.Unix(int64(cert.ValidAfter), 0).Format(time.RFC3339))
+	}
+
+	marshaled := cert.Key.Marshal()
+	for _, signer := range signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), marshaled) {
+			return ssh.NewCertSigner(cert, signer)
+		}
+	}
+	return nil, fmt.Errorf("%s doesn't certify any of the host keys", cert.KeyId)
+}
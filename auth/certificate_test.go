@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func generateSigner(t *testing.T) ssh.Signer {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(private)
+	assert.NoError(t, err)
+	return signer
+}
+
+// signCert creates a certificate for key signed by ca that's valid for an hour
+func signCert(t *testing.T, ca ssh.Signer, key ssh.PublicKey, certType uint32, principals ...string) *ssh.Certificate {
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             key,
+		KeyId:           "test",
+		CertType:        certType,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+	}
+	assert.NoError(t, cert.SignCert(rand.Reader, ca))
+	return cert
+}
+
+func TestParseCAKeys(t *testing.T) {
+	ca := generateSigner(t)
+	line := string(ssh.MarshalAuthorizedKey(ca.PublicKey()))
+
+	keys, err := ParseCAKeys([]byte("# Our CA\n" + line + "cert-authority " + line))
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	_, err = ParseCAKeys([]byte("no-pty " + line))
+	assert.Error(t, err)
+	_, err = ParseCAKeys([]byte("# Nothing\n"))
+	assert.Error(t, err)
+}
+
+func TestCreateCertificateCallback_AcceptsLoginNamePrincipal(t *testing.T) {
+	ca := generateSigner(t)
+	cert := signCert(t, ca, generateSigner(t).PublicKey(), ssh.UserCert, "guest")
+	cert.Extensions = map[string]string{PermitPty: ""}
+	cert.CriticalOptions = map[string]string{ForceCommand: "uptime"}
+	assert.NoError(t, cert.SignCert(rand.Reader, ca))
+	callback := CreateCertificateCallback([]ssh.PublicKey{ca.PublicKey()}, nil, nil)
+
+	perms, err := callback(connFrom("10.0.0.1"), cert)
+	assert.NoError(t, err)
+	assert.True(t, Permitted(perms, PermitPty))
+	assert.False(t, Permitted(perms, PermitPortForwarding))
+	assert.Equal(t, "uptime", perms.CriticalOptions[ForceCommand])
+
+	_, err = callback(fakeConnMetadata{user: "root"}, cert)
+	assert.Error(t, err)
+}
+
+func TestCreateCertificateCallback_AcceptsConfiguredPrincipals(t *testing.T) {
+	ca := generateSigner(t)
+	callback := CreateCertificateCallback([]ssh.PublicKey{ca.PublicKey()}, []string{"staff", "ops"}, nil)
+
+	_, err := callback(connFrom("10.0.0.1"), signCert(t, ca, generateSigner(t).PublicKey(), ssh.UserCert, "alice", "ops"))
+	assert.NoError(t, err)
+
+	_, err = callback(connFrom("10.0.0.1"), signCert(t, ca, generateSigner(t).PublicKey(), ssh.UserCert, "guest"))
+	assert.Error(t, err)
+}
+
+func TestCreateCertificateCallback_RejectsInvalidCertificates(t *testing.T) {
+	ca := generateSigner(t)
+	callback := CreateCertificateCallback([]ssh.PublicKey{ca.PublicKey()}, nil, nil)
+	key := generateSigner(t).PublicKey()
+
+	untrusted := signCert(t, generateSigner(t), key, ssh.UserCert, "guest")
+	_, err := callback(connFrom("10.0.0.1"), untrusted)
+	assert.Error(t, err)
+
+	host := signCert(t, ca, key, ssh.HostCert, "guest")
+	_, err = callback(connFrom("10.0.0.1"), host)
+	assert.Error(t, err)
+
+	expired := signCert(t, ca, key, ssh.UserCert, "guest")
+	expired.ValidBefore = uint64(time.Now().Add(-time.Second).Unix())
+	assert.NoError(t, expired.SignCert(rand.Reader, ca))
+	_, err = callback(connFrom("10.0.0.1"), expired)
+	assert.Error(t, err)
+
+	unsupported := signCert(t, ca, key, ssh.UserCert, "guest")
+	unsupported.CriticalOptions = map[string]string{"verify-required": ""}
+	assert.NoError(t, unsupported.SignCert(rand.Reader, ca))
+	_, err = callback(connFrom("10.0.0.1"), unsupported)
+	assert.Error(t, err)
+}
+
+func TestCreateCertificateCallback_ChecksSourceAddress(t *testing.T) {
+	ca := generateSigner(t)
+	callback := CreateCertificateCallback([]ssh.PublicKey{ca.PublicKey()}, nil, nil)
+	cert := signCert(t, ca, generateSigner(t).PublicKey(), ssh.UserCert, "guest")
+	cert.CriticalOptions = map[string]string{SourceAddress: "192.168.1.0/24, 10.0.0.1"}
+	assert.NoError(t, cert.SignCert(rand.Reader, ca))
+
+	_, err := callback(connFrom("10.0.0.1"), cert)
+	assert.NoError(t, err)
+	_, err = callback(connFrom("192.168.1.7"), cert)
+	assert.NoError(t, err)
+	_, err = callback(connFrom("10.0.0.2"), cert)
+	assert.Error(t, err)
+
+	cert.CriticalOptions = map[string]string{SourceAddress: "somewhere"}
+	assert.NoError(t, cert.SignCert(rand.Reader, ca))
+	_, err = callback(connFrom("10.0.0.1"), cert)
+	assert.Error(t, err)
+}
+
+func TestCreateCertificateCallback_PassesPlainKeysToFallback(t *testing.T) {
+	ca := generateSigner(t)
+	key := generateSigner(t).PublicKey()
+
+	_, err := CreateCertificateCallback([]ssh.PublicKey{ca.PublicKey()}, nil, nil)(connFrom("10.0.0.1"), key)
+	assert.Error(t, err)
+
+	fallback := func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+		return nil, fmt.Errorf("fallback")
+	}
+	_, err = CreateCertificateCallback([]ssh.PublicKey{ca.PublicKey()}, nil, fallback)(connFrom("10.0.0.1"), key)
+	assert.EqualError(t, err, "fallback")
+}
+
+func TestNewHostCertSigner(t *testing.T) {
+	ca := generateSigner(t)
+	hostKey := generateSigner(t)
+	otherKey := generateSigner(t)
+	cert := signCert(t, ca, hostKey.PublicKey(), ssh.HostCert, "example.com")
+
+	signer, err := NewHostCertSigner(ssh.MarshalAuthorizedKey(cert), []ssh.Signer{otherKey, hostKey})
+	assert.NoError(t, err)
+	assert.Equal(t, cert.Type(), signer.PublicKey().Type())
+
+	_, err = NewHostCertSigner(ssh.MarshalAuthorizedKey(cert), []ssh.Signer{otherKey})
+	assert.Error(t, err)
+
+	userCert := signCert(t, ca, hostKey.PublicKey(), ssh.UserCert, "example.com")
+	_, err = NewHostCertSigner(ssh.MarshalAuthorizedKey(userCert), []ssh.Signer{hostKey})
+	assert.Error(t, err)
+
+	_, err = NewHostCertSigner(ssh.MarshalAuthorizedKey(hostKey.PublicKey()), []ssh.Signer{hostKey})
+	assert.Error(t, err)
+
+	expired := signCert(t, ca, hostKey.PublicKey(), ssh.HostCert, "example.com")
+	expired.ValidBefore = uint64(time.Now().Add(-time.Second).Unix())
+	assert.NoError(t, expired.SignCert(rand.Reader, ca))
+	_, err = NewHostCertSigner(ssh.MarshalAuthorizedKey(expired), []ssh.Signer{hostKey})
+	assert.Error(t, err)
+
+	notYetValid := signCert(t, ca, hostKey.PublicKey(), ssh.HostCert, "example.com")
+	notYetValid.ValidAfter = uint64(time.Now().Add(time.Hour).Unix())
+	assert.NoError(t, notYetValid.SignCert(rand.Reader, ca))
+	_, err = NewHostCertSigner(ssh.MarshalAuthorizedKey(notYetValid), []ssh.Signer{hostKey})
+	assert.Error(t, err)
+}
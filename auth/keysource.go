@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultKeysURL is the site whose users' published keys are trusted by
+// default
+const DefaultKeysURL = "https://github.com"
+
+// The longest time to wait for keys to be fetched
+const fetchTimeout = 10 * time.Second
+
+// A KeySource looks up the public keys of a user
+type KeySource interface {
+	Keys(user string) ([]*AuthorizedKey, error)
+}
+
+// Valid GitHub and GitLab user names
+var userPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+type urlKeySource struct {
+	baseURL string
+	get     func(string) (*http.Response, error)
+	mutex   sync.Mutex
+	cache   map[string][]*AuthorizedKey
+}
+
+// NewURLKeySource creates a KeySource for the keys users publish at
+// <baseURL>/<user>.keys, which is where GitHub and GitLab publish them. Keys
+// are cached so each user's keys are only fetched once.
+func NewURLKeySource(baseURL string) KeySource {
+	client := &http.Client{Timeout: fetchTimeout}
+	return newURLKeySource(baseURL, client.Get)
+}
+
+func newURLKeySource(baseURL string, get func(string) (*http.Response, error)) *urlKeySource {
+	return &urlKeySource{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		get:     get,
+		cache:   map[string][]*AuthorizedKey{},
+	}
+}
+
+func (s *urlKeySource) Keys(user string) ([]*AuthorizedKey, error) {
+	if !userPattern.MatchString(user) {
+		return nil, fmt.Errorf("Invalid user name %q", user)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if keys, ok := s.cache[user]; ok {
+		return keys, nil
+	}
+
+	keys, err := fetchKeys(s.get, s.baseURL+"/"+user+".keys")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get the keys for %s (%s)", user, err)
+	}
+	for _, key := range keys {
+		if key.Comment == "" {
+			key.Comment = user
+		}
+	}
+	s.cache[user] = keys
+	return keys, nil
+}
+
+// FetchKeys fetches the keys in the authorized_keys format from url
+func FetchKeys(url string) ([]*AuthorizedKey, error) {
+	client := &http.Client{Timeout: fetchTimeout}
+	return fetchKeys(client.Get, url)
+}
+
+func fetchKeys(get func(string) (*http.Response, error), url string) ([]*AuthorizedKey, error) {
+	resp, err := get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("No keys found at %s", url)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Invalid response %s from %s", resp.Status, url)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := ParseAuthorizedKeys(body)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid keys at %s (%s)", url, err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No public keys have been published at %s", url)
+	}
+	return keys, nil
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// createKeyServer serves the published keys of users
+func createKeyServer(users map[string]string) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		keys, ok := users[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, keys)
+	}))
+	return server, &requests
+}
+
+func TestURLKeySource_FetchesPublishedKeys(t *testing.T) {
+	key0, line0 := generatePublicKey(t)
+	_, line1 := generatePublicKey(t)
+	server, _ := createKeyServer(map[string]string{"/alice.keys": line0 + "\n" + line1 + "\n"})
+	defer server.Close()
+
+	keys, err := NewURLKeySource(server.URL + "/").Keys("alice")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+	assert.Equal(t, key0.Marshal(), keys[0].Key.Marshal())
+	assert.Equal(t, "alice", keys[0].Comment)
+}
+
+func TestURLKeySource_CachesKeys(t *testing.T) {
+	_, line := generatePublicKey(t)
+	server, requests := createKeyServer(map[string]string{"/alice.keys": line})
+	defer server.Close()
+	source := NewURLKeySource(server.URL)
+
+	keys0, err := source.Keys("alice")
+	assert.NoError(t, err)
+	keys1, err := source.Keys("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, keys0, keys1)
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+}
+
+func TestURLKeySource_ReturnsErrorForUnknownUser(t *testing.T) {
+	server, _ := createKeyServer(map[string]string{})
+	defer server.Close()
+
+	_, err := NewURLKeySource(server.URL).Keys("bob")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "No keys found")
+}
+
+func TestURLKeySource_ReturnsErrorForUserWithoutKeys(t *testing.T) {
+	server, _ := createKeyServer(map[string]string{"/bob.keys": "\n"})
+	defer server.Close()
+
+	_, err := NewURLKeySource(server.URL).Keys("bob")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "No public keys have been published")
+}
+
+func TestURLKeySource_ReturnsErrorForInvalidKeys(t *testing.T) {
+	server, _ := createKeyServer(map[string]string{"/bob.keys": "<html>"})
+	defer server.Close()
+
+	_, err := NewURLKeySource(server.URL).Keys("bob")
+	assert.Error(t, err)
+}
+
+func TestURLKeySource_ReturnsErrorForServerErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	_, err := NewURLKeySource(server.URL).Keys("bob")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "500")
+}
+
+func TestURLKeySource_RejectsInvalidUserNames(t *testing.T) {
+	server, requests := createKeyServer(map[string]string{})
+	defer server.Close()
+
+	for _, user := range []string{"", "../admin", "a/b", "a?b"} {
+		_, err := NewURLKeySource(server.URL).Keys(user)
+		assert.Error(t, err, user)
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(requests))
+}
+
+func TestFetchKeys_FetchesURL(t *testing.T) {
+	_, line := generatePublicKey(t)
+	server, _ := createKeyServer(map[string]string{"/team/keys": line})
+	defer server.Close()
+
+	keys, err := FetchKeys(server.URL + "/team/keys")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+}
+
+func TestFetchKeys_HandlesGETFailure(t *testing.T) {
+	_, err := FetchKeys("http://127.0.0.1:0/keys")
+	assert.Error(t, err)
+}
@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// knownHostsAddress returns the address of the server as it appears in a
+// known_hosts file, [host]:port or just host for the standard port
+func knownHostsAddress(host string, port int) string {
+	return knownhosts.Normalize(net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// KnownHostsLines returns a known_hosts line for each of the server's host
+// keys
+func KnownHostsLines(host string, port int, keys []ssh.PublicKey) []string {
+	address := knownHostsAddress(host, port)
+	lines := []string{}
+	for _, key := range keys {
+		lines = append(lines, knownhosts.Line([]string{address}, key))
+	}
+	return lines
+}
+
+// VerifiedSSHCommand returns an ssh command that connects to the server and
+// verifies its host key without touching the guest's known_hosts file. It
+// requires OpenSSH 8.5 or later for KnownHostsCommand.
+func VerifiedSSHCommand(host string, port int, key ssh.PublicKey) string {
+	line := KnownHostsLines(host, port, []ssh.PublicKey{key})[0]
+	return fmt.Sprintf("ssh -o 'KnownHostsCommand=/bin/echo %s' %s -p %d", line, host, port)
+}
+
+// TempKnownHostsCommand returns a shell command for older ssh clients that
+// writes the host key to a temporary known_hosts file and connects with it
+func TempKnownHostsCommand(host string, port int, key ssh.PublicKey) string {
+	line := KnownHostsLines(host, port, []ssh.PublicKey{key})[0]
+	return fmt.Sprintf("f=$(mktemp) && echo '%s' > $f && ssh -o UserKnownHostsFile=$f %s -p %d; rm -f $f", line, host, port)
+}
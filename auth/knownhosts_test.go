@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestKnownHostsLines_VerifyHostKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "known_hosts")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	key := generateSigner(t).PublicKey()
+	otherKey := generateSigner(t).PublicKey()
+	lines := KnownHostsLines("0.tcp.ngrok.io", 12345, []ssh.PublicKey{key})
+	assert.Len(t, lines, 1)
+	assert.True(t, strings.HasPrefix(lines[0], "[0.tcp.ngrok.io]:12345 ssh-ed25519 "))
+
+	file := path.Join(dir, "known_hosts")
+	assert.NoError(t, ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0600))
+	callback, err := knownhosts.New(file)
+	assert.NoError(t, err)
+
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 12345}
+	assert.NoError(t, callback("0.tcp.ngrok.io:12345", addr, key))
+	assert.Error(t, callback("0.tcp.ngrok.io:12345", addr, otherKey))
+	assert.Error(t, callback("0.tcp.ngrok.io:22", addr, key))
+}
+
+func TestKnownHostsLines_OmitsStandardPort(t *testing.T) {
+	key := generateSigner(t).PublicKey()
+	lines := KnownHostsLines("example.com", 22, []ssh.PublicKey{key})
+	assert.True(t, strings.HasPrefix(lines[0], "example.com ssh-ed25519 "))
+}
+
+func TestVerifiedSSHCommand(t *testing.T) {
+	key := generateSigner(t).PublicKey()
+	line := KnownHostsLines("example.com", 2222, []ssh.PublicKey{key})[0]
+
+	assert.Equal(t, "ssh -o 'KnownHostsCommand=/bin/echo "+line+"' example.com -p 2222", VerifiedSSHCommand("example.com", 2222, key))
+	assert.Contains(t, TempKnownHostsCommand("example.com", 2222, key), "echo '"+line+"' > $f && ssh -o UserKnownHostsFile=$f example.com -p 2222")
+}
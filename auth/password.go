@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A PasswordPolicy limits how long a password can be used
+type PasswordPolicy struct {
+	// MaxLogins is the number of successful logins before the password is
+	// invalidated. Zero allows any number of logins.
+	MaxLogins int
+	// Lifetime is how long the password is valid for. Zero never expires.
+	Lifetime time.Duration
+}
+
+func (p PasswordPolicy) String() string {
+	limits := ""
+	if p.MaxLogins == 1 {
+		limits = "single use"
+	} else if p.MaxLogins > 1 {
+		limits = fmt.Sprintf("%d logins", p.MaxLogins)
+	}
+	if p.Lifetime > 0 {
+		if limits != "" {
+			limits += ", "
+		}
+		limits += fmt.Sprintf("expires in %s", p.Lifetime)
+	}
+	return limits
+}
+
+// A SessionPassword is a generated password limited by a PasswordPolicy. It
+// can be rotated without affecting clients that have already logged in.
+type SessionPassword struct {
+	mutex    sync.Mutex
+	length   int
+	policy   PasswordPolicy
+	password string
+	logins   int
+	expires  time.Time
+	now      func() time.Time
+}
+
+// NewSessionPassword generates a password with len bytes of random data
+func NewSessionPassword(len int, policy PasswordPolicy) (*SessionPassword, error) {
+	p := &SessionPassword{length: len, policy: policy, now: time.Now}
+	_, err := p.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Rotate replaces the password with a new one and returns it
+func (p *SessionPassword) Rotate() (string, error) {
+	password, err := GeneratePassword(p.length)
+	if err != nil {
+		return "", err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.password = password
+	p.logins = 0
+	if p.policy.Lifetime > 0 {
+		p.expires = p.now().Add(p.policy.Lifetime)
+	}
+	return password, nil
+}
+
+// Password returns the current password
+func (p *SessionPassword) Password() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.password
+}
+
+// Policy returns the limits of the password
+func (p *SessionPassword) Policy() PasswordPolicy {
+	return p.policy
+}
+
+// check returns an error unless the password can be used to log in
+func (p *SessionPassword) check(password []byte) error {
+	if subtle.ConstantTimeCompare([]byte(p.password), password) != 1 {
+		return fmt.Errorf("Invalid password")
+	}
+	if p.policy.Lifetime > 0 && !p.now().Before(p.expires) {
+		return fmt.Errorf("The password has expired")
+	}
+	if p.policy.MaxLogins > 0 && p.logins >= p.policy.MaxLogins {
+		return fmt.Errorf("The password has been used %d times", p.logins)
+	}
+	return nil
+}
+
+// login checks the password again and counts the login
+func (p *SessionPassword) login(password []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	err := p.check(password)
+	if err != nil {
+		return err
+	}
+	p.logins++
+	return nil
+}
+
+// CreatePasswordCallback creates a function for authenticating with the
+// session password. Logins aren't counted until CountLogins sees them
+// complete.
+func (p *SessionPassword) CreatePasswordCallback() func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		p.mutex.Lock()
+		err := p.check(password)
+		p.mutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return &ssh.Permissions{}, nil
+	}
+}
+
+// CountLogins changes the server's configuration so a login with the
+// password is only counted once it's complete, after the host has approved it
+// and a code has been entered. It must be called after every other change to
+// the password callback.
+func (p *SessionPassword) CountLogins(sshConf *ssh.ServerConfig) {
+	callback := sshConf.PasswordCallback
+	if callback == nil {
+		return
+	}
+	sshConf.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		perms, err := callback(conn, password)
+		// The password is only used up if it wasn't used up or rotated
+		// while the login was being completed
+		return completed(perms, err, func(perms *ssh.Permissions) (*ssh.Permissions, error) {
+			err := p.login(password)
+			if err != nil {
+				return nil, err
+			}
+			return perms, nil
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countedCallback returns a password callback that counts logins
+func countedCallback(password *SessionPassword) func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+	sshConf := &ssh.ServerConfig{PasswordCallback: password.CreatePasswordCallback()}
+	password.CountLogins(sshConf)
+	return sshConf.PasswordCallback
+}
+
+func TestSessionPassword_UnlimitedByDefault(t *testing.T) {
+	password, err := NewSessionPassword(10, PasswordPolicy{})
+	assert.NoError(t, err)
+	callback := countedCallback(password)
+
+	for i := 0; i < 3; i++ {
+		_, err = callback(nil, []byte(password.Password()))
+		assert.NoError(t, err)
+	}
+	_, err = callback(nil, []byte("bad"))
+	assert.Error(t, err)
+}
+
+func TestSessionPassword_SingleUse(t *testing.T) {
+	password, err := NewSessionPassword(10, PasswordPolicy{MaxLogins: 1})
+	assert.NoError(t, err)
+	callback := countedCallback(password)
+
+	// A failed login doesn't use up the password
+	_, err = callback(nil, []byte("bad"))
+	assert.Error(t, err)
+	_, err = callback(nil, []byte(password.Password()))
+	assert.NoError(t, err)
+	_, err = callback(nil, []byte(password.Password()))
+	assert.Error(t, err)
+}
+
+func TestSessionPassword_LimitedLogins(t *testing.T) {
+	password, err := NewSessionPassword(10, PasswordPolicy{MaxLogins: 2})
+	assert.NoError(t, err)
+	callback := countedCallback(password)
+
+	_, err = callback(nil, []byte(password.Password()))
+	assert.NoError(t, err)
+	_, err = callback(nil, []byte(password.Password()))
+	assert.NoError(t, err)
+	_, err = callback(nil, []byte(password.Password()))
+	assert.Error(t, err)
+}
+
+func TestSessionPassword_Expires(t *testing.T) {
+	now := time.Unix(1000, 0)
+	password := &SessionPassword{length: 10, policy: PasswordPolicy{Lifetime: time.Minute}, now: func() time.Time { return now }}
+	_, err := password.Rotate()
+	assert.NoError(t, err)
+	callback := countedCallback(password)
+
+	now = now.Add(59 * time.Second)
+	_, err = callback(nil, []byte(password.Password()))
+	assert.NoError(t, err)
+
+	now = now.Add(time.Second)
+	_, err = callback(nil, []byte(password.Password()))
+	assert.Error(t, err)
+}
+
+func TestSessionPassword_RotateReplacesPassword(t *testing.T) {
+	password, err := NewSessionPassword(10, PasswordPolicy{MaxLogins: 1})
+	assert.NoError(t, err)
+	callback := countedCallback(password)
+	old := password.Password()
+	_, err = callback(nil, []byte(old))
+	assert.NoError(t, err)
+
+	rotated, err := password.Rotate()
+	assert.NoError(t, err)
+	assert.NotEqual(t, old, rotated)
+	assert.Equal(t, rotated, password.Password())
+
+	_, err = callback(nil, []byte(old))
+	assert.Error(t, err)
+	_, err = callback(nil, []byte(rotated))
+	assert.NoError(t, err)
+}
+
+func TestSessionPassword_DeniedLoginsDontUseThePassword(t *testing.T) {
+	password, err := NewSessionPassword(10, PasswordPolicy{MaxLogins: 1})
+	assert.NoError(t, err)
+	approve := false
+	sshConf := &ssh.ServerConfig{
+		PasswordCallback: CreateApprovedPasswordCallback(password.CreatePasswordCallback(), func(*ApprovalRequest) bool { return approve }),
+	}
+	password.CountLogins(sshConf)
+
+	_, err = sshConf.PasswordCallback(connFrom("10.0.0.1"), []byte(password.Password()))
+	assert.Error(t, err)
+
+	approve = true
+	_, err = sshConf.PasswordCallback(connFrom("10.0.0.1"), []byte(password.Password()))
+	assert.NoError(t, err)
+	_, err = sshConf.PasswordCallback(connFrom("10.0.0.1"), []byte(password.Password()))
+	assert.Error(t, err)
+}
+
+func TestSessionPassword_WrongCodesDontUseThePassword(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	totp := newTOTP(rfcSecret, "gmash", "guest", 1, fixedClock(&now))
+	password, err := NewSessionPassword(10, PasswordPolicy{MaxLogins: 1})
+	assert.NoError(t, err)
+	newConf := func() *ssh.ServerConfig {
+		sshConf := &ssh.ServerConfig{PasswordCallback: password.CreatePasswordCallback()}
+		totp.Require(sshConf)
+		password.CountLogins(sshConf)
+		return sshConf
+	}
+
+	_, err = login(t, newConf(), &ssh.ClientConfig{User: "guest", Auth: []ssh.AuthMethod{ssh.Password(password.Password()), answer("000000")}})
+	assert.Error(t, err)
+
+	_, err = login(t, newConf(), &ssh.ClientConfig{User: "guest", Auth: []ssh.AuthMethod{ssh.Password(password.Password()), answer("081804")}})
+	assert.NoError(t, err)
+
+	now = now.Add(30 * time.Second)
+	_, err = login(t, newConf(), &ssh.ClientConfig{User: "guest", Auth: []ssh.AuthMethod{ssh.Password(password.Password()), answer(totp.code(uint64(now.Unix() / 30)))}})
+	assert.Error(t, err)
+}
+
+func TestPasswordPolicy_String(t *testing.T) {
+	assert.Equal(t, "", PasswordPolicy{}.String())
+	assert.Equal(t, "single use", PasswordPolicy{MaxLogins: 1}.String())
+	assert.Equal(t, "3 logins, expires in 1h0m0s", PasswordPolicy{MaxLogins: 3, Lifetime: time.Hour}.String())
+}
@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A RateLimitConfig configures how failed logins are limited
+type RateLimitConfig struct {
+	// BaseDelay is the delay after the first failed login. The delay doubles
+	// with each failure from the same address or connection.
+	BaseDelay time.Duration
+	// MaxDelay is the longest delay after a failed login
+	MaxDelay time.Duration
+	// MaxFailures is the number of failed logins from an address before it's
+	// banned. Loopback addresses are limited by MaxSharedFailures instead.
+	MaxFailures int
+	// BanDuration is how long an address is banned for. An address's
+	// failures are also forgotten after this long without a failure.
+	BanDuration time.Duration
+	// MaxConnFailures is the number of failed logins before a connection is
+	// closed
+	MaxConnFailures int
+	// MaxSharedFailures is the number of failed logins from all of the
+	// loopback addresses together before new connections from them are
+	// refused for SharedCooldown
+	MaxSharedFailures int
+	// SharedCooldown is how long connections from loopback addresses are
+	// refused for
+	SharedCooldown time.Duration
+}
+
+// DefaultRateLimitConfig is a RateLimitConfig suitable for a server on the
+// public internet
+var DefaultRateLimitConfig = RateLimitConfig{
+	BaseDelay:         500 * time.Millisecond,
+	MaxDelay:          10 * time.Second,
+	MaxFailures:       10,
+	BanDuration:       15 * time.Minute,
+	MaxConnFailures:   3,
+	MaxSharedFailures: 30,
+	SharedCooldown:    time.Minute,
+}
+
+// The key the loopback addresses' failures are counted under
+const sharedHosts = "loopback"
+
+// How long a connection's failures are remembered. Connections that haven't
+// authenticated by then have been dropped by the server.
+const connFailureLifetime = 10 * time.Minute
+
+type failures struct {
+	count       int
+	lastFailure time.Time
+	bannedUntil time.Time
+}
+
+// A RateLimiter tracks failed logins by remote address and by connection. It
+// slows down clients with repeated failures and temporarily bans addresses
+// that fail too often.
+type RateLimiter struct {
+	config RateLimitConfig
+	mutex  sync.Mutex
+	hosts  map[string]*failures
+	conns  map[string]*failures
+	onBan  func(host string, until time.Time)
+	now    func() time.Time
+	sleep  func(time.Duration)
+}
+
+// NewRateLimiter creates a RateLimiter
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	return &RateLimiter{
+		config: config,
+		hosts:  map[string]*failures{},
+		conns:  map[string]*failures{},
+		onBan:  func(string, time.Time) {},
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+// OnBan sets the function that's called when an address is banned
+func (l *RateLimiter) OnBan(onBan func(host string, until time.Time)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.onBan = onBan
+}
+
+// sharedHost returns true if many guests can connect from the host. Tunnels
+// like ngrok connect from the loopback interface so banning it for long would
+// lock every guest out. Its failures are counted together and only refuse
+// new connections for a short cooldown.
+func sharedHost(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// hostOf returns the IP address of a remote address
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// AllowConnection returns an error if the address is banned
+func (l *RateLimiter) AllowConnection(addr net.Addr) error {
+	host := hostOf(addr)
+	if sharedHost(host) {
+		host = sharedHosts
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if state, ok := l.hosts[host]; ok && l.now().Before(state.bannedUntil) {
+		return fmt.Errorf("%s is banned until %s", host, state.bannedUntil.Format(time.Kitchen))
+	}
+	return nil
+}
+
+// allowGuess returns an error if the connection can't guess another password
+// or code
+func (l *RateLimiter) allowGuess(conn ssh.ConnMetadata) error {
+	err := l.AllowConnection(conn.RemoteAddr())
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	state, ok := l.conns[string(conn.SessionID())]
+	if ok && l.config.MaxConnFailures > 0 && state.count >= l.config.MaxConnFailures {
+		return fmt.Errorf("Too many failed logins on this connection")
+	}
+	return nil
+}
+
+// Protect configures the server to limit failed logins. It must be called
+// after the authentication callbacks have been set. The server's
+// MaxAuthTries is left alone because it also counts the public keys a client
+// offers, so guests with many keys in their agent would be disconnected.
+func (l *RateLimiter) Protect(sshConf *ssh.ServerConfig) {
+	sshConf.AuthLogCallback = l.authLog
+
+	// Connections that were already open when their address was banned or
+	// that have run out of guesses can't keep guessing
+	if callback := sshConf.PasswordCallback; callback != nil {
+		sshConf.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			err := l.allowGuess(conn)
+			if err != nil {
+				return nil, err
+			}
+			return callback(conn, password)
+		}
+	}
+	if callback := sshConf.KeyboardInteractiveCallback; callback != nil {
+		sshConf.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			err := l.allowGuess(conn)
+			if err != nil {
+				return nil, err
+			}
+			return callback(conn, client)
+		}
+	}
+}
+
+// authLog is called after every authentication attempt. Failures are
+// delayed before the client is told about them and the connection is closed
+// once it has failed too often.
+func (l *RateLimiter) authLog(conn ssh.ConnMetadata, method string, err error) {
+	if err == nil || !countsAsFailure(method, err) {
+		return
+	}
+	delay, exhausted := l.recordFailure(hostOf(conn.RemoteAddr()), string(conn.SessionID()))
+	l.sleep(delay)
+	// The server passes its connection to the callbacks so it can be closed.
+	// If it can't be the connection's later guesses are refused instead.
+	if closer, ok := conn.(io.Closer); ok && exhausted {
+		_ = closer.Close()
+	}
+}
+
+// countsAsFailure returns true if the failed attempt could be a guess. Public
+// keys can't be guessed and clients routinely offer keys that aren't
+// accepted so they're not counted.
+func countsAsFailure(method string, err error) bool {
+	if _, ok := err.(*ssh.PartialSuccessError); ok {
+		return false
+	}
+	return method == "password" || method == "keyboard-interactive"
+}
+
+// recordFailure counts the failure and returns how long to delay the client
+// and whether the connection has run out of guesses
+func (l *RateLimiter) recordFailure(host, sessionID string) (time.Duration, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+
+	for id, state := range l.conns {
+		if now.Sub(state.lastFailure) > connFailureLifetime {
+			delete(l.conns, id)
+		}
+	}
+	for addr, state := range l.hosts {
+		if l.expired(state, now) {
+			delete(l.hosts, addr)
+		}
+	}
+	conn := l.failures(l.conns, sessionID, now)
+	conn.count++
+	conn.lastFailure = now
+	exhausted := l.config.MaxConnFailures > 0 && conn.count >= l.config.MaxConnFailures
+	if sharedHost(host) {
+		host = sharedHosts
+	}
+
+	hostState := l.failures(l.hosts, host, now)
+	hostState.count++
+	hostState.lastFailure = now
+	count := conn.count
+	if hostState.count > count {
+		count = hostState.count
+	}
+
+	if host == sharedHosts {
+		// The guests that are sharing the address get a fresh budget once
+		// the cooldown is over
+		if l.config.MaxSharedFailures > 0 && hostState.count >= l.config.MaxSharedFailures {
+			hostState.count = 0
+			hostState.bannedUntil = now.Add(l.config.SharedCooldown)
+			l.onBan(host, hostState.bannedUntil)
+		}
+	} else if l.config.MaxFailures > 0 && hostState.count >= l.config.MaxFailures && !now.Before(hostState.bannedUntil) {
+		hostState.bannedUntil = now.Add(l.config.BanDuration)
+		l.onBan(host, hostState.bannedUntil)
+	}
+	return l.delay(count), exhausted
+}
+
+// expired returns true if there hasn't been a failure for a while and any ban
+// is over
+func (l *RateLimiter) expired(state *failures, now time.Time) bool {
+	return now.Sub(state.lastFailure) > l.config.BanDuration && !now.Before(state.bannedUntil)
+}
+
+// failures returns the failures for key, forgetting them if they've expired
+func (l *RateLimiter) failures(states map[string]*failures, key string, now time.Time) *failures {
+	state, ok := states[key]
+	if !ok || l.expired(state, now) {
+		state = &failures{}
+		states[key] = state
+	}
+	return state
+}
+
+// delay returns the delay after count failures
+func (l *RateLimiter) delay(count int) time.Duration {
+	delay := l.config.BaseDelay
+	for i := 1; i < count && delay < l.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > l.config.MaxDelay {
+		delay = l.config.MaxDelay
+	}
+	return delay
+}
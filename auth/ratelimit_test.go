@@ -0,0 +1,261 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+var testRateLimitConfig = RateLimitConfig{
+	BaseDelay:         time.Second,
+	MaxDelay:          5 * time.Second,
+	MaxFailures:       5,
+	BanDuration:       time.Minute,
+	MaxConnFailures:   3,
+	MaxSharedFailures: 8,
+	SharedCooldown:    10 * time.Second,
+}
+
+// testRateLimiter creates a RateLimiter with a fake clock that records the
+// delays instead of sleeping
+func testRateLimiter(now *time.Time, delays *[]time.Duration) *RateLimiter {
+	limiter := NewRateLimiter(testRateLimitConfig)
+	limiter.now = func() time.Time { return *now }
+	limiter.sleep = func(delay time.Duration) { *delays = append(*delays, delay) }
+	return limiter
+}
+
+func connSession(ip, sessionID string) ssh.ConnMetadata {
+	return fakeConnMetadata{user: "guest", remoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}, sessionID: sessionID}
+}
+
+func TestRateLimiter_DelaysGrowExponentially(t *testing.T) {
+	now := time.Unix(1000, 0)
+	delays := []time.Duration{}
+	limiter := testRateLimiter(&now, &delays)
+
+	for i := 0; i < 4; i++ {
+		limiter.authLog(connSession("10.0.0.1", "a"), "password", fmt.Errorf("Invalid password"))
+	}
+
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}, delays)
+}
+
+func TestRateLimiter_IgnoresOtherAttempts(t *testing.T) {
+	now := time.Unix(1000, 0)
+	delays := []time.Duration{}
+	limiter := testRateLimiter(&now, &delays)
+	conn := connSession("10.0.0.1", "a")
+
+	limiter.authLog(conn, "none", fmt.Errorf("no auth passed yet"))
+	limiter.authLog(conn, "publickey", fmt.Errorf("Unknown public key"))
+	limiter.authLog(conn, "password", nil)
+	limiter.authLog(conn, "password", &ssh.PartialSuccessError{})
+
+	assert.Empty(t, delays)
+}
+
+func TestRateLimiter_DelaysNewConnectionsFromSameHost(t *testing.T) {
+	now := time.Unix(1000, 0)
+	delays := []time.Duration{}
+	limiter := testRateLimiter(&now, &delays)
+
+	limiter.authLog(connSession("10.0.0.1", "a"), "password", fmt.Errorf("Invalid password"))
+	limiter.authLog(connSession("10.0.0.1", "b"), "password", fmt.Errorf("Invalid password"))
+	limiter.authLog(connSession("10.0.0.2", "c"), "password", fmt.Errorf("Invalid password"))
+
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, time.Second}, delays)
+}
+
+func TestRateLimiter_BansHost(t *testing.T) {
+	now := time.Unix(1000, 0)
+	delays := []time.Duration{}
+	limiter := testRateLimiter(&now, &delays)
+	bans := []string{}
+	limiter.OnBan(func(host string, until time.Time) {
+		bans = append(bans, host)
+		assert.Equal(t, now.Add(time.Minute), until)
+	})
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+
+	for i := 0; i < 4; i++ {
+		limiter.authLog(connSession("10.0.0.1", fmt.Sprint(i)), "keyboard-interactive", fmt.Errorf("Wrong code"))
+	}
+	assert.NoError(t, limiter.AllowConnection(addr))
+	assert.Empty(t, bans)
+
+	limiter.authLog(connSession("10.0.0.1", "5"), "password", fmt.Errorf("Invalid password"))
+	assert.Error(t, limiter.AllowConnection(addr))
+	assert.NoError(t, limiter.AllowConnection(&net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1}))
+	assert.Equal(t, []string{"10.0.0.1"}, bans)
+
+	// The ban expires and the failures are forgotten
+	now = now.Add(time.Minute + time.Second)
+	assert.NoError(t, limiter.AllowConnection(addr))
+	delays = delays[:0]
+	limiter.authLog(connSession("10.0.0.1", "6"), "password", fmt.Errorf("Invalid password"))
+	assert.Equal(t, []time.Duration{time.Second}, delays)
+}
+
+func TestRateLimiter_ProtectRejectsBannedHosts(t *testing.T) {
+	now := time.Unix(1000, 0)
+	delays := []time.Duration{}
+	limiter := testRateLimiter(&now, &delays)
+	sshConf := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return &ssh.Permissions{}, nil
+		},
+	}
+	limiter.Protect(sshConf)
+	assert.Equal(t, 0, sshConf.MaxAuthTries)
+	assert.NotNil(t, sshConf.AuthLogCallback)
+	assert.Nil(t, sshConf.KeyboardInteractiveCallback)
+
+	_, err := sshConf.PasswordCallback(connSession("10.0.0.1", "a"), []byte("password"))
+	assert.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		sshConf.AuthLogCallback(connSession("10.0.0.1", "a"), "password", fmt.Errorf("Invalid password"))
+	}
+	_, err = sshConf.PasswordCallback(connSession("10.0.0.1", "a"), []byte("password"))
+	assert.Error(t, err)
+}
+
+// closableConn is a connection that records being closed
+type closableConn struct {
+	ssh.ConnMetadata
+	closed *bool
+}
+
+func (c closableConn) Close() error {
+	*c.closed = true
+	return nil
+}
+
+func TestRateLimiter_ClosesConnectionsThatFailTooOften(t *testing.T) {
+	now := time.Unix(1000, 0)
+	delays := []time.Duration{}
+	limiter := testRateLimiter(&now, &delays)
+	closed := false
+	conn := closableConn{connSession("10.0.0.1", "a"), &closed}
+
+	limiter.authLog(conn, "password", fmt.Errorf("Invalid password"))
+	limiter.authLog(conn, "keyboard-interactive", fmt.Errorf("Wrong code"))
+	assert.False(t, closed)
+	assert.NoError(t, limiter.allowGuess(conn))
+
+	limiter.authLog(conn, "password", fmt.Errorf("Invalid password"))
+	assert.True(t, closed)
+	assert.Error(t, limiter.allowGuess(conn))
+	assert.NoError(t, limiter.allowGuess(connSession("10.0.0.1", "b")))
+}
+
+func TestRateLimiter_LimitsLoopbackTogether(t *testing.T) {
+	now := time.Unix(1000, 0)
+	delays := []time.Duration{}
+	limiter := testRateLimiter(&now, &delays)
+	bans := []string{}
+	limiter.OnBan(func(host string, until time.Time) {
+		bans = append(bans, host)
+		assert.Equal(t, now.Add(10*time.Second), until)
+	})
+	v4 := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	v6 := &net.TCPAddr{IP: net.ParseIP("::1"), Port: 1}
+
+	// More failures than MaxFailures but fewer than MaxSharedFailures
+	for i := 0; i < 7; i++ {
+		ip := "127.0.0.1"
+		if i%2 == 1 {
+			ip = "::1"
+		}
+		limiter.authLog(connSession(ip, fmt.Sprint(i)), "password", fmt.Errorf("Invalid password"))
+	}
+	assert.NoError(t, limiter.AllowConnection(v4))
+	assert.Empty(t, bans)
+	// The failures from every connection slow down the next one
+	assert.Equal(t, 5*time.Second, delays[len(delays)-1])
+
+	limiter.authLog(connSession("::1", "7"), "password", fmt.Errorf("Invalid password"))
+	assert.Equal(t, []string{"loopback"}, bans)
+	assert.Error(t, limiter.AllowConnection(v4))
+	assert.Error(t, limiter.AllowConnection(v6))
+	assert.NoError(t, limiter.AllowConnection(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}))
+
+	// The cooldown is short and the guests get a fresh budget
+	now = now.Add(11 * time.Second)
+	assert.NoError(t, limiter.AllowConnection(v4))
+	delays = delays[:0]
+	limiter.authLog(connSession("127.0.0.1", "8"), "password", fmt.Errorf("Invalid password"))
+	assert.NoError(t, limiter.AllowConnection(v4))
+	assert.Equal(t, []time.Duration{time.Second}, delays)
+}
+
+func TestRateLimiter_ForgetsExpiredHosts(t *testing.T) {
+	now := time.Unix(1000, 0)
+	delays := []time.Duration{}
+	limiter := testRateLimiter(&now, &delays)
+
+	limiter.authLog(connSession("10.0.0.1", "a"), "password", fmt.Errorf("Invalid password"))
+	limiter.authLog(connSession("10.0.0.2", "b"), "password", fmt.Errorf("Invalid password"))
+	now = now.Add(time.Minute + time.Second)
+	limiter.authLog(connSession("10.0.0.3", "c"), "password", fmt.Errorf("Invalid password"))
+
+	assert.Len(t, limiter.hosts, 1)
+	assert.Contains(t, limiter.hosts, "10.0.0.3")
+}
+
+// protectedServer creates a server that accepts the password "secret" and
+// no public keys
+func protectedServer(limiter *RateLimiter) *ssh.ServerConfig {
+	sshConf := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "secret" {
+				return nil, fmt.Errorf("Invalid password")
+			}
+			return &ssh.Permissions{}, nil
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, fmt.Errorf("Unknown public key")
+		},
+	}
+	limiter.Protect(sshConf)
+	return sshConf
+}
+
+func TestRateLimiter_AllowsManyKeysBeforeThePassword(t *testing.T) {
+	now := time.Unix(1000, 0)
+	delays := []time.Duration{}
+	signers := []ssh.Signer{}
+	for i := 0; i < 5; i++ {
+		signers = append(signers, generateSigner(t))
+	}
+
+	_, err := login(t, protectedServer(testRateLimiter(&now, &delays)), &ssh.ClientConfig{
+		User: "guest",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signers...), ssh.Password("secret")},
+	})
+
+	assert.NoError(t, err)
+	assert.Empty(t, delays)
+}
+
+func TestRateLimiter_DisconnectsAfterTooManyWrongPasswords(t *testing.T) {
+	now := time.Unix(1000, 0)
+	delays := []time.Duration{}
+	attempts := 0
+
+	_, err := login(t, protectedServer(testRateLimiter(&now, &delays)), &ssh.ClientConfig{
+		User: "guest",
+		Auth: []ssh.AuthMethod{ssh.RetryableAuthMethod(ssh.PasswordCallback(func() (string, error) {
+			attempts++
+			return "wrong", nil
+		}), 10)},
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, 3, attempts)
+}
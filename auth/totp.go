@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The TOTP parameters understood by every authenticator app
+const (
+	totpSecretLength = 20
+	totpDigits       = 6
+	totpPeriod       = 30 * time.Second
+)
+
+// DefaultTOTPSkew is the number of periods a code may be early or late by to
+// allow for clock drift
+const DefaultTOTPSkew = 1
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// A TOTP verifies time-based one-time passwords (See RFC 6238) for use as a
+// second factor
+type TOTP struct {
+	mutex   sync.Mutex
+	secret  []byte
+	issuer  string
+	account string
+	skew    int
+	// used is the time step of the last code each user logged in with.
+	// Codes can't be reused by the same user.
+	used map[string]uint64
+	now  func() time.Time
+}
+
+// NewTOTP generates a random TOTP secret. The issuer and account name the
+// secret in authenticator apps.
+func NewTOTP(issuer, account string, skew int) (*TOTP, error) {
+	secret := make([]byte, totpSecretLength)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate TOTP secret (%s)", err)
+	}
+	return newTOTP(secret, issuer, account, skew, time.Now), nil
+}
+
+func newTOTP(secret []byte, issuer, account string, skew int, now func() time.Time) *TOTP {
+	return &TOTP{secret: secret, issuer: issuer, account: account, skew: skew, used: map[string]uint64{}, now: now}
+}
+
+// Secret returns the base32 encoded secret for entering by hand
+func (t *TOTP) Secret() string {
+	return totpEncoding.EncodeToString(t.secret)
+}
+
+// URI returns the otpauth URI for adding the secret to an authenticator app
+func (t *TOTP) URI() string {
+	params := url.Values{}
+	params.Set("secret", t.Secret())
+	params.Set("issuer", t.issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+	label := url.PathEscape(t.issuer + ":" + t.account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// code returns the code for a time step (See RFC 4226 5.3)
+func (t *TOTP) code(step uint64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, step)
+	mac := hmac.New(sha1.New, t.secret)
+	_, _ = mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulus)
+}
+
+// Verify returns true if the code is valid now, allowing for clock drift. A
+// code can only be used once by each user. Guests share the secret so
+// different users can log in with the same code.
+func (t *TOTP) Verify(user, code string) bool {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return false
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	current := t.now().Unix() / int64(totpPeriod/time.Second)
+	for step := current - int64(t.skew); step <= current+int64(t.skew); step++ {
+		if step < 0 || uint64(step) <= t.used[user] {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(t.code(uint64(step))), []byte(code)) == 1 {
+			t.used[user] = uint64(step)
+			return true
+		}
+	}
+	return false
+}
+
+// createChallenge creates a keyboard-interactive callback that asks for a
+// code and grants perms, the permissions from the first factor, if it's valid
+func (t *TOTP) createChallenge(perms *ssh.Permissions) func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		answers, err := client("", "Enter the code from your authenticator app", []string{"Verification code: "}, []bool{false})
+		if err != nil {
+			return nil, err
+		}
+		if len(answers) != 1 || !t.Verify(conn.User(), answers[0]) {
+			return nil, fmt.Errorf("Invalid verification code")
+		}
+		return perms, nil
+	}
+}
+
+// secondFactor asks for a code before the login is complete
+func (t *TOTP) secondFactor(perms *ssh.Permissions) error {
+	return &ssh.PartialSuccessError{
+		Next: ssh.ServerAuthCallbacks{KeyboardInteractiveCallback: t.createChallenge(perms)},
+	}
+}
+
+// completed calls done with the login's permissions once it's complete. If
+// the login needs a second factor done is called after the code is entered.
+func completed(perms *ssh.Permissions, err error, done func(*ssh.Permissions) (*ssh.Permissions, error)) (*ssh.Permissions, error) {
+	if partial, ok := err.(*ssh.PartialSuccessError); ok {
+		if next := partial.Next.KeyboardInteractiveCallback; next != nil {
+			partial.Next.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				perms, err := next(conn, client)
+				return completed(perms, err, done)
+			}
+		}
+		return nil, partial
+	}
+	if err != nil {
+		return nil, err
+	}
+	return done(perms)
+}
+
+// Require changes the server's configuration so logins with a password or
+// key must also enter a code. It must be called after the password and
+// public key callbacks have been set.
+func (t *TOTP) Require(sshConf *ssh.ServerConfig) {
+	if callback := sshConf.PasswordCallback; callback != nil {
+		sshConf.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			perms, err := callback(conn, password)
+			if err != nil {
+				return nil, err
+			}
+			return nil, t.secondFactor(perms)
+		}
+	}
+
+	// A public key callback can't ask for a second factor if there's a
+	// verified public key callback so ask once the key has been verified
+	if sshConf.PublicKeyCallback != nil {
+		verified := sshConf.VerifiedPublicKeyCallback
+		sshConf.VerifiedPublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey, perms *ssh.Permissions, signatureAlgorithm string) (*ssh.Permissions, error) {
+			if verified != nil {
+				var err error
+				perms, err = verified(conn, key, perms, signatureAlgorithm)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return nil, t.secondFactor(perms)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// The secret from the RFC 6238 test vectors
+var rfcSecret = []byte("12345678901234567890")
+
+func fixedClock(now *time.Time) func() time.Time {
+	return func() time.Time { return *now }
+}
+
+func TestTOTP_MatchesRFCTestVectors(t *testing.T) {
+	// The RFC's 8 digit codes truncated to 6 digits
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, code := range vectors {
+		now := time.Unix(unix, 0)
+		totp := newTOTP(rfcSecret, "gmash", "guest", 0, fixedClock(&now))
+		assert.True(t, totp.Verify("guest", code), "time %d", unix)
+	}
+}
+
+func TestTOTP_AllowsClockDrift(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	early := newTOTP(rfcSecret, "gmash", "guest", 1, fixedClock(&now))
+	late := newTOTP(rfcSecret, "gmash", "guest", 1, fixedClock(&now))
+	strict := newTOTP(rfcSecret, "gmash", "guest", 0, fixedClock(&now))
+	step := uint64(now.Unix() / 30)
+
+	assert.True(t, early.Verify("guest", early.code(step+1)))
+	assert.True(t, late.Verify("guest", late.code(step-1)))
+	assert.False(t, strict.Verify("guest", strict.code(step+1)))
+	assert.False(t, early.Verify("guest", early.code(step+2)))
+}
+
+func TestTOTP_RejectsReusedCodes(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	totp := newTOTP(rfcSecret, "gmash", "guest", 1, fixedClock(&now))
+	step := uint64(now.Unix() / 30)
+
+	assert.True(t, totp.Verify("guest", totp.code(step)))
+	assert.False(t, totp.Verify("guest", totp.code(step)))
+	assert.False(t, totp.Verify("guest", totp.code(step-1)))
+	assert.True(t, totp.Verify("guest", totp.code(step+1)))
+}
+
+func TestTOTP_AllowsOtherUsersTheSameCode(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	totp := newTOTP(rfcSecret, "gmash", "guest", 1, fixedClock(&now))
+	step := uint64(now.Unix() / 30)
+
+	assert.True(t, totp.Verify("alice", totp.code(step)))
+	assert.True(t, totp.Verify("bob", totp.code(step)))
+	assert.False(t, totp.Verify("alice", totp.code(step)))
+}
+
+func TestTOTP_RejectsMalformedCodes(t *testing.T) {
+	now := time.Unix(59, 0)
+	totp := newTOTP(rfcSecret, "gmash", "guest", 0, fixedClock(&now))
+
+	assert.False(t, totp.Verify("guest", ""))
+	assert.False(t, totp.Verify("guest", "94287082"))
+	assert.True(t, totp.Verify("guest", " 287 082 "))
+}
+
+func TestTOTP_URI(t *testing.T) {
+	totp, err := NewTOTP("gmash", "alice@example", DefaultTOTPSkew)
+	assert.NoError(t, err)
+
+	uri, err := url.Parse(totp.URI())
+	assert.NoError(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/gmash:alice@example", uri.Path)
+	assert.Equal(t, totp.Secret(), uri.Query().Get("secret"))
+	assert.Equal(t, "gmash", uri.Query().Get("issuer"))
+	assert.Equal(t, "6", uri.Query().Get("digits"))
+	assert.Equal(t, "30", uri.Query().Get("period"))
+	assert.Len(t, totp.Secret(), 32)
+}
+
+// login connects a client to a server and returns the server's permissions
+func login(t *testing.T, sshConf *ssh.ServerConfig, clientConf *ssh.ClientConfig) (*ssh.Permissions, error) {
+	signer := generateSigner(t)
+	sshConf.AddHostKey(signer)
+	clientConf.HostKeyCallback = ssh.FixedHostKey(signer.PublicKey())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	assert.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+
+	go func() {
+		conn, err := ssh.Dial("tcp", listener.Addr().String(), clientConf)
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+	srv, err := listener.Accept()
+	assert.NoError(t, err)
+	defer func() { _ = srv.Close() }()
+	serverConn, _, _, err := ssh.NewServerConn(srv, sshConf)
+	if err != nil {
+		return nil, err
+	}
+	return serverConn.Permissions, nil
+}
+
+// answer is a keyboard-interactive client that answers with the code
+func answer(code string) ssh.AuthMethod {
+	return ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		if len(questions) != 1 || !strings.Contains(questions[0], "code") {
+			return nil, fmt.Errorf("Unexpected questions %v", questions)
+		}
+		return []string{code}, nil
+	})
+}
+
+func TestTOTP_RequiresCodeAfterPassword(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	totp := newTOTP(rfcSecret, "gmash", "guest", 1, fixedClock(&now))
+	newConf := func() *ssh.ServerConfig {
+		sshConf := &ssh.ServerConfig{
+			PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+				return &ssh.Permissions{Extensions: map[string]string{PermitPty: ""}}, nil
+			},
+		}
+		totp.Require(sshConf)
+		return sshConf
+	}
+
+	// The password alone isn't enough
+	_, err := login(t, newConf(), &ssh.ClientConfig{User: "guest", Auth: []ssh.AuthMethod{ssh.Password("pw")}})
+	assert.Error(t, err)
+
+	_, err = login(t, newConf(), &ssh.ClientConfig{User: "guest", Auth: []ssh.AuthMethod{ssh.Password("pw"), answer("000000")}})
+	assert.Error(t, err)
+
+	perms, err := login(t, newConf(), &ssh.ClientConfig{User: "guest", Auth: []ssh.AuthMethod{ssh.Password("pw"), answer("081804")}})
+	assert.NoError(t, err)
+	assert.True(t, Permitted(perms, PermitPty))
+	assert.False(t, Permitted(perms, PermitPortForwarding))
+}
+
+func TestTOTP_RequiresCodeAfterVerifiedKey(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	totp := newTOTP(rfcSecret, "gmash", "guest", 1, fixedClock(&now))
+	client := generateSigner(t)
+	approved := false
+	sshConf := &ssh.ServerConfig{
+		PublicKeyCallback: CreatePublicKeyCallback([]*AuthorizedKey{{Key: client.PublicKey(), NoPty: true}}),
+		VerifiedPublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey, perms *ssh.Permissions, alg string) (*ssh.Permissions, error) {
+			approved = true
+			return perms, nil
+		},
+	}
+	totp.Require(sshConf)
+
+	perms, err := login(t, sshConf, &ssh.ClientConfig{User: "guest", Auth: []ssh.AuthMethod{ssh.PublicKeys(client), answer("081804")}})
+	assert.NoError(t, err)
+	assert.True(t, approved)
+	assert.False(t, Permitted(perms, PermitPty))
+}
@@ -52,7 +52,7 @@ func (c *Console) Error() *Console {
 
 // Printf formats and writes to the console
 func (c *Console) Printf(format string, a ...interface{}) (n int, err error) {
-	n, err = fmt.Fprintf(c.writer, c.prefix)
+	n, err = fmt.Fprint(c.writer, c.prefix)
 	if err != nil {
 		return 0, err
 	}
@@ -60,7 +60,7 @@ func (c *Console) Printf(format string, a ...interface{}) (n int, err error) {
 	if err != nil {
 		return 0, err
 	}
-	_, err = fmt.Fprintf(c.writer, c.postfix)
+	_, err = fmt.Fprint(c.writer, c.postfix)
 	if err != nil {
 		return 0, err
 	}
@@ -0,0 +1,97 @@
+package console
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Prompter asks the host questions at the console. Questions are asked one
+// at a time and lines the host types when there's no question are passed to
+// the command handler.
+type Prompter struct {
+	printer  Printer
+	turn     chan struct{}
+	mutex    sync.Mutex
+	answer   chan string
+	commands func(line string)
+}
+
+// NewPrompter creates a Prompter that reads the host's input from reader and
+// writes questions to printer
+func NewPrompter(reader io.Reader, printer Printer) *Prompter {
+	p := &Prompter{
+		printer: printer,
+		turn:    make(chan struct{}, 1),
+	}
+	go p.read(reader)
+	return p
+}
+
+// NewPrompter creates a Prompter that asks questions on the console
+func (c *Console) NewPrompter(reader io.Reader) *Prompter {
+	return NewPrompter(reader, c)
+}
+
+func (p *Prompter) read(reader io.Reader) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		p.mutex.Lock()
+		answer := p.answer
+		p.answer = nil
+		commands := p.commands
+		p.mutex.Unlock()
+
+		if answer != nil {
+			answer <- line
+		} else if commands != nil {
+			commands(line)
+		}
+	}
+}
+
+// HandleCommands sets the function that's called with each line that isn't
+// the answer to a question
+func (p *Prompter) HandleCommands(handler func(line string)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.commands = handler
+}
+
+// Ask writes the question and waits for the host's answer. The timeout
+// includes waiting for earlier questions to be answered. It returns false if
+// the host doesn't answer in time.
+func (p *Prompter) Ask(question string, timeout time.Duration) (string, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case p.turn <- struct{}{}:
+	case <-timer.C:
+		return "", false
+	}
+	defer func() { <-p.turn }()
+
+	answer := make(chan string, 1)
+	p.mutex.Lock()
+	p.answer = answer
+	p.mutex.Unlock()
+
+	_, _ = p.printer.Printf("%s", question)
+	select {
+	case line := <-answer:
+		return line, true
+	case <-timer.C:
+		p.mutex.Lock()
+		if p.answer == answer {
+			p.answer = nil
+		}
+		p.mutex.Unlock()
+		_, _ = p.printer.Printf("\n")
+		return "", false
+	}
+}
@@ -0,0 +1,105 @@
+package console
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is a bytes.Buffer that can be used from multiple goroutines
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+func TestPrompter_AsksQuestions(t *testing.T) {
+	reader, writer := io.Pipe()
+	output := &syncBuffer{}
+	prompter := NewPrompter(reader, New(output))
+
+	go func() {
+		_, _ = writer.Write([]byte(" yes \n"))
+	}()
+	answer, ok := prompter.Ask("Allow? ", time.Minute)
+
+	assert.True(t, ok)
+	assert.Equal(t, "yes", answer)
+	assert.Equal(t, "Allow? ", output.String())
+}
+
+func TestPrompter_TimesOut(t *testing.T) {
+	reader, _ := io.Pipe()
+	output := &syncBuffer{}
+	prompter := NewPrompter(reader, New(output))
+
+	answer, ok := prompter.Ask("Allow? ", time.Millisecond)
+
+	assert.False(t, ok)
+	assert.Equal(t, "", answer)
+	assert.Equal(t, "Allow? \n", output.String())
+}
+
+func TestPrompter_TimesOutWaitingForOtherQuestions(t *testing.T) {
+	reader, writer := io.Pipe()
+	prompter := NewPrompter(reader, New(&syncBuffer{}))
+
+	asked := make(chan struct{})
+	done := make(chan string)
+	go func() {
+		close(asked)
+		answer, _ := prompter.Ask("First? ", time.Minute)
+		done <- answer
+	}()
+	<-asked
+	time.Sleep(10 * time.Millisecond)
+
+	_, ok := prompter.Ask("Second? ", 10*time.Millisecond)
+	assert.False(t, ok)
+
+	_, _ = writer.Write([]byte("first\n"))
+	assert.Equal(t, "first", <-done)
+}
+
+func TestPrompter_PassesOtherLinesToCommandHandler(t *testing.T) {
+	reader, writer := io.Pipe()
+	prompter := NewPrompter(reader, New(&syncBuffer{}))
+	commands := make(chan string, 1)
+	prompter.HandleCommands(func(line string) {
+		commands <- line
+	})
+
+	_, _ = writer.Write([]byte("rotate\n"))
+
+	assert.Equal(t, "rotate", <-commands)
+}
+
+func TestConsole_NewPrompterAsksOnConsole(t *testing.T) {
+	reader, writer := io.Pipe()
+	output := &syncBuffer{}
+	prompter := New(output).Warn().NewPrompter(reader)
+
+	go func() {
+		_, _ = writer.Write([]byte("y\n"))
+	}()
+	answer, ok := prompter.Ask("Allow? ", time.Minute)
+
+	assert.True(t, ok)
+	assert.Equal(t, "y", answer)
+	assert.Equal(t, "\033[1;33mAllow? \033[00m", output.String())
+}
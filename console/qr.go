@@ -0,0 +1,52 @@
+package console
+
+import (
+	"strings"
+
+	"rsc.io/qr"
+)
+
+// The light border QR readers need around the code, in modules
+const qrQuietZone = 2
+
+// QRCode renders text as a QR code that can be scanned from the terminal.
+// Each character is two modules stacked vertically, and light modules are
+// drawn as blocks so the code reads correctly on a dark background.
+func QRCode(text string) (string, error) {
+	code, err := qr.Encode(text, qr.L)
+	if err != nil {
+		return "", err
+	}
+
+	light := func(x, y int) bool {
+		return !code.Black(x, y)
+	}
+	var b strings.Builder
+	for y := -qrQuietZone; y < code.Size+qrQuietZone; y += 2 {
+		for x := -qrQuietZone; x < code.Size+qrQuietZone; x++ {
+			top, bottom := light(x, y), light(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
+
+// PrintQRCode prints text as a QR code
+func (c *Console) PrintQRCode(text string) error {
+	code, err := QRCode(text)
+	if err != nil {
+		return err
+	}
+	_, err = c.Printf("%s", code)
+	return err
+}
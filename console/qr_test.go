@@ -0,0 +1,41 @@
+package console
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"rsc.io/qr"
+)
+
+func TestQRCode_DrawsTwoModulesPerCharacter(t *testing.T) {
+	text := "otpauth://totp/gmash:guest?secret=ABC"
+	code, err := qr.Encode(text, qr.L)
+	assert.NoError(t, err)
+
+	rendered, err := QRCode(text)
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSuffix(rendered, "\n"), "\n")
+	width := code.Size + 2*qrQuietZone
+	assert.Len(t, lines, (width+1)/2)
+	for _, line := range lines {
+		assert.Equal(t, width, utf8.RuneCountInString(line))
+	}
+
+	// The quiet zone is light
+	assert.Equal(t, strings.Repeat("█", width), lines[0])
+
+	// The top left finder pattern starts with a dark row
+	assert.True(t, strings.HasPrefix(lines[1], "██ ▄▄▄▄▄ "))
+}
+
+func TestConsole_PrintQRCode(t *testing.T) {
+	output := &syncBuffer{}
+	assert.NoError(t, New(output).PrintQRCode("hello"))
+
+	rendered, err := QRCode("hello")
+	assert.NoError(t, err)
+	assert.Equal(t, rendered, output.String())
+}
@@ -4,17 +4,24 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"os/exec"
 	"os/signal"
 	"os/user"
 	"path"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/efarrer/gmash/audit"
 	"github.com/efarrer/gmash/auth"
 	"github.com/efarrer/gmash/console"
 	"github.com/efarrer/gmash/ip"
 	"github.com/efarrer/gmash/ngrok"
+	"github.com/efarrer/gmash/share"
 	"github.com/efarrer/gmash/sshd"
 	"github.com/efarrer/gmash/version"
 
@@ -22,7 +29,15 @@ import (
 )
 
 func main() {
-	console := console.New(os.Stdout)
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay(os.Args[2:])
+		return
+	}
+
+	// gmash's messages go through the shared terminal so they're readable
+	// while the host's shell is running in it
+	terminal := share.NewTerminal(os.Stdout)
+	console := console.New(terminal.Messages())
 	logger := log.New(os.Stderr, "", 0)
 
 	console.Printf("GMASH (Version: %s)\n", version.String)
@@ -34,9 +49,64 @@ func main() {
 	}
 
 	var local = flag.Bool("local", false, "Whether to only allow connections over the local network")
+	var sftpRoot = flag.String("sftp-root", "", "The directory guests can read over SFTP (empty disables SFTP)")
+	var sftpWrite = flag.Bool("sftp-write", false, "Whether guests can also modify files in the -sftp-root directory")
+	var scpRoot = flag.String("scp-root", "", "The directory guests are restricted to when using scp (empty allows any file)")
+	var authorizedKeysFile = flag.String("authorized-keys", "", "An authorized_keys file with the public keys allowed to log in")
+	var authorizedKeyLines stringList
+	flag.Var(&authorizedKeyLines, "authorized-key", "A public key allowed to log in, in authorized_keys format (may be repeated)")
+	var invites stringList
+	flag.Var(&invites, "invite", "A user whose published public keys are allowed to log in, or a URL of keys (may be repeated)")
+	var keysURL = flag.String("keys-url", auth.DefaultKeysURL, "The site where invited users publish their keys as <url>/<user>.keys")
+	var userCAFile = flag.String("user-ca", "", "A file of CA public keys whose user certificates are allowed to log in")
+	var principals stringList
+	flag.Var(&principals, "principal", "A principal user certificates must list (may be repeated, defaults to the login name)")
+	var hostCerts stringList
+	flag.Var(&hostCerts, "host-cert", "A certificate for one of the host keys signed by a host CA (may be repeated)")
+	var passwordUses = flag.Int("password-uses", 0, "The number of logins before the password must be rotated (0 is unlimited)")
+	var passwordLifetime = flag.Duration("password-lifetime", 0, "How long the password is valid for before it must be rotated (0 never expires)")
+	var approve = flag.Bool("approve", false, "Whether each login must be approved at the console")
+	var approveTimeout = flag.Duration("approve-timeout", 30*time.Second, "How long to wait for a login to be approved before denying it")
+	var allowPassword = flag.Bool("password", false, "Whether to allow password authentication when authorized keys are given")
+	var requireTOTP = flag.Bool("totp", false, "Whether logins must also enter a code from an authenticator app")
+	var totpSkew = flag.Int("totp-skew", auth.DefaultTOTPSkew, "The number of 30 second periods a code may be early or late by")
+	var maxAuthFailures = flag.Int("max-auth-failures", auth.DefaultRateLimitConfig.MaxFailures, "The number of failed logins from an address before it's banned (0 never bans)")
+	var banDuration = flag.Duration("ban-duration", auth.DefaultRateLimitConfig.BanDuration, "How long an address is banned for after too many failed logins")
+	var maxSharedFailures = flag.Int("max-loopback-failures", auth.DefaultRateLimitConfig.MaxSharedFailures, "The number of failed logins from loopback addresses (every guest over ngrok) before new connections from them are refused for a minute (0 never refuses)")
+	var knownHostsFile = flag.String("known-hosts-file", "", "A file to write the server's known_hosts entries to")
+	var hostKeyTypes = flag.String("host-keys", "ed25519,ecdsa,rsa", "The types of host key to offer (rsa is gmash's original key)")
+	var shareTerminal = flag.Bool("share", false, "Whether guests watch the host's shell read-only instead of getting their own")
+	var collaborate = flag.Bool("collaborate", false, "Whether the host can hand the keyboard to guests watching the shared shell (implies -share)")
+	var guestHandOff = flag.Bool("guest-handoff", false, "Whether a guest with the keyboard can pass it on to the next guest (with -collaborate)")
+	var record = flag.Bool("record", false, "Whether to record guests' terminal sessions to ~/.gmash/recordings")
+	var recordInput = flag.Bool("record-input", false, "Whether recordings include what guests type (with -record)")
+	var auditLogFile = flag.String("audit-log", "", "A file to append a JSON line to for every connection, login, channel and request")
+	var permitOpen stringList
+	flag.Var(&permitOpen, "permit-open", "A host:port guests may forward connections to with ssh -L, * matches any host or port (may be repeated)")
+	var permitSockets stringList
+	flag.Var(&permitSockets, "permit-socket", "A Unix socket guests may forward connections to or listen on, * matches any name (may be repeated)")
+	var acceptEnv stringList
+	flag.Var(&acceptEnv, "accept-env", "An environment variable guests may send (ssh -o SendEnv), * matches any characters. Replaces the default of LANG, LC_* and TERM (may be repeated)")
+	var setEnv stringList
+	flag.Var(&setEnv, "setenv", "A NAME=VALUE environment variable to set for every guest's session (may be repeated)")
+	var agentForwarding = flag.Bool("agent-forwarding", false, "Whether guests can forward their ssh agent so the commands they run can use their keys")
+	var x11Forwarding = flag.Bool("x11-forwarding", false, "Whether guests can forward their X11 display (ssh -X) to run graphical programs")
+	var gatewayPorts = flag.Bool("gateway-ports", false, "Whether guests' remote forwards (ssh -R) can listen on any address instead of only the loopback interface")
+	var maxHandshakes = flag.Int("max-handshakes", sshd.DefaultMaxHandshakes, "The number of connections that can be authenticating at once (0 is unlimited)")
 
 	flag.Parse()
 
+	if *collaborate {
+		*shareTerminal = true
+		terminal.Collaborate(*guestHandOff)
+	}
+	if *shareTerminal && *approve {
+		logger.Fatalf("-approve can't be used with -share since the host's shell reads the console\n")
+	}
+	if *shareTerminal && *record {
+		logger.Fatalf("-record can't be used with -share since guests watch the host's shell instead of their own sessions\n")
+	}
+
 	// Get the user's home directory
 	usr, err := user.Current()
 	if err != nil {
@@ -50,28 +120,273 @@ func main() {
 		logger.Fatalf("Unable to create %s (%s)\n", gmashDir, err)
 	}
 
-	// Generate a random user password for this session
-	masterPassword, err := auth.GeneratePassword(10)
-	if err != nil {
-		logger.Fatalf("Unable to generate password (%s)", err)
+	// Load the public keys allowed to log in
+	var authorizedKeys []*auth.AuthorizedKey
+	if *authorizedKeysFile != "" {
+		authorizedKeys, err = auth.LoadAuthorizedKeys(*authorizedKeysFile)
+		if err != nil {
+			logger.Fatalf("%s\n", err)
+		}
+	}
+	for _, line := range authorizedKeyLines {
+		key, err := auth.ParseAuthorizedKey(line)
+		if err != nil {
+			logger.Fatalf("%s\n", err)
+		}
+		authorizedKeys = append(authorizedKeys, key)
+	}
+	keySource := auth.NewURLKeySource(*keysURL)
+	for _, invite := range invites {
+		var keys []*auth.AuthorizedKey
+		if strings.Contains(invite, "://") {
+			keys, err = auth.FetchKeys(invite)
+		} else {
+			keys, err = keySource.Keys(invite)
+		}
+		if err != nil {
+			logger.Fatalf("Unable to invite %s (%s)\n", invite, err)
+		}
+		console.Printf("Invited %s with %d public keys\n", invite, len(keys))
+		authorizedKeys = append(authorizedKeys, keys...)
+	}
+	var caKeys []ssh.PublicKey
+	if *userCAFile != "" {
+		caKeys, err = auth.LoadCAKeys(*userCAFile)
+		if err != nil {
+			logger.Fatalf("%s\n", err)
+		}
+	}
+	usePassword := (len(authorizedKeys) == 0 && len(caKeys) == 0) || *allowPassword
+
+	// Construct the ssh configuration with public key, certificate and/or
+	// password authentication
+	sshConf := ssh.ServerConfig{}
+	if len(authorizedKeys) != 0 {
+		sshConf.PublicKeyCallback = auth.CreatePublicKeyCallback(authorizedKeys)
+	}
+	if len(caKeys) != 0 {
+		sshConf.PublicKeyCallback = auth.CreateCertificateCallback(caKeys, principals, sshConf.PublicKeyCallback)
+	}
+	var sessionPassword *auth.SessionPassword
+	if usePassword {
+		// Generate a random user password for this session
+		sessionPassword, err = auth.NewSessionPassword(10, auth.PasswordPolicy{MaxLogins: *passwordUses, Lifetime: *passwordLifetime})
+		if err != nil {
+			logger.Fatalf("Unable to generate password (%s)", err)
+		}
+		sshConf.PasswordCallback = sessionPassword.CreatePasswordCallback()
+	}
+
+	// The password can be rotated without dropping the guests that are
+	// already logged in
+	rotatePassword := func() {
+		if sessionPassword == nil {
+			console.Warn().Printf("Password authentication is disabled\n")
+			return
+		}
+		_, err := sessionPassword.Rotate()
+		if err != nil {
+			console.Error().Printf("Unable to rotate password (%s)\n", err)
+			return
+		}
+		printPassword(console, sessionPassword)
+	}
+
+	// When the host's shell is shared it reads the console instead
+	var approver auth.Approver
+	if !*shareTerminal {
+		prompter := console.NewPrompter(os.Stdin)
+		prompter.HandleCommands(func(line string) {
+			switch line {
+			case "":
+			case "rotate":
+				rotatePassword()
+			default:
+				console.Warn().Printf("Unknown command %q (type \"rotate\" to generate a new password)\n", line)
+			}
+		})
+
+		if *approve {
+			approver = auth.CreateConsoleApprover(prompter, *approveTimeout)
+		}
+	}
+
+	// Ask for a code once the password or key has been accepted
+	var totp *auth.TOTP
+	if *requireTOTP {
+		totp, err = auth.NewTOTP("gmash", usr.Username, *totpSkew)
+		if err != nil {
+			logger.Fatalf("%s\n", err)
+		}
+		totp.Require(&sshConf)
+	}
+	// Logins are approved once they're complete so the host isn't asked about
+	// guests that then enter the wrong code
+	if approver != nil {
+		if sshConf.PasswordCallback != nil {
+			sshConf.PasswordCallback = auth.CreateApprovedPasswordCallback(sshConf.PasswordCallback, approver)
+		}
+		if sshConf.PublicKeyCallback != nil {
+			sshConf.VerifiedPublicKeyCallback = auth.CreateApprovalCallback(sshConf.VerifiedPublicKeyCallback, approver)
+		}
+	}
+	// Denied logins and wrong codes don't use up the password
+	if sessionPassword != nil {
+		sessionPassword.CountLogins(&sshConf)
+	}
+
+	// Slow down and ban clients that keep guessing
+	rateLimitConfig := auth.DefaultRateLimitConfig
+	rateLimitConfig.MaxFailures = *maxAuthFailures
+	rateLimitConfig.BanDuration = *banDuration
+	rateLimitConfig.MaxSharedFailures = *maxSharedFailures
+	rateLimiter := auth.NewRateLimiter(rateLimitConfig)
+	rateLimiter.OnBan(func(host string, until time.Time) {
+		console.Warn().Printf("Banned %s until %s after too many failed logins\n", host, until.Format(time.Kitchen))
+	})
+	rateLimiter.Protect(&sshConf)
+
+	// Every connection, login, channel and request is logged for auditing
+	var auditLog *audit.Logger
+	if *auditLogFile != "" {
+		auditLog, err = audit.Open(*auditLogFile)
+		if err != nil {
+			logger.Fatalf("%s\n", err)
+		}
+		defer func() { _ = auditLog.Close() }()
+		auditLog.OnError(func(err error) { console.Error().Printf("%s\n", err) })
+		auditLog.WatchAuthentication(&sshConf)
+	}
+	logAudit := func(event audit.Event) {
+		if auditLog == nil {
+			return
+		}
+		err := auditLog.Log(event)
+		if err != nil {
+			console.Error().Printf("%s\n", err)
+		}
 	}
 
-	// Construct the ssh configuration with password authentication
-	sshConf := ssh.ServerConfig{
-		PasswordCallback: auth.CreatePasswordCallback(masterPassword),
+	shellOptions := []sshd.ShellOption{
+		sshd.WithConnectionFilter(rateLimiter.AllowConnection),
+		sshd.WithMaxHandshakes(*maxHandshakes),
+	}
+	if *sftpRoot != "" {
+		sftpSubsystem, err := sshd.SFTPSubsystem(*sftpRoot, !*sftpWrite)
+		if err != nil {
+			logger.Fatalf("%s\n", err)
+		}
+		shellOptions = append(shellOptions, sshd.WithSubsystem("sftp", sftpSubsystem))
+	}
+	scpHandler, err := sshd.SCPCommandHandler(*scpRoot)
+	if err != nil {
+		logger.Fatalf("%s\n", err)
+	}
+	shellOptions = append(shellOptions, sshd.WithCommandHandler(scpHandler))
+	if *shareTerminal {
+		shellOptions = append(shellOptions, sshd.WithSharedTerminal(terminal))
+	}
+	if *record {
+		shellOptions = append(shellOptions, sshd.WithRecording(path.Join(gmashDir, "recordings"), *recordInput))
+	}
+	if len(permitOpen) != 0 {
+		forwardAllowList, err := sshd.NewForwardAllowList(permitOpen)
+		if err != nil {
+			logger.Fatalf("%s\n", err)
+		}
+		shellOptions = append(shellOptions, sshd.WithForwardAllowList(forwardAllowList))
 	}
+	if len(permitSockets) != 0 {
+		socketAllowList, err := sshd.NewSocketAllowList(permitSockets)
+		if err != nil {
+			logger.Fatalf("%s\n", err)
+		}
+		shellOptions = append(shellOptions, sshd.WithSocketAllowList(socketAllowList))
+	}
+	if len(acceptEnv) != 0 {
+		envAllowList, err := sshd.NewEnvAllowList(acceptEnv)
+		if err != nil {
+			logger.Fatalf("%s\n", err)
+		}
+		shellOptions = append(shellOptions, sshd.WithEnvAllowList(envAllowList))
+	}
+	if len(setEnv) != 0 {
+		env, err := sshd.ParseEnv(setEnv)
+		if err != nil {
+			logger.Fatalf("%s\n", err)
+		}
+		shellOptions = append(shellOptions, sshd.WithEnv(env))
+	}
+	if *gatewayPorts {
+		shellOptions = append(shellOptions, sshd.WithGatewayPorts())
+	}
+	if *agentForwarding {
+		shellOptions = append(shellOptions, sshd.WithAgentForwarding())
+	}
+	if *x11Forwarding {
+		shellOptions = append(shellOptions, sshd.WithX11Forwarding())
+	}
+	shellOptions = append(shellOptions, sshd.WithAuditHandler(func(event audit.Event) {
+		logAudit(event)
+		if event.Event == audit.Request && event.Outcome == audit.Success {
+			switch event.Request {
+			case "tcpip-forward", "streamlocal-forward@openssh.com":
+				console.Notify().Printf("%s@%s is forwarding connections to %s on this machine to their machine\n", event.User, event.RemoteAddr, event.Listen)
+			case "cancel-tcpip-forward", "cancel-streamlocal-forward@openssh.com":
+				console.Printf("%s@%s stopped forwarding connections to %s\n", event.User, event.RemoteAddr, event.Listen)
+			case "auth-agent-req@openssh.com":
+				console.Warn().Printf("%s@%s forwarded their ssh agent into session %s\n", event.User, event.RemoteAddr, event.ChannelID)
+			case "x11-req":
+				console.Notify().Printf("%s@%s forwarded their X11 display into session %s\n", event.User, event.RemoteAddr, event.ChannelID)
+			}
+		}
+		if event.ChannelType != "direct-tcpip" && event.ChannelType != "direct-streamlocal@openssh.com" {
+			return
+		}
+		switch event.Event {
+		case audit.ChannelOpened:
+			console.Notify().Printf("%s@%s is forwarding connections to %s\n", event.User, event.RemoteAddr, event.Destination)
+		case audit.ChannelClosed:
+			console.Printf("%s@%s stopped forwarding to %s (%d bytes in, %d bytes out)\n", event.User, event.RemoteAddr, event.Destination, *event.BytesIn, *event.BytesOut)
+		}
+	}))
+	shellOptions = append(shellOptions, sshd.WithSessionEndHandler(func(end sshd.SessionEnd) {
+		recorded := ""
+		if end.Recording != "" {
+			recorded = ", recorded to " + end.Recording
+		}
+		console.Printf("%s's session %s ended%s\n", end.Guest, end.ID, recorded)
+	}))
 	shellConf := sshd.DefaultShellConf(
 		"/bin/bash",
-		func(err error) { fmt.Printf("%s\n", err) },
+		func(err error) {
+			console.Printf("%s\n", err)
+			logAudit(audit.Event{Event: audit.Error, Error: err.Error()})
+		},
+		shellOptions...,
 	)
 
 	// Generate server ssh keys
-	signer, err := auth.TryLoadKeys(path.Join(gmashDir, "key"))
+	keyTypes, err := auth.ParseKeyTypes(*hostKeyTypes)
+	if err != nil {
+		logger.Fatalf("%s\n", err)
+	}
+	signers, err := auth.LoadHostKeys(gmashDir, keyTypes)
 	if err != nil {
-		logger.Fatal(err)
+		logger.Fatalf("%s\n", err)
+	}
+	for _, signer := range signers {
+		sshConf.AddHostKey(signer)
+	}
+	var certSigners []ssh.Signer
+	for _, hostCert := range hostCerts {
+		certSigner, err := auth.LoadHostCertificate(hostCert, signers)
+		if err != nil {
+			logger.Fatalf("%s\n", err)
+		}
+		sshConf.AddHostKey(certSigner)
+		certSigners = append(certSigners, certSigner)
 	}
-	sshConf.AddHostKey(signer)
-	fpMD5, fpSHA256 := auth.GetFingerPrint(signer)
 
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -114,22 +429,143 @@ func main() {
 		}
 	}
 
-	console.Printf("Started server with RSA key: ")
-	console.Success().Printf("%s\n", fpMD5)
-	console.Printf("Started server with RSA key: ")
-	console.Success().Printf("%s\n", fpSHA256)
+	for _, signer := range signers {
+		fpMD5, fpSHA256 := auth.GetFingerPrint(signer)
+		console.Printf("Started server with %s key: ", signer.PublicKey().Type())
+		console.Success().Printf("%s\n", fpMD5)
+		console.Printf("Started server with %s key: ", signer.PublicKey().Type())
+		console.Success().Printf("%s\n", fpSHA256)
+	}
 	console.Printf("\n")
 	console.Printf("To connect type:\n")
-	console.Notify().Printf("ssh -o UserKnownHostsFile=/dev/null %s -p %d\n\n", pubIP, port)
-	console.Printf("password: ")
-	console.Success().Printf("%s\n", masterPassword)
+	if len(certSigners) != 0 {
+		// Guests that trust the host CA can verify the server
+		console.Notify().Printf("ssh %s -p %d\n\n", pubIP, port)
+		for _, certSigner := range certSigners {
+			cert := certSigner.PublicKey().(*ssh.Certificate)
+			if !certifies(cert, pubIP) {
+				console.Warn().Printf("The host certificate %s isn't valid for %s\n", cert.KeyId, pubIP)
+			}
+		}
+	} else {
+		// The command pins the host key so guests don't have to check the
+		// fingerprint by hand
+		console.Notify().Printf("%s\n", auth.VerifiedSSHCommand(pubIP, port, signers[0].PublicKey()))
+		console.Printf("Or with OpenSSH older than 8.5:\n")
+		console.Notify().Printf("%s\n\n", auth.TempKnownHostsCommand(pubIP, port, signers[0].PublicKey()))
+	}
+	var hostKeys []ssh.PublicKey
+	for _, signer := range signers {
+		hostKeys = append(hostKeys, signer.PublicKey())
+	}
+	knownHosts := auth.KnownHostsLines(pubIP, port, hostKeys)
+	console.Printf("known_hosts:\n")
+	for _, line := range knownHosts {
+		console.Printf("%s\n", line)
+	}
+	if *knownHostsFile != "" {
+		err = ioutil.WriteFile(*knownHostsFile, []byte(strings.Join(knownHosts, "\n")+"\n"), 0644)
+		if err != nil {
+			console.Error().Printf("Unable to write %s (%s)\n", *knownHostsFile, err)
+		} else {
+			console.Printf("Wrote the known_hosts entries to %s\n", *knownHostsFile)
+		}
+	}
+	console.Printf("\n")
+	if len(authorizedKeys) != 0 {
+		console.Printf("Authorized public keys: ")
+		console.Success().Printf("%d\n", len(authorizedKeys))
+	}
+	if len(caKeys) != 0 {
+		console.Printf("Trusted user CAs: ")
+		console.Success().Printf("%d\n", len(caKeys))
+	}
+	if usePassword {
+		printPassword(console, sessionPassword)
+	}
+	if totp != nil {
+		console.Printf("\nScan with an authenticator app to get verification codes:\n")
+		err = console.PrintQRCode(totp.URI())
+		if err != nil {
+			console.Error().Printf("Unable to show QR code (%s)\n", err)
+		}
+		console.Printf("%s\n", totp.URI())
+		console.Printf("TOTP secret: ")
+		console.Success().Printf("%s\n", totp.Secret())
+	}
+	if *agentForwarding {
+		console.Warn().Printf("\nAgent forwarding is enabled. Anything running as you can use a guest's keys while their agent is forwarded.\n")
+	}
+
+	if *shareTerminal {
+		shell := os.Getenv("SHELL")
+		if shell == "" {
+			shell = "/bin/bash"
+		}
+		console.Printf("\nGuests are watching this terminal. Exit the shell to stop sharing.\n")
+		if *collaborate {
+			console.Printf("Press %s to hand the keyboard to the next guest or to take it back.\n", share.HandOffKeyName)
+		}
+		console.Printf("\n")
+		err = terminal.Start(exec.Command(shell), os.Stdin)
+		if err != nil {
+			logger.Fatalf("%s\n", err)
+		}
+	}
 
 	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, os.Interrupt)
-	select {
-	case <-signalCh:
-		cancel()
-		fmt.Printf("Bubye\n")
-	case <-ctx.Done():
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGUSR1)
+	for {
+		select {
+		case sig := <-signalCh:
+			if sig == syscall.SIGUSR1 {
+				rotatePassword()
+				continue
+			}
+			cancel()
+			fmt.Printf("Bubye\n")
+			return
+		case <-terminal.Done():
+			cancel()
+			console.Printf("Bubye\n")
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// printPassword shows the password and its limits
+func printPassword(console *console.Console, password *auth.SessionPassword) {
+	console.Printf("password: ")
+	console.Success().Printf("%s", password.Password())
+	if policy := password.Policy().String(); policy != "" {
+		console.Printf(" (%s)", policy)
+	}
+	console.Printf("\n")
+}
+
+// certifies returns true if the host certificate is valid for the host
+func certifies(cert *ssh.Certificate, host string) bool {
+	if len(cert.ValidPrincipals) == 0 {
+		return true
 	}
+	for _, principal := range cert.ValidPrincipals {
+		if principal == host {
+			return true
+		}
+	}
+	return false
+}
+
+// stringList is a flag that can be given multiple times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
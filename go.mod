@@ -1,12 +1,20 @@
 module github.com/efarrer/gmash
 
-go 1.12
+go 1.25.0
 
 require (
-	github.com/davecgh/go-spew v1.1.0 // indirect
 	github.com/kr/pty v1.0.0
+	github.com/pkg/sftp v1.13.11
+	github.com/stretchr/testify v1.11.1
+	golang.org/x/crypto v0.54.0
+	golang.org/x/sys v0.47.0
+	golang.org/x/term v0.45.0
+	rsc.io/qr v0.2.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.1.4
-	golang.org/x/crypto v0.0.0-20170606163016-e7ba82683099
-	golang.org/x/sys v0.0.0-20190801041406-cbf593c0f2f3 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
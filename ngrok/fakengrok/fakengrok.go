@@ -58,7 +58,7 @@ func main() {
 		if characters > len(data) {
 			characters = len(data)
 		}
-		fmt.Printf(data[:characters])
+		fmt.Print(data[:characters])
 		data = data[characters:]
 	}
 
@@ -15,6 +15,14 @@ func parseUInt32(b []byte) (interface{}, []byte, error) {
 	return binary.BigEndian.Uint32(b), b[4:], nil
 }
 
+func parseBool(b []byte) (interface{}, []byte, error) {
+	if len(b) < 1 {
+		return nil, []byte{}, fmt.Errorf("Unable to parse bool not enough bytes remaining (%d)", len(b))
+	}
+
+	return b[0] != 0, b[1:], nil
+}
+
 func parseBytes(b []byte) (interface{}, []byte, error) {
 	return b, []byte{}, nil
 }
@@ -49,12 +57,12 @@ func parsePayload(b []byte, parsers []parser) ([]interface{}, error) {
 
 // PtyConfig contains PTY configuration from a Pty request
 type PtyConfig struct {
-	ttyType       string
-	widthChars    uint32
-	heightCols    uint32
-	widthPixels   uint32
-	heightPixels  uint32
-	terminalModes []byte
+	TtyType       string
+	WidthChars    uint32
+	HeightRows    uint32
+	WidthPixels   uint32
+	HeightPixels  uint32
+	TerminalModes []byte
 }
 
 // ParsePtyReq Parses the SSH Pty request payload
@@ -66,11 +74,204 @@ func ParsePtyReq(b []byte) (*PtyConfig, error) {
 	}
 
 	return &PtyConfig{
-		ttyType:       data[0].(string),
-		widthChars:    data[1].(uint32),
-		heightCols:    data[2].(uint32),
-		widthPixels:   data[3].(uint32),
-		heightPixels:  data[4].(uint32),
-		terminalModes: data[5].([]byte),
+		TtyType:       data[0].(string),
+		WidthChars:    data[1].(uint32),
+		HeightRows:    data[2].(uint32),
+		WidthPixels:   data[3].(uint32),
+		HeightPixels:  data[4].(uint32),
+		TerminalModes: data[5].([]byte),
+	}, nil
+}
+
+// WindowChange contains the new terminal dimensions from a window-change request
+type WindowChange struct {
+	WidthChars   uint32
+	HeightRows   uint32
+	WidthPixels  uint32
+	HeightPixels uint32
+}
+
+// ParseWindowChange Parses the SSH window-change request payload
+func ParseWindowChange(b []byte) (*WindowChange, error) {
+	// See RFC 4254 6.7
+	data, err := parsePayload(b, []parser{parseUInt32, parseUInt32, parseUInt32, parseUInt32})
+	if err != nil {
+		return nil, err
+	}
+
+	return &WindowChange{
+		WidthChars:   data[0].(uint32),
+		HeightRows:   data[1].(uint32),
+		WidthPixels:  data[2].(uint32),
+		HeightPixels: data[3].(uint32),
+	}, nil
+}
+
+// ExecReq contains the command from an exec request
+type ExecReq struct {
+	Command string
+}
+
+// ParseExecReq Parses the SSH exec request payload
+func ParseExecReq(b []byte) (*ExecReq, error) {
+	// See RFC 4254 6.5
+	data, err := parsePayload(b, []parser{parseString})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExecReq{
+		Command: data[0].(string),
+	}, nil
+}
+
+// EnvReq contains the environment variable from an env request
+type EnvReq struct {
+	Name  string
+	Value string
+}
+
+// ParseEnvReq Parses the SSH env request payload
+func ParseEnvReq(b []byte) (*EnvReq, error) {
+	// See RFC 4254 6.4
+	data, err := parsePayload(b, []parser{parseString, parseString})
+	if err != nil {
+		return nil, err
+	}
+
+	return &EnvReq{
+		Name:  data[0].(string),
+		Value: data[1].(string),
+	}, nil
+}
+
+// SubsystemReq contains the subsystem name from a subsystem request
+type SubsystemReq struct {
+	Name string
+}
+
+// ParseSubsystemReq Parses the SSH subsystem request payload
+func ParseSubsystemReq(b []byte) (*SubsystemReq, error) {
+	// See RFC 4254 6.5
+	data, err := parsePayload(b, []parser{parseString})
+	if err != nil {
+		return nil, err
+	}
+
+	return &SubsystemReq{
+		Name: data[0].(string),
+	}, nil
+}
+
+// DirectTCPIP contains where a direct-tcpip channel connects to and where the
+// connection came from
+type DirectTCPIP struct {
+	Host           string
+	Port           uint32
+	OriginatorIP   string
+	OriginatorPort uint32
+}
+
+// ParseDirectTCPIP Parses the SSH direct-tcpip channel open payload
+func ParseDirectTCPIP(b []byte) (*DirectTCPIP, error) {
+	// See RFC 4254 7.2
+	data, err := parsePayload(b, []parser{parseString, parseUInt32, parseString, parseUInt32})
+	if err != nil {
+		return nil, err
+	}
+
+	return &DirectTCPIP{
+		Host:           data[0].(string),
+		Port:           data[1].(uint32),
+		OriginatorIP:   data[2].(string),
+		OriginatorPort: data[3].(uint32),
+	}, nil
+}
+
+// TCPIPForward contains the address from a tcpip-forward or
+// cancel-tcpip-forward request
+type TCPIPForward struct {
+	Address string
+	Port    uint32
+}
+
+// ParseTCPIPForward Parses the SSH tcpip-forward and cancel-tcpip-forward
+// request payloads
+func ParseTCPIPForward(b []byte) (*TCPIPForward, error) {
+	// See RFC 4254 7.1
+	data, err := parsePayload(b, []parser{parseString, parseUInt32})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TCPIPForward{
+		Address: data[0].(string),
+		Port:    data[1].(uint32),
+	}, nil
+}
+
+// DirectStreamLocal contains the socket a direct-streamlocal@openssh.com
+// channel connects to
+type DirectStreamLocal struct {
+	SocketPath string
+}
+
+// ParseDirectStreamLocal Parses the SSH direct-streamlocal@openssh.com
+// channel open payload
+func ParseDirectStreamLocal(b []byte) (*DirectStreamLocal, error) {
+	// See OpenSSH's PROTOCOL 2.4, the reserved fields are ignored
+	data, err := parsePayload(b, []parser{parseString, parseString, parseUInt32})
+	if err != nil {
+		return nil, err
+	}
+
+	return &DirectStreamLocal{
+		SocketPath: data[0].(string),
+	}, nil
+}
+
+// StreamLocalForward contains the socket from a
+// streamlocal-forward@openssh.com or cancel-streamlocal-forward@openssh.com
+// request
+type StreamLocalForward struct {
+	SocketPath string
+}
+
+// ParseStreamLocalForward Parses the SSH streamlocal-forward@openssh.com and
+// cancel-streamlocal-forward@openssh.com request payloads
+func ParseStreamLocalForward(b []byte) (*StreamLocalForward, error) {
+	// See OpenSSH's PROTOCOL 2.4
+	data, err := parsePayload(b, []parser{parseString})
+	if err != nil {
+		return nil, err
+	}
+
+	return &StreamLocalForward{
+		SocketPath: data[0].(string),
+	}, nil
+}
+
+// X11Req contains the client's X11 authentication from an x11-req request
+type X11Req struct {
+	SingleConnection bool
+	AuthProtocol     string
+	// The hex encoded cookie
+	AuthCookie   string
+	ScreenNumber uint32
+}
+
+// ParseX11Req Parses the SSH x11-req request payload
+func ParseX11Req(b []byte) (*X11Req, error) {
+	// See RFC 4254 6.3.1
+	data, err := parsePayload(b, []parser{parseBool, parseString, parseString, parseUInt32})
+	if err != nil {
+		return nil, err
+	}
+
+	return &X11Req{
+		SingleConnection: data[0].(bool),
+		AuthProtocol:     data[1].(string),
+		AuthCookie:       data[2].(string),
+		ScreenNumber:     data[3].(uint32),
 	}, nil
 }
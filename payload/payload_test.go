@@ -26,6 +26,20 @@ func TestParseUint32_ReturnsUnusedBytes(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestParseBool_ParsesBytes(t *testing.T) {
+	res, rest, err := parseBool([]byte{0x1, 0x2})
+	assert.Equal(t, true, res.(bool))
+	assert.Equal(t, rest, []byte{0x2})
+	assert.Nil(t, err)
+}
+
+func TestParseBool_ReturnsErrorIfNotEnoughBytes(t *testing.T) {
+	res, rest, err := parseBool([]byte{})
+	assert.Nil(t, res)
+	assert.Equal(t, rest, []byte{})
+	assert.NotNil(t, err)
+}
+
 func TestParseBytes_ReturnsUnusedBytes(t *testing.T) {
 	res, rest, err := parseBytes([]byte{0x0, 0x0, 0x0, 0x0, 0x1})
 	assert.Equal(t, res, []byte{0x0, 0x0, 0x0, 0x0, 0x1})
@@ -80,3 +94,188 @@ func TestParsePtyRequst_HandlesInValidPtyRequest(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Nil(t, ptyConf)
 }
+
+func TestParseWindowChange_HandlesValidWindowChange(t *testing.T) {
+	windowChange, err := ParseWindowChange([]byte{
+		0x0, 0x0, 0x0, 0x50, // width chars
+		0x0, 0x0, 0x0, 0x18, // height rows
+		0x0, 0x0, 0x2, 0x80, // width pixels
+		0x0, 0x0, 0x1, 0xE0, // height pixels
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, *windowChange, WindowChange{uint32(80), uint32(24), uint32(640), uint32(480)})
+}
+
+func TestParseWindowChange_HandlesInValidWindowChange(t *testing.T) {
+	windowChange, err := ParseWindowChange([]byte{
+		0x0, 0x0, 0x0, 0x50, // width chars
+		0x0, 0x0, 0x0, 0x18, // height rows
+		0x0, 0x0, 0x2, // Whoops missing a byte
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, windowChange)
+}
+
+func TestParseExecReq_HandlesValidExecRequest(t *testing.T) {
+	execReq, err := ParseExecReq([]byte{
+		0x0, 0x0, 0x0, 0x2, 0x6c, 0x73, // command
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, *execReq, ExecReq{"ls"})
+}
+
+func TestParseExecReq_HandlesInValidExecRequest(t *testing.T) {
+	execReq, err := ParseExecReq([]byte{
+		0x0, 0x0, 0x0, 0x2, 0x6c, // Whoops missing a byte
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, execReq)
+}
+
+func TestParseEnvReq_HandlesValidEnvRequest(t *testing.T) {
+	envReq, err := ParseEnvReq([]byte{
+		0x0, 0x0, 0x0, 0x1, 0x41, // name
+		0x0, 0x0, 0x0, 0x1, 0x42, // value
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, *envReq, EnvReq{"A", "B"})
+}
+
+func TestParseEnvReq_HandlesInValidEnvRequest(t *testing.T) {
+	envReq, err := ParseEnvReq([]byte{
+		0x0, 0x0, 0x0, 0x1, 0x41, // name
+		0x0, 0x0, 0x0, 0x1, // Whoops missing the value
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, envReq)
+}
+
+func TestParseSubsystemReq_HandlesValidSubsystemRequest(t *testing.T) {
+	subsystemReq, err := ParseSubsystemReq([]byte{
+		0x0, 0x0, 0x0, 0x4, 0x73, 0x66, 0x74, 0x70, // name
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, *subsystemReq, SubsystemReq{"sftp"})
+}
+
+func TestParseSubsystemReq_HandlesInValidSubsystemRequest(t *testing.T) {
+	subsystemReq, err := ParseSubsystemReq([]byte{
+		0x0, 0x0, 0x0, 0x4, 0x73, // Whoops missing bytes
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, subsystemReq)
+}
+
+func TestParseDirectTCPIP_HandlesValidDirectTCPIP(t *testing.T) {
+	directTCPIP, err := ParseDirectTCPIP([]byte{
+		0x0, 0x0, 0x0, 0x9, 0x6c, 0x6f, 0x63, 0x61, 0x6c, 0x68, 0x6f, 0x73, 0x74, // host
+		0x0, 0x0, 0x1f, 0x90, // port
+		0x0, 0x0, 0x0, 0x7, 0x31, 0x2e, 0x32, 0x2e, 0x33, 0x2e, 0x34, // originator ip
+		0x0, 0x0, 0xd4, 0x31, // originator port
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, *directTCPIP, DirectTCPIP{"localhost", 8080, "1.2.3.4", 54321})
+}
+
+func TestParseDirectTCPIP_HandlesInValidDirectTCPIP(t *testing.T) {
+	directTCPIP, err := ParseDirectTCPIP([]byte{
+		0x0, 0x0, 0x0, 0x9, 0x6c, 0x6f, 0x63, 0x61, 0x6c, 0x68, 0x6f, 0x73, 0x74, // host
+		0x0, 0x0, 0x1f, 0x90, // port
+		0x0, 0x0, 0x0, 0x7, 0x31, // Whoops missing bytes
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, directTCPIP)
+}
+
+func TestParseTCPIPForward_HandlesValidTCPIPForward(t *testing.T) {
+	tcpipForward, err := ParseTCPIPForward([]byte{
+		0x0, 0x0, 0x0, 0x9, 0x6c, 0x6f, 0x63, 0x61, 0x6c, 0x68, 0x6f, 0x73, 0x74, // address
+		0x0, 0x0, 0x1f, 0x90, // port
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, *tcpipForward, TCPIPForward{"localhost", 8080})
+}
+
+func TestParseTCPIPForward_HandlesInValidTCPIPForward(t *testing.T) {
+	tcpipForward, err := ParseTCPIPForward([]byte{
+		0x0, 0x0, 0x0, 0x9, 0x6c, 0x6f, 0x63, 0x61, 0x6c, 0x68, 0x6f, 0x73, 0x74, // address
+		0x0, 0x0, 0x1f, // Whoops missing a byte
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, tcpipForward)
+}
+
+func TestParseDirectStreamLocal_HandlesValidDirectStreamLocal(t *testing.T) {
+	directStreamLocal, err := ParseDirectStreamLocal([]byte{
+		0x0, 0x0, 0x0, 0x6, 0x2f, 0x74, 0x6d, 0x70, 0x2f, 0x73, // socket path
+		0x0, 0x0, 0x0, 0x0, // reserved
+		0x0, 0x0, 0x0, 0x0, // reserved
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, *directStreamLocal, DirectStreamLocal{"/tmp/s"})
+}
+
+func TestParseDirectStreamLocal_HandlesInValidDirectStreamLocal(t *testing.T) {
+	directStreamLocal, err := ParseDirectStreamLocal([]byte{
+		0x0, 0x0, 0x0, 0x6, 0x2f, 0x74, 0x6d, 0x70, 0x2f, 0x73, // socket path
+		0x0, 0x0, 0x0, 0x0, // reserved
+		0x0, 0x0, // Whoops missing bytes
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, directStreamLocal)
+}
+
+func TestParseStreamLocalForward_HandlesValidStreamLocalForward(t *testing.T) {
+	streamLocalForward, err := ParseStreamLocalForward([]byte{
+		0x0, 0x0, 0x0, 0x6, 0x2f, 0x74, 0x6d, 0x70, 0x2f, 0x73, // socket path
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, *streamLocalForward, StreamLocalForward{"/tmp/s"})
+}
+
+func TestParseStreamLocalForward_HandlesInValidStreamLocalForward(t *testing.T) {
+	streamLocalForward, err := ParseStreamLocalForward([]byte{
+		0x0, 0x0, 0x0, 0x6, 0x2f, 0x74, // Whoops missing bytes
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, streamLocalForward)
+}
+
+func TestParseX11Req_HandlesValidX11Request(t *testing.T) {
+	x11Req, err := ParseX11Req([]byte{
+		0x1,                                  // single connection
+		0x0, 0x0, 0x0, 0x3, 0x4d, 0x49, 0x54, // auth protocol
+		0x0, 0x0, 0x0, 0x2, 0x30, 0x61, // auth cookie
+		0x0, 0x0, 0x0, 0x2, // screen number
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, *x11Req, X11Req{true, "MIT", "0a", 2})
+}
+
+func TestParseX11Req_HandlesInValidX11Request(t *testing.T) {
+	x11Req, err := ParseX11Req([]byte{
+		0x1,                                  // single connection
+		0x0, 0x0, 0x0, 0x3, 0x4d, 0x49, 0x54, // auth protocol
+		0x0, 0x0, 0x0, 0x2, 0x30, // Whoops missing bytes
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, x11Req)
+}
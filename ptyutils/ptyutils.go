@@ -2,8 +2,13 @@ package ptyutils
 
 import (
 	"os"
+	"os/exec"
 	"syscall"
 	"unsafe"
+
+	"github.com/kr/pty"
+
+	"golang.org/x/term"
 )
 
 type winsize struct {
@@ -15,7 +20,17 @@ type winsize struct {
 
 // SetWindowSize set's the PTY's window size
 func SetWindowSize(file *os.File, width, height int) error {
-	ws := &winsize{row: uint16(height), col: uint16(width)}
+	return SetWindowGeometry(file, width, height, 0, 0)
+}
+
+// SetWindowGeometry set's the PTY's window size including the size in pixels
+func SetWindowGeometry(file *os.File, width, height, widthPixels, heightPixels int) error {
+	ws := &winsize{
+		row:    uint16(height),
+		col:    uint16(width),
+		xpixel: uint16(widthPixels),
+		ypixel: uint16(heightPixels),
+	}
 	_, _, err := syscall.Syscall(
 		syscall.SYS_IOCTL,
 		file.Fd(),
@@ -27,3 +42,60 @@ func SetWindowSize(file *os.File, width, height int) error {
 	}
 	return nil
 }
+
+// GetWindowSize returns the terminal's window size
+func GetWindowSize(file *os.File) (width, height int, err error) {
+	ws := &winsize{}
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		file.Fd(),
+		uintptr(syscall.TIOCGWINSZ),
+		uintptr(unsafe.Pointer(ws)),
+	)
+	if errno != 0 {
+		return 0, 0, errno
+	}
+	return int(ws.col), int(ws.row), nil
+}
+
+// MakeRaw puts the terminal in raw mode so keys are read as they're pressed
+// and aren't echoed. The returned function restores the terminal's mode.
+func MakeRaw(file *os.File) (func(), error) {
+	fd := int(file.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+	return func() { _ = term.Restore(fd, state) }, nil
+}
+
+// StartWithSize is like pty.Start except the PTY's window size is set before
+// the command is started so the command never sees the default size
+func StartWithSize(cmd *exec.Cmd, width, height, widthPixels, heightPixels int) (*os.File, error) {
+	ptyFile, tty, err := pty.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tty.Close() }()
+
+	err = SetWindowGeometry(ptyFile, width, height, widthPixels, heightPixels)
+	if err != nil {
+		_ = ptyFile.Close()
+		return nil, err
+	}
+
+	cmd.Stdin = tty
+	cmd.Stdout = tty
+	cmd.Stderr = tty
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Setsid = true
+	err = cmd.Start()
+	if err != nil {
+		_ = ptyFile.Close()
+		return nil, err
+	}
+	return ptyFile, nil
+}
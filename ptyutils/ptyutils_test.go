@@ -3,10 +3,14 @@ package ptyutils
 import (
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"syscall"
 	"testing"
+	"unsafe"
 
 	"github.com/kr/pty"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
 )
 
 func TestSetWindowSize_FailsWithANonPty(t *testing.T) {
@@ -34,3 +38,90 @@ func TestSetWindowSize_WorksWithPty(t *testing.T) {
 	assert.Equal(t, width, cols)
 	assert.Equal(t, height, rows)
 }
+
+func TestSetWindowGeometry_WorksWithPty(t *testing.T) {
+	_pty, tty, err := pty.Open()
+	assert.NoError(t, err)
+	defer func() { _ = _pty.Close() }()
+	defer func() { _ = tty.Close() }()
+
+	err = SetWindowGeometry(_pty, 80, 24, 640, 480)
+	assert.NoError(t, err)
+
+	ws := &winsize{}
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		_pty.Fd(),
+		uintptr(syscall.TIOCGWINSZ),
+		uintptr(unsafe.Pointer(ws)),
+	)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, winsize{row: 24, col: 80, xpixel: 640, ypixel: 480}, *ws)
+}
+
+func TestStartWithSize_FailsWithInvalidCommand(t *testing.T) {
+	ptyFile, err := StartWithSize(exec.Command("/"), 80, 24, 0, 0)
+	assert.Nil(t, ptyFile)
+	assert.Error(t, err)
+}
+
+func TestStartWithSize_CommandSeesSize(t *testing.T) {
+	ptyFile, err := StartWithSize(exec.Command("stty", "size"), 80, 24, 0, 0)
+	assert.NoError(t, err)
+	defer func() { _ = ptyFile.Close() }()
+
+	output, _ := ioutil.ReadAll(ptyFile)
+	assert.Equal(t, "24 80\r\n", string(output))
+}
+
+func TestGetWindowSize_FailsWithANonPty(t *testing.T) {
+	file, err := ioutil.TempFile("", "GetWindowSize")
+	assert.NoError(t, err)
+	defer func() { _ = os.Remove(file.Name()) }()
+
+	_, _, err = GetWindowSize(file)
+	assert.Error(t, err)
+}
+
+func TestGetWindowSize_WorksWithPty(t *testing.T) {
+	_pty, tty, err := pty.Open()
+	assert.NoError(t, err)
+	defer func() { _ = _pty.Close() }()
+	defer func() { _ = tty.Close() }()
+	assert.NoError(t, SetWindowSize(_pty, 100, 50))
+
+	width, height, err := GetWindowSize(tty)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 100, width)
+	assert.Equal(t, 50, height)
+}
+
+func TestMakeRaw_FailsWithANonTerminal(t *testing.T) {
+	file, err := ioutil.TempFile("", "MakeRaw")
+	assert.NoError(t, err)
+	defer func() { _ = os.Remove(file.Name()) }()
+
+	_, err = MakeRaw(file)
+	assert.Error(t, err)
+}
+
+func TestMakeRaw_RestoresTheTerminal(t *testing.T) {
+	_pty, tty, err := pty.Open()
+	assert.NoError(t, err)
+	defer func() { _ = _pty.Close() }()
+	defer func() { _ = tty.Close() }()
+	before, err := unix.IoctlGetTermios(int(tty.Fd()), unix.TCGETS)
+	assert.NoError(t, err)
+
+	restore, err := MakeRaw(tty)
+	assert.NoError(t, err)
+	raw, err := unix.IoctlGetTermios(int(tty.Fd()), unix.TCGETS)
+	assert.NoError(t, err)
+	assert.Zero(t, raw.Lflag&unix.ECHO)
+
+	restore()
+	after, err := unix.IoctlGetTermios(int(tty.Fd()), unix.TCGETS)
+	assert.NoError(t, err)
+	assert.Equal(t, before.Lflag, after.Lflag)
+}
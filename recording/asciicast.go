@@ -0,0 +1,204 @@
+// Package recording records terminal sessions in the asciicast v2 format
+// used by asciinema (See https://docs.asciinema.org/manual/asciicast/v2/).
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The asciicast event types
+const (
+	OutputEvent = "o"
+	InputEvent  = "i"
+	ResizeEvent = "r"
+)
+
+// Extension is the file extension of recordings
+const Extension = ".cast"
+
+// A Header is the first line of a recording
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// A Recorder writes a terminal session's events as they happen
+type Recorder struct {
+	mutex  sync.Mutex
+	writer *bufio.Writer
+	closer io.Closer
+	path   string
+	start  time.Time
+	now    func() time.Time
+	// Bytes of an incomplete UTF-8 character for each event type
+	partial map[string][]byte
+	err     error
+}
+
+// NewRecorder writes the header and returns a Recorder that writes events to
+// the writer
+func NewRecorder(writer io.Writer, header Header) (*Recorder, error) {
+	return newRecorder(writer, header, time.Now)
+}
+
+func newRecorder(writer io.Writer, header Header, now func() time.Time) (*Recorder, error) {
+	r := &Recorder{
+		writer:  bufio.NewWriter(writer),
+		start:   now(),
+		now:     now,
+		partial: map[string][]byte{},
+	}
+	if closer, ok := writer.(io.Closer); ok {
+		r.closer = closer
+	}
+
+	header.Version = 2
+	if header.Timestamp == 0 {
+		header.Timestamp = r.start.Unix()
+	}
+	line, err := json.Marshal(header)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to encode the recording header (%s)", err)
+	}
+	_, err = fmt.Fprintf(r.writer, "%s\n", line)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to write the recording header (%s)", err)
+	}
+	return r, r.writer.Flush()
+}
+
+// Create starts a recording in a new file in dir named after the session
+func Create(dir, sessionID string, header Header) (*Recorder, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create %s (%s)", dir, err)
+	}
+	filename := path.Join(dir, sessionID+Extension)
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create recording %s (%s)", filename, err)
+	}
+	r, err := NewRecorder(file, header)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	r.path = filename
+	return r, nil
+}
+
+// Path returns the file the recording is written to or "" if it wasn't
+// created with Create
+func (r *Recorder) Path() string {
+	return r.path
+}
+
+// event writes an event. The mutex must be held.
+func (r *Recorder) event(kind string, data string) {
+	if r.err != nil {
+		return
+	}
+	elapsed := r.now().Sub(r.start).Seconds()
+	line, err := json.Marshal([]interface{}{json.Number(fmt.Sprintf("%.6f", elapsed)), kind, data})
+	if err == nil {
+		_, err = fmt.Fprintf(r.writer, "%s\n", line)
+	}
+	if err == nil {
+		err = r.writer.Flush()
+	}
+	r.err = err
+}
+
+// text returns the complete UTF-8 characters in p. The start of a character
+// that's split across writes is kept until the rest of it is written.
+func (r *Recorder) text(kind string, p []byte) string {
+	data := append(r.partial[kind], p...)
+	end := len(data)
+	// A character is at most utf8.UTFMax bytes so only the end of the data
+	// can be incomplete
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	r.partial[kind] = append([]byte(nil), data[end:]...)
+	return string(data[:end])
+}
+
+// record writes the bytes as an event of the given kind
+func (r *Recorder) record(kind string, p []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if text := r.text(kind, p); text != "" {
+		r.event(kind, text)
+	}
+}
+
+// Resize records the terminal's new size
+func (r *Recorder) Resize(width, height int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.event(ResizeEvent, fmt.Sprintf("%dx%d", width, height))
+}
+
+// Output returns a writer that records what's written as output events.
+// Writes never fail so a broken recording doesn't break the session, the
+// error is returned by Close instead.
+func (r *Recorder) Output() io.Writer {
+	return eventWriter{r, OutputEvent}
+}
+
+// Input returns a writer that records what's written as input events
+func (r *Recorder) Input() io.Writer {
+	return eventWriter{r, InputEvent}
+}
+
+type eventWriter struct {
+	r    *Recorder
+	kind string
+}
+
+func (w eventWriter) Write(p []byte) (int, error) {
+	w.r.record(w.kind, p)
+	return len(p), nil
+}
+
+// Close finishes the recording. It returns the first error from writing the
+// recording.
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, kind := range []string{OutputEvent, InputEvent} {
+		// Whatever is left isn't valid UTF-8 and is recorded as is
+		if partial := r.partial[kind]; len(partial) != 0 {
+			r.partial[kind] = nil
+			r.event(kind, string(partial))
+		}
+	}
+	err := r.err
+	if r.closer != nil {
+		closeErr := r.closer.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write the recording (%s)", err)
+	}
+	return nil
+}
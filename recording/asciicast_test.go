@@ -0,0 +1,105 @@
+package recording
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// steppingClock returns a clock that advances by step each time it's read
+func steppingClock(start time.Time, step time.Duration) func() time.Time {
+	now := start.Add(-step)
+	return func() time.Time {
+		now = now.Add(step)
+		return now
+	}
+}
+
+func TestRecorder_WritesAsciicast(t *testing.T) {
+	var output bytes.Buffer
+	clock := steppingClock(time.Unix(1500000000, 0), 250*time.Millisecond)
+	r, err := newRecorder(&output, Header{Width: 80, Height: 24, Title: "alice", Env: map[string]string{"TERM": "xterm"}}, clock)
+	assert.NoError(t, err)
+
+	_, _ = r.Output().Write([]byte("$ "))
+	_, _ = r.Input().Write([]byte("ls\r"))
+	r.Resize(100, 50)
+	assert.NoError(t, r.Close())
+
+	assert.Equal(t, `{"version":2,"width":80,"height":24,"timestamp":1500000000,"title":"alice","env":{"TERM":"xterm"}}
+[0.250000,"o","$ "]
+[0.500000,"i","ls\r"]
+[0.750000,"r","100x50"]
+`, output.String())
+}
+
+func TestRecorder_KeepsSplitCharactersTogether(t *testing.T) {
+	var output bytes.Buffer
+	r, err := newRecorder(&output, Header{Width: 80, Height: 24}, steppingClock(time.Unix(0, 0), time.Second))
+	assert.NoError(t, err)
+
+	snowman := []byte("☃")
+	_, _ = r.Output().Write(append([]byte("a"), snowman[:1]...))
+	_, _ = r.Output().Write(snowman[1:2])
+	_, _ = r.Output().Write(append(snowman[2:], 'b'))
+	// An incomplete character at the end is recorded when it's closed
+	_, _ = r.Output().Write(snowman[:2])
+	assert.NoError(t, r.Close())
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	assert.Equal(t, []string{
+		`[1.000000,"o","a"]`,
+		`[2.000000,"o","☃b"]`,
+		`[3.000000,"o","��"]`,
+	}, lines[1:])
+}
+
+func TestCreate_WritesRecordingToDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recordings")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	recordings := path.Join(dir, "recordings")
+
+	r, err := Create(recordings, "session", Header{Width: 80, Height: 24})
+	assert.NoError(t, err)
+	_, _ = r.Output().Write([]byte("hi"))
+	assert.NoError(t, r.Close())
+
+	assert.Equal(t, path.Join(recordings, "session.cast"), r.Path())
+	info, err := os.Stat(r.Path())
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	data, err := ioutil.ReadFile(r.Path())
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"o","hi"]`)
+
+	// Recordings are never overwritten
+	_, err = Create(recordings, "session", Header{Width: 80, Height: 24})
+	assert.Error(t, err)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	if bytes.HasPrefix(p, []byte("{")) {
+		return len(p), nil
+	}
+	return 0, os.ErrClosed
+}
+
+func TestRecorder_CloseReturnsWriteErrors(t *testing.T) {
+	r, err := NewRecorder(failingWriter{}, Header{Width: 80, Height: 24})
+	assert.NoError(t, err)
+
+	n, err := r.Output().Write([]byte("hi"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	assert.Error(t, r.Close())
+}
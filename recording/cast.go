@@ -0,0 +1,93 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// An Event is something that happened during a recording
+type Event struct {
+	// When the event happened relative to the start of the recording
+	Time time.Duration
+	Type string
+	Data string
+}
+
+// A Cast is a recording that has been read back
+type Cast struct {
+	Header Header
+	Events []Event
+}
+
+// Duration returns how long the recording is
+func (c *Cast) Duration() time.Duration {
+	if len(c.Events) == 0 {
+		return 0
+	}
+	return c.Events[len(c.Events)-1].Time
+}
+
+// ReadCast reads an asciicast v2 recording
+func ReadCast(reader io.Reader) (*Cast, error) {
+	scanner := bufio.NewScanner(reader)
+	// Output events can be as large as the PTY's reads
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	if !scanner.Scan() {
+		if scanner.Err() != nil {
+			return nil, fmt.Errorf("Unable to read the recording (%s)", scanner.Err())
+		}
+		return nil, fmt.Errorf("Unable to read the recording (it's empty)")
+	}
+	cast := &Cast{}
+	err := json.Unmarshal(scanner.Bytes(), &cast.Header)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse the recording header (%s)", err)
+	}
+	if cast.Header.Version != 2 {
+		return nil, fmt.Errorf("Unable to read asciicast version %d recordings", cast.Header.Version)
+	}
+
+	for line := 2; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var fields []json.RawMessage
+		err := json.Unmarshal(scanner.Bytes(), &fields)
+		if err != nil || len(fields) != 3 {
+			return nil, fmt.Errorf("Unable to parse event on line %d of the recording", line)
+		}
+		var seconds float64
+		var event Event
+		err = json.Unmarshal(fields[0], &seconds)
+		if err == nil {
+			err = json.Unmarshal(fields[1], &event.Type)
+		}
+		if err == nil {
+			err = json.Unmarshal(fields[2], &event.Data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse event on line %d of the recording (%s)", line, err)
+		}
+		event.Time = time.Duration(seconds * float64(time.Second))
+		cast.Events = append(cast.Events, event)
+	}
+	if scanner.Err() != nil {
+		return nil, fmt.Errorf("Unable to read the recording (%s)", scanner.Err())
+	}
+	return cast, nil
+}
+
+// Open reads the recording in the file
+func Open(filename string) (*Cast, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %s (%s)", filename, err)
+	}
+	defer func() { _ = file.Close() }()
+	return ReadCast(file)
+}
@@ -0,0 +1,61 @@
+package recording
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadCast_ReadsWhatWasRecorded(t *testing.T) {
+	var output bytes.Buffer
+	clock := steppingClock(time.Unix(1500000000, 0), 1500*time.Millisecond)
+	r, err := newRecorder(&output, Header{Width: 80, Height: 24, Title: "alice"}, clock)
+	assert.NoError(t, err)
+	_, _ = r.Output().Write([]byte("$ \x1b[1mbold\x1b[0m"))
+	_, _ = r.Input().Write([]byte("ls\r"))
+	r.Resize(100, 50)
+	assert.NoError(t, r.Close())
+
+	cast, err := ReadCast(&output)
+
+	assert.NoError(t, err)
+	assert.Equal(t, Header{Version: 2, Width: 80, Height: 24, Timestamp: 1500000000, Title: "alice"}, cast.Header)
+	assert.Equal(t, []Event{
+		{Time: 1500 * time.Millisecond, Type: OutputEvent, Data: "$ \x1b[1mbold\x1b[0m"},
+		{Time: 3 * time.Second, Type: InputEvent, Data: "ls\r"},
+		{Time: 4500 * time.Millisecond, Type: ResizeEvent, Data: "100x50"},
+	}, cast.Events)
+	assert.Equal(t, 4500*time.Millisecond, cast.Duration())
+}
+
+func TestReadCast_SkipsBlankLines(t *testing.T) {
+	cast, err := ReadCast(strings.NewReader("{\"version\":2,\"width\":80,\"height\":24}\n\n[1,\"o\",\"hi\"]\n"))
+
+	assert.NoError(t, err)
+	assert.Len(t, cast.Events, 1)
+}
+
+func TestReadCast_RejectsInvalidRecordings(t *testing.T) {
+	recordings := map[string]string{
+		"empty":         "",
+		"bad header":    "not json\n",
+		"version 1":     "{\"version\":1,\"width\":80,\"height\":24}\n",
+		"bad event":     "{\"version\":2,\"width\":80,\"height\":24}\n[1,\"o\"]\n",
+		"bad time":      "{\"version\":2,\"width\":80,\"height\":24}\n[\"1\",\"o\",\"hi\"]\n",
+		"not an event":  "{\"version\":2,\"width\":80,\"height\":24}\n{}\n",
+		"bad data type": "{\"version\":2,\"width\":80,\"height\":24}\n[1,\"o\",1]\n",
+	}
+	for name, recording := range recordings {
+		_, err := ReadCast(strings.NewReader(recording))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestOpen_FailsForMissingFile(t *testing.T) {
+	_, err := Open("/does/not/exist.cast")
+
+	assert.Error(t, err)
+}
@@ -0,0 +1,248 @@
+package recording
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// A Control changes how a recording is played
+type Control int
+
+// The controls for playing a recording
+const (
+	TogglePause Control = iota
+	Faster
+	Slower
+	SeekForward
+	SeekBackward
+	Quit
+)
+
+// SeekStep is how far SeekForward and SeekBackward move through a recording
+const SeekStep = 5 * time.Second
+
+// The fastest and slowest a recording can be played
+const (
+	maxSpeed = 16
+	minSpeed = 1.0 / 16
+)
+
+// resetTerminal clears the screen and resets the terminal's modes so a
+// recording can be played again from the start
+const resetTerminal = "\x1bc"
+
+// The keys for each control. Arrow keys are handled separately.
+var controlKeys = map[byte]Control{
+	' ':  TogglePause,
+	'+':  Faster,
+	'=':  Faster,
+	'-':  Slower,
+	'.':  SeekForward,
+	'l':  SeekForward,
+	',':  SeekBackward,
+	'h':  SeekBackward,
+	'q':  Quit,
+	0x03: Quit, // Ctrl-C
+}
+
+// ControlKeys describes the keys ReadControls understands
+const ControlKeys = "space pauses, + and - change the speed, the arrow keys seek and q quits"
+
+// ReadControls sends the controls for the keys that are pressed until
+// reading the keys fails. The keys must be read from a terminal in raw mode.
+func ReadControls(keys io.Reader, controls chan<- Control) {
+	buffer := make([]byte, 64)
+	for {
+		n, err := keys.Read(buffer)
+		pressed := buffer[:n]
+		for len(pressed) != 0 {
+			switch {
+			case bytes.HasPrefix(pressed, []byte("\x1b[C")):
+				controls <- SeekForward
+				pressed = pressed[3:]
+			case bytes.HasPrefix(pressed, []byte("\x1b[D")):
+				controls <- SeekBackward
+				pressed = pressed[3:]
+			default:
+				if control, ok := controlKeys[pressed[0]]; ok {
+					controls <- control
+				}
+				pressed = pressed[1:]
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// A Player plays a recording's output in real time. Pauses longer than the
+// idle limit are shortened to the idle limit.
+type Player struct {
+	// The output events with the idle time removed
+	events   []Event
+	output   io.Writer
+	speed    float64
+	paused   bool
+	position int
+	// How far into the recording playback has reached
+	clock time.Duration
+	now   func() time.Time
+	err   error
+}
+
+// NewPlayer creates a Player that writes the recording's output. Zero or a
+// negative idleLimit keeps the pauses as they were recorded.
+func NewPlayer(cast *Cast, output io.Writer, speed float64, idleLimit time.Duration) *Player {
+	p := &Player{
+		output: output,
+		speed:  clampSpeed(speed),
+		now:    time.Now,
+	}
+	var last, shortened time.Duration
+	for _, event := range cast.Events {
+		if event.Type != OutputEvent {
+			continue
+		}
+		idle := event.Time - last
+		if idleLimit > 0 && idle > idleLimit {
+			shortened += idle - idleLimit
+		}
+		last = event.Time
+		event.Time -= shortened
+		p.events = append(p.events, event)
+	}
+	return p
+}
+
+func clampSpeed(speed float64) float64 {
+	if speed > maxSpeed {
+		return maxSpeed
+	}
+	if speed < minSpeed {
+		return minSpeed
+	}
+	return speed
+}
+
+// Duration returns how long the recording takes to play at normal speed
+func (p *Player) Duration() time.Duration {
+	if len(p.events) == 0 {
+		return 0
+	}
+	return p.events[len(p.events)-1].Time
+}
+
+// write writes the events' output
+func (p *Player) write(events []Event) {
+	if p.err != nil || len(events) == 0 {
+		return
+	}
+	var output bytes.Buffer
+	for _, event := range events {
+		output.WriteString(event.Data)
+	}
+	_, p.err = p.output.Write(output.Bytes())
+}
+
+// status shows the playback's state in the terminal's title
+func (p *Player) status() {
+	if p.err != nil {
+		return
+	}
+	state := "playing"
+	if p.paused {
+		state = "paused"
+	}
+	_, p.err = fmt.Fprintf(p.output, "\x1b]2;gmash replay %s %gx %s/%s\x07", state, p.speed, formatTime(p.clock), formatTime(p.Duration()))
+}
+
+// formatTime formats the time as minutes and seconds
+func formatTime(t time.Duration) string {
+	seconds := int(t / time.Second)
+	return fmt.Sprintf("%02d:%02d", seconds/60, seconds%60)
+}
+
+// seek moves playback to the time. The screen is redrawn from the start of
+// the recording when seeking backwards.
+func (p *Player) seek(to time.Duration) {
+	if to < 0 {
+		to = 0
+	}
+	if to > p.Duration() {
+		to = p.Duration()
+	}
+	if to < p.clock {
+		_, p.err = io.WriteString(p.output, resetTerminal)
+		p.position = 0
+	}
+	end := p.position
+	for end < len(p.events) && p.events[end].Time <= to {
+		end++
+	}
+	p.write(p.events[p.position:end])
+	p.position = end
+	p.clock = to
+}
+
+// control applies the control to the playback
+func (p *Player) control(control Control) {
+	switch control {
+	case TogglePause:
+		p.paused = !p.paused
+	case Faster:
+		p.speed = clampSpeed(p.speed * 2)
+	case Slower:
+		p.speed = clampSpeed(p.speed / 2)
+	case SeekForward:
+		p.seek(p.clock + SeekStep)
+	case SeekBackward:
+		p.seek(p.clock - SeekStep)
+	}
+	p.status()
+}
+
+// Play plays the recording until it ends or it's quit. Controls can be nil
+// if playback can't be controlled.
+func (p *Player) Play(controls <-chan Control) error {
+	p.status()
+	for p.position < len(p.events) && p.err == nil {
+		var timer *time.Timer
+		var expired <-chan time.Time
+		started := p.now()
+		if !p.paused {
+			wait := time.Duration(float64(p.events[p.position].Time-p.clock) / p.speed)
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+
+		select {
+		case <-expired:
+			p.clock = p.events[p.position].Time
+			p.write(p.events[p.position : p.position+1])
+			p.position++
+		case control, ok := <-controls:
+			if timer != nil {
+				timer.Stop()
+				// Catch up with the time that passed while waiting
+				p.clock += time.Duration(float64(p.now().Sub(started)) * p.speed)
+				if p.clock > p.events[p.position].Time {
+					p.clock = p.events[p.position].Time
+				}
+			}
+			if !ok {
+				// Nothing can unpause the playback anymore
+				controls = nil
+				p.paused = false
+				continue
+			}
+			if control == Quit {
+				return p.err
+			}
+			p.control(control)
+		}
+	}
+	return p.err
+}
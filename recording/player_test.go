@@ -0,0 +1,160 @@
+package recording
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// titles matches the status the player shows in the terminal's title
+var titles = regexp.MustCompile("\x1b]2;[^\x07]*\x07")
+
+func screen(output *bytes.Buffer) string {
+	return titles.ReplaceAllString(output.String(), "")
+}
+
+func newCast(events ...Event) *Cast {
+	return &Cast{Header: Header{Version: 2, Width: 80, Height: 24}, Events: events}
+}
+
+func TestNewPlayer_ShortensIdleTime(t *testing.T) {
+	cast := newCast(
+		Event{Time: 500 * time.Millisecond, Type: OutputEvent, Data: "a"},
+		Event{Time: 4 * time.Second, Type: InputEvent, Data: "x"},
+		Event{Time: 5 * time.Second, Type: OutputEvent, Data: "b"},
+		Event{Time: 5500 * time.Millisecond, Type: OutputEvent, Data: "c"},
+	)
+
+	player := NewPlayer(cast, &bytes.Buffer{}, 1, time.Second)
+	assert.Equal(t, []Event{
+		{Time: 500 * time.Millisecond, Type: OutputEvent, Data: "a"},
+		{Time: 1500 * time.Millisecond, Type: OutputEvent, Data: "b"},
+		{Time: 2 * time.Second, Type: OutputEvent, Data: "c"},
+	}, player.events)
+	assert.Equal(t, 2*time.Second, player.Duration())
+
+	assert.Equal(t, 5500*time.Millisecond, NewPlayer(cast, &bytes.Buffer{}, 1, 0).Duration())
+}
+
+func TestPlayer_PlaysOutput(t *testing.T) {
+	output := &bytes.Buffer{}
+	player := NewPlayer(newCast(
+		Event{Time: time.Millisecond, Type: OutputEvent, Data: "hello "},
+		Event{Time: 2 * time.Millisecond, Type: InputEvent, Data: "typed"},
+		Event{Time: 3 * time.Millisecond, Type: OutputEvent, Data: "world"},
+	), output, 1, 0)
+
+	assert.NoError(t, player.Play(nil))
+
+	assert.Equal(t, "hello world", screen(output))
+	assert.Contains(t, output.String(), "gmash replay playing 1x 00:00/00:00")
+}
+
+func TestPlayer_Quits(t *testing.T) {
+	output := &bytes.Buffer{}
+	player := NewPlayer(newCast(Event{Time: time.Hour, Type: OutputEvent, Data: "never"}), output, 1, 0)
+	controls := make(chan Control, 1)
+	controls <- Quit
+
+	assert.NoError(t, player.Play(controls))
+
+	assert.Empty(t, screen(output))
+}
+
+func TestPlayer_KeepsPlayingWhenControlsClose(t *testing.T) {
+	output := &bytes.Buffer{}
+	player := NewPlayer(newCast(Event{Time: 10 * time.Millisecond, Type: OutputEvent, Data: "done"}), output, 1, 0)
+	controls := make(chan Control, 1)
+	controls <- TogglePause
+	close(controls)
+
+	assert.NoError(t, player.Play(controls))
+
+	assert.Equal(t, "done", screen(output))
+}
+
+func TestPlayer_Seeks(t *testing.T) {
+	output := &bytes.Buffer{}
+	player := NewPlayer(newCast(
+		Event{Time: 1 * time.Second, Type: OutputEvent, Data: "a"},
+		Event{Time: 4 * time.Second, Type: OutputEvent, Data: "b"},
+		Event{Time: 7 * time.Second, Type: OutputEvent, Data: "c"},
+		Event{Time: 11 * time.Second, Type: OutputEvent, Data: "d"},
+	), output, 1, 0)
+
+	player.control(SeekForward)
+	assert.Equal(t, "ab", screen(output))
+	assert.Equal(t, 5*time.Second, player.clock)
+	assert.Contains(t, output.String(), "00:05/00:11")
+
+	player.control(SeekForward)
+	assert.Equal(t, "abc", screen(output))
+
+	// Seeking backwards redraws the screen from the start
+	player.control(SeekBackward)
+	assert.Equal(t, "abc"+resetTerminal+"ab", screen(output))
+	assert.Equal(t, 2, player.position)
+
+	player.control(SeekBackward)
+	player.control(SeekBackward)
+	assert.Equal(t, time.Duration(0), player.clock)
+	assert.True(t, strings.HasSuffix(screen(output), resetTerminal))
+
+	player.seek(time.Hour)
+	assert.Equal(t, 11*time.Second, player.clock)
+	assert.True(t, strings.HasSuffix(screen(output), "abcd"))
+}
+
+func TestPlayer_ChangesSpeedAndPauses(t *testing.T) {
+	output := &bytes.Buffer{}
+	player := NewPlayer(newCast(Event{Time: time.Second, Type: OutputEvent, Data: "a"}), output, 1, 0)
+
+	player.control(Faster)
+	assert.Equal(t, 2.0, player.speed)
+	for i := 0; i < 10; i++ {
+		player.control(Faster)
+	}
+	assert.Equal(t, float64(maxSpeed), player.speed)
+	for i := 0; i < 20; i++ {
+		player.control(Slower)
+	}
+	assert.Equal(t, minSpeed, player.speed)
+
+	player.control(TogglePause)
+	assert.True(t, player.paused)
+	assert.Contains(t, output.String(), "gmash replay paused")
+	player.control(TogglePause)
+	assert.False(t, player.paused)
+}
+
+func TestReadControls_MapsKeys(t *testing.T) {
+	controls := make(chan Control, 16)
+	ReadControls(strings.NewReader(" +=-.,\x1b[C\x1b[Dxq\x03"), controls)
+	close(controls)
+
+	var read []Control
+	for control := range controls {
+		read = append(read, control)
+	}
+	assert.Equal(t, []Control{TogglePause, Faster, Faster, Slower, SeekForward, SeekBackward, SeekForward, SeekBackward, Quit, Quit}, read)
+}
+
+func TestReadControls_StopsWhenReadingFails(t *testing.T) {
+	reader, writer := io.Pipe()
+	controls := make(chan Control, 1)
+	done := make(chan struct{})
+	go func() {
+		ReadControls(reader, controls)
+		close(done)
+	}()
+
+	_, _ = writer.Write([]byte("q"))
+	assert.Equal(t, Quit, <-controls)
+	_ = writer.Close()
+	<-done
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/efarrer/gmash/console"
+	"github.com/efarrer/gmash/ptyutils"
+	"github.com/efarrer/gmash/recording"
+)
+
+// replay plays a recorded session in the terminal
+func replay(args []string) {
+	console := console.New(os.Stdout)
+	logger := log.New(os.Stderr, "", 0)
+
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	var speed = flags.Float64("speed", 1, "How many times faster than real time to play the recording")
+	var idleLimit = flags.Duration("idle-limit", 2*time.Second, "The longest pause to play (0 keeps the recorded pauses)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: gmash replay [options] <recording.cast>\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cast, err := recording.Open(flags.Arg(0))
+	if err != nil {
+		logger.Fatalf("%s\n", err)
+	}
+	player := recording.NewPlayer(cast, os.Stdout, *speed, *idleLimit)
+
+	console.Printf("Replaying %s", flags.Arg(0))
+	if cast.Header.Title != "" {
+		console.Printf(" of %s", cast.Header.Title)
+	}
+	if cast.Header.Timestamp != 0 {
+		console.Printf(" from %s", time.Unix(cast.Header.Timestamp, 0).Format(time.RFC1123))
+	}
+	console.Printf(" (%s)\n", player.Duration().Truncate(time.Second))
+	width, height, err := ptyutils.GetWindowSize(os.Stdout)
+	if err == nil && width != 0 && (width < cast.Header.Width || height < cast.Header.Height) {
+		console.Warn().Printf("The recording is %dx%d but the terminal is only %dx%d\n", cast.Header.Width, cast.Header.Height, width, height)
+	}
+
+	// Keys control the playback when gmash is run from a terminal
+	var controls chan recording.Control
+	restore := func() {}
+	if raw, err := ptyutils.MakeRaw(os.Stdin); err == nil {
+		console.Notify().Printf("%s\n", recording.ControlKeys)
+		restore = raw
+		controls = make(chan recording.Control)
+		go recording.ReadControls(os.Stdin, controls)
+	}
+
+	err = player.Play(controls)
+	restore()
+	if err != nil {
+		logger.Fatalf("\nUnable to replay %s (%s)\n", flags.Arg(0), err)
+	}
+	console.Printf("\nFinished replaying %s\n", flags.Arg(0))
+}
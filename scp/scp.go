@@ -0,0 +1,240 @@
+// Package scp implements the remote side of the legacy scp protocol. An scp
+// client runs "scp -t <target>" to copy files to the remote host (sink mode)
+// or "scp -f <paths>" to copy files from the remote host (source mode) and
+// then exchanges control messages and file data over the command's stdin and
+// stdout.
+package scp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A Command is a parsed scp server command line
+type Command struct {
+	// Sink is set by -t, the client is sending files to Paths[0]
+	Sink bool
+	// Source is set by -f, the client is requesting Paths
+	Source bool
+	// Recursive is set by -r, directories may be copied
+	Recursive bool
+	// TargetIsDir is set by -d, the sink target must be a directory
+	TargetIsDir bool
+	// PreserveTimes is set by -p, modification and access times are copied
+	PreserveTimes bool
+	Paths         []string
+}
+
+// A Resolver maps a path requested by the client to a local path. It returns
+// an error if the client isn't allowed to access the path.
+type Resolver func(path string) (string, error)
+
+// ParseCommand parses the command line of an exec request. It returns false
+// if the command isn't an scp server command.
+func ParseCommand(command string) (*Command, bool) {
+	words, err := splitWords(command)
+	if err != nil || len(words) == 0 || filepath.Base(words[0]) != "scp" {
+		return nil, false
+	}
+
+	cmd := &Command{}
+	args := words[1:]
+	for len(args) > 0 {
+		arg := args[0]
+		if arg == "--" {
+			args = args[1:]
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			break
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 't':
+				cmd.Sink = true
+			case 'f':
+				cmd.Source = true
+			case 'r':
+				cmd.Recursive = true
+			case 'd':
+				cmd.TargetIsDir = true
+			case 'p':
+				cmd.PreserveTimes = true
+			case 'v', 'q':
+				// Verbosity only affects the client
+			default:
+				return nil, false
+			}
+		}
+		args = args[1:]
+	}
+	cmd.Paths = args
+
+	if cmd.Sink == cmd.Source || len(cmd.Paths) == 0 {
+		return nil, false
+	}
+	if cmd.Sink && len(cmd.Paths) != 1 {
+		return nil, false
+	}
+	return cmd, true
+}
+
+// IsCommand returns true if the command line runs scp, even if it isn't a
+// server command ParseCommand understands
+func IsCommand(command string) bool {
+	words, err := splitWords(command)
+	if err != nil {
+		words = strings.Fields(command)
+	}
+	return len(words) > 0 && filepath.Base(words[0]) == "scp"
+}
+
+// Serve runs the scp protocol for the command over rw. Paths from the client
+// are mapped to local paths with resolve. Problems with individual files are
+// reported to the client and the transfer continues, in that case Serve
+// returns an error once the transfer is finished.
+func Serve(cmd *Command, rw io.ReadWriter, resolve Resolver) error {
+	c := &conn{r: bufio.NewReader(rw), w: rw}
+	if cmd.Sink {
+		return (&sink{conn: c, cmd: cmd, resolve: resolve}).run()
+	}
+	return (&source{conn: c, cmd: cmd, resolve: resolve}).run()
+}
+
+// Control message status bytes
+const (
+	statusOK      = 0
+	statusWarning = 1
+	statusFatal   = 2
+)
+
+// errTransfer is returned by Serve if any file couldn't be transferred
+var errTransfer = errors.New("Some files couldn't be transferred")
+
+// A remoteError is an error reported by the client
+type remoteError struct {
+	message string
+	fatal   bool
+}
+
+func (e *remoteError) Error() string {
+	return fmt.Sprintf("Client reported error (%s)", e.message)
+}
+
+// conn reads and writes scp control messages
+type conn struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+func (c *conn) ack() error {
+	_, err := c.w.Write([]byte{statusOK})
+	return err
+}
+
+// warn reports a non-fatal error to the client
+func (c *conn) warn(err error) error {
+	_, werr := fmt.Fprintf(c.w, "\x01scp: %s\n", oneLine(err.Error()))
+	return werr
+}
+
+// fatal reports an error that ends the transfer to the client
+func (c *conn) fatal(err error) error {
+	_, _ = fmt.Fprintf(c.w, "\x02scp: %s\n", oneLine(err.Error()))
+	return err
+}
+
+// readAck reads the client's response to a message
+func (c *conn) readAck() error {
+	status, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch status {
+	case statusOK:
+		return nil
+	case statusWarning, statusFatal:
+		message, err := c.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		return &remoteError{message: strings.TrimSuffix(message, "\n"), fatal: status == statusFatal}
+	}
+	return fmt.Errorf("Unexpected response %q", status)
+}
+
+// fileError describes a problem with the client's path p. The local path
+// isn't included as it may reveal where the files are stored.
+func fileError(p string, err error) error {
+	if perr, ok := err.(*os.PathError); ok {
+		err = perr.Err
+	}
+	return fmt.Errorf("%s: %s", p, err)
+}
+
+// oneLine makes sure a message doesn't break the line based protocol
+func oneLine(message string) string {
+	return strings.ReplaceAll(message, "\n", " ")
+}
+
+// splitWords splits a command line into words following the quoting rules of
+// a POSIX shell
+func splitWords(command string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range command {
+		switch {
+		case escaped:
+			// Inside double quotes a backslash only escapes a few characters
+			if quote == '"' && !strings.ContainsRune("$`\"\\\n", r) {
+				word.WriteRune('\\')
+			}
+			word.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else if r == '\\' {
+				escaped = true
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+			inWord = true
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("Unterminated quote in %q", command)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
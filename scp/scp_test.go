@@ -0,0 +1,263 @@
+package scp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConn is the client side of a transfer. The client's messages are read
+// from input and the server's messages are written to output.
+type fakeConn struct {
+	input  io.Reader
+	output bytes.Buffer
+}
+
+func (c *fakeConn) Read(p []byte) (int, error) {
+	return c.input.Read(p)
+}
+
+func (c *fakeConn) Write(p []byte) (int, error) {
+	return c.output.Write(p)
+}
+
+func newFakeConn(input string) *fakeConn {
+	return &fakeConn{input: bytes.NewBufferString(input)}
+}
+
+func createTempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "scp")
+	assert.NoError(t, err)
+	return dir, func() { _ = os.RemoveAll(dir) }
+}
+
+var time1e9 = time.Unix(1000000000, 0)
+
+func identity(p string) (string, error) {
+	return p, nil
+}
+
+func TestParseCommand_ParsesSink(t *testing.T) {
+	cmd, ok := ParseCommand("scp -v -r -p -d -t -- '/tmp/a dir'")
+	assert.True(t, ok)
+	assert.Equal(t, &Command{
+		Sink:          true,
+		Recursive:     true,
+		PreserveTimes: true,
+		TargetIsDir:   true,
+		Paths:         []string{"/tmp/a dir"},
+	}, cmd)
+}
+
+func TestParseCommand_ParsesSource(t *testing.T) {
+	cmd, ok := ParseCommand("/usr/bin/scp -rf 'a file' b\\ c \"d\"")
+	assert.True(t, ok)
+	assert.Equal(t, &Command{
+		Source:    true,
+		Recursive: true,
+		Paths:     []string{"a file", "b c", "d"},
+	}, cmd)
+}
+
+func TestParseCommand_RejectsOtherCommands(t *testing.T) {
+	for _, command := range []string{
+		"",
+		"ls -l",
+		"scp file host:",
+		"scp -t",
+		"scp -t -f file",
+		"scp -x -t file",
+		"scp -t 'unterminated",
+	} {
+		cmd, ok := ParseCommand(command)
+		assert.False(t, ok, command)
+		assert.Nil(t, cmd, command)
+	}
+}
+
+func TestIsCommand_RecognizesSCP(t *testing.T) {
+	assert.True(t, IsCommand("scp -t ."))
+	assert.True(t, IsCommand("/usr/bin/scp -x file"))
+	assert.True(t, IsCommand("scp -t 'unterminated"))
+	assert.False(t, IsCommand(""))
+	assert.False(t, IsCommand("ls -l"))
+	assert.False(t, IsCommand("scpx -t ."))
+}
+
+func TestSplitWords_FollowsShellQuoting(t *testing.T) {
+	words, err := splitWords(`a  'b c' "d \"e\" \f" g\ h ''`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b c", `d "e" \f`, "g h", ""}, words)
+}
+
+func TestServe_SinkReceivesFiles(t *testing.T) {
+	dir, closer := createTempDir(t)
+	defer closer()
+
+	conn := newFakeConn("T1000000000 0 1000000000 0\nC0640 5 a.txt\nhello\x00C0600 0 b.txt\n\x00")
+	err := Serve(&Command{Sink: true, PreserveTimes: true, Paths: []string{dir}}, conn, identity)
+	assert.NoError(t, err)
+	assert.Equal(t, "\x00\x00\x00\x00\x00\x00", conn.output.String())
+
+	data, err := ioutil.ReadFile(path.Join(dir, "a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	info, err := os.Stat(path.Join(dir, "a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	assert.Equal(t, int64(1000000000), info.ModTime().Unix())
+
+	info, err = os.Stat(path.Join(dir, "b.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+}
+
+func TestServe_SinkRenamesSingleFile(t *testing.T) {
+	dir, closer := createTempDir(t)
+	defer closer()
+
+	target := path.Join(dir, "renamed.txt")
+	conn := newFakeConn("C0644 2 a.txt\nhi\x00")
+	err := Serve(&Command{Sink: true, Paths: []string{target}}, conn, identity)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(target)
+	assert.NoError(t, err)
+	assert.Equal(t, "hi", string(data))
+}
+
+func TestServe_SinkReceivesDirectories(t *testing.T) {
+	dir, closer := createTempDir(t)
+	defer closer()
+
+	conn := newFakeConn("D0755 0 sub\nC0644 2 a.txt\nhi\x00D0700 0 nested\nE\nE\n")
+	err := Serve(&Command{Sink: true, Recursive: true, Paths: []string{dir}}, conn, identity)
+	assert.NoError(t, err)
+	assert.Equal(t, "\x00\x00\x00\x00\x00\x00\x00", conn.output.String())
+
+	data, err := ioutil.ReadFile(path.Join(dir, "sub", "a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hi", string(data))
+	info, err := os.Stat(path.Join(dir, "sub", "nested"))
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+}
+
+func TestServe_SinkRejectsDirectoriesWithoutRecursive(t *testing.T) {
+	dir, closer := createTempDir(t)
+	defer closer()
+
+	conn := newFakeConn("D0755 0 sub\nE\n")
+	err := Serve(&Command{Sink: true, Paths: []string{dir}}, conn, identity)
+	assert.Error(t, err)
+	assert.Equal(t, "\x00\x02scp: Received a directory without -r\n", conn.output.String())
+}
+
+func TestServe_SinkRejectsNamesWithPaths(t *testing.T) {
+	dir, closer := createTempDir(t)
+	defer closer()
+
+	for _, name := range []string{"../evil", "..", "a/b"} {
+		conn := newFakeConn("C0644 2 " + name + "\nhi\x00")
+		err := Serve(&Command{Sink: true, Paths: []string{dir}}, conn, identity)
+		assert.Error(t, err)
+		assert.Contains(t, conn.output.String(), "\x02scp: Protocol error: invalid name")
+	}
+	_, err := os.Stat(path.Join(path.Dir(dir), "evil"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestServe_SinkRequiresDirectoryTarget(t *testing.T) {
+	dir, closer := createTempDir(t)
+	defer closer()
+
+	conn := newFakeConn("")
+	err := Serve(&Command{Sink: true, TargetIsDir: true, Paths: []string{path.Join(dir, "missing")}}, conn, identity)
+	assert.Error(t, err)
+	assert.Contains(t, conn.output.String(), "Not a directory")
+}
+
+func TestServe_SinkSkipsFilesItCantWrite(t *testing.T) {
+	dir, closer := createTempDir(t)
+	defer closer()
+	assert.NoError(t, os.Mkdir(path.Join(dir, "a.txt"), 0700))
+
+	// The client doesn't send the data of a declined file
+	conn := newFakeConn("C0644 2 a.txt\nC0644 2 b.txt\nhi\x00")
+	err := Serve(&Command{Sink: true, Paths: []string{"."}}, conn, func(p string) (string, error) {
+		return path.Join(dir, p), nil
+	})
+	assert.Equal(t, errTransfer, err)
+	assert.Equal(t, "\x00\x01scp: a.txt: is a directory\n\x00\x00", conn.output.String())
+
+	data, err := ioutil.ReadFile(path.Join(dir, "b.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hi", string(data))
+}
+
+func TestServe_SourceSendsFiles(t *testing.T) {
+	dir, closer := createTempDir(t)
+	defer closer()
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "a.txt"), []byte("hello"), 0640))
+	assert.NoError(t, os.Chtimes(path.Join(dir, "a.txt"), time1e9, time1e9))
+
+	conn := newFakeConn("\x00\x00\x00\x00")
+	err := Serve(&Command{Source: true, PreserveTimes: true, Paths: []string{path.Join(dir, "a.txt")}}, conn, identity)
+	assert.NoError(t, err)
+	assert.Equal(t, "T1000000000 0 1000000000 0\nC0640 5 a.txt\nhello\x00", conn.output.String())
+}
+
+func TestServe_SourceSendsDirectories(t *testing.T) {
+	dir, closer := createTempDir(t)
+	defer closer()
+	assert.NoError(t, os.Mkdir(path.Join(dir, "sub"), 0750))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sub", "a.txt"), []byte("hi"), 0600))
+
+	conn := newFakeConn("\x00\x00\x00\x00\x00")
+	err := Serve(&Command{Source: true, Recursive: true, Paths: []string{path.Join(dir, "sub")}}, conn, identity)
+	assert.NoError(t, err)
+	assert.Equal(t, "D0750 0 sub\nC0600 2 a.txt\nhi\x00E\n", conn.output.String())
+}
+
+func TestServe_SourceExpandsWildcards(t *testing.T) {
+	dir, closer := createTempDir(t)
+	defer closer()
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "a.txt"), []byte("a"), 0600))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "b.txt"), []byte("b"), 0600))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "c.log"), []byte("c"), 0600))
+
+	conn := newFakeConn("\x00\x00\x00\x00\x00")
+	err := Serve(&Command{Source: true, Paths: []string{path.Join(dir, "*.txt")}}, conn, identity)
+	assert.NoError(t, err)
+	assert.Equal(t, "C0600 1 a.txt\na\x00C0600 1 b.txt\nb\x00", conn.output.String())
+}
+
+func TestServe_SourceReportsMissingFiles(t *testing.T) {
+	dir, closer := createTempDir(t)
+	defer closer()
+	assert.NoError(t, os.Mkdir(path.Join(dir, "sub"), 0750))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "a.txt"), []byte("a"), 0600))
+
+	conn := newFakeConn("\x00\x00\x00")
+	err := Serve(&Command{Source: true, Paths: []string{"missing", "sub", "a.txt"}}, conn, func(p string) (string, error) {
+		return path.Join(dir, p), nil
+	})
+	assert.Equal(t, errTransfer, err)
+	assert.Equal(t, "\x01scp: missing: no such file or directory\n\x01scp: sub: not a regular file\nC0600 1 a.txt\na\x00", conn.output.String())
+}
+
+func TestServe_SourceStopsOnFatalClientError(t *testing.T) {
+	dir, closer := createTempDir(t)
+	defer closer()
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "a.txt"), []byte("a"), 0600))
+
+	conn := newFakeConn("\x00\x02disk full\n")
+	err := Serve(&Command{Source: true, Paths: []string{path.Join(dir, "a.txt")}}, conn, identity)
+	assert.EqualError(t, err, "Client reported error (disk full)")
+}
@@ -0,0 +1,276 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A sink receives files from the client (scp -t)
+type sink struct {
+	*conn
+	cmd     *Command
+	resolve Resolver
+	failed  bool
+}
+
+// fileTimes are the times sent with a T message
+type fileTimes struct {
+	mtime time.Time
+	atime time.Time
+}
+
+func (s *sink) run() error {
+	target := s.cmd.Paths[0]
+	local, err := s.resolve(target)
+	if err != nil {
+		return s.fatal(fileError(target, err))
+	}
+	info, err := os.Stat(local)
+	targetIsDir := err == nil && info.IsDir()
+	if s.cmd.TargetIsDir && !targetIsDir {
+		return s.fatal(fmt.Errorf("%s: Not a directory", target))
+	}
+
+	err = s.ack()
+	if err != nil {
+		return err
+	}
+	err = s.receive(target, targetIsDir, 0)
+	if err != nil {
+		return err
+	}
+	if s.failed {
+		return errTransfer
+	}
+	return nil
+}
+
+// destination returns the path of an entry sent by the client. Entries are
+// created in dir if it's a directory otherwise the entry replaces dir.
+func destination(dir string, isDir bool, name string) string {
+	if isDir {
+		return path.Join(dir, name)
+	}
+	return dir
+}
+
+// receive handles the messages for the entries of dir until the client ends
+// the directory, or for the top level until the client closes its input. All
+// paths are the client's paths, so every entry is resolved and can't escape
+// through a symbolic link.
+func (s *sink) receive(dir string, isDir bool, depth int) error {
+	var times *fileTimes
+	for {
+		line, err := s.r.ReadString('\n')
+		if err == io.EOF && line == "" && depth == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return s.fatal(errors.New("Protocol error: empty message"))
+		}
+
+		switch line[0] {
+		case 'T':
+			times, err = parseTimes(line[1:])
+			if err != nil {
+				return s.fatal(err)
+			}
+			err = s.ack()
+			if err != nil {
+				return err
+			}
+		case 'C':
+			mode, size, name, err := parseEntry(line[1:])
+			if err != nil {
+				return s.fatal(err)
+			}
+			err = s.receiveFile(destination(dir, isDir, name), mode, size, times)
+			if err != nil {
+				return err
+			}
+			times = nil
+		case 'D':
+			if !s.cmd.Recursive {
+				return s.fatal(errors.New("Received a directory without -r"))
+			}
+			mode, _, name, err := parseEntry(line[1:])
+			if err != nil {
+				return s.fatal(err)
+			}
+			err = s.receiveDir(destination(dir, isDir, name), mode, times, depth)
+			if err != nil {
+				return err
+			}
+			times = nil
+		case 'E':
+			if depth == 0 {
+				return s.fatal(errors.New("Protocol error: unexpected end of directory"))
+			}
+			return s.ack()
+		case statusWarning:
+			// The client couldn't send one of its files and has already
+			// reported it to the user
+		case statusFatal:
+			return &remoteError{message: line[1:], fatal: true}
+		default:
+			return s.fatal(fmt.Errorf("Protocol error: unexpected message %q", line))
+		}
+	}
+}
+
+func (s *sink) receiveFile(p string, mode os.FileMode, size int64, times *fileTimes) error {
+	local, err := s.resolve(p)
+	var file *os.File
+	if err == nil {
+		file, err = os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	}
+	if err != nil {
+		// The client skips the file data if the file is declined
+		s.failed = true
+		return s.warn(fileError(p, err))
+	}
+	defer file.Close()
+
+	err = s.ack()
+	if err != nil {
+		return err
+	}
+	// A failed write still has to consume the rest of the file data
+	writer := &errWriter{w: file}
+	_, err = io.CopyN(writer, s.r, size)
+	if err != nil {
+		return err
+	}
+	err = s.readAck()
+	if rerr, ok := err.(*remoteError); ok && !rerr.fatal {
+		// The client couldn't read the whole file
+		s.failed = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = writer.err
+	if err == nil && s.cmd.PreserveTimes {
+		err = file.Chmod(mode)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && times != nil {
+		err = os.Chtimes(local, times.atime, times.mtime)
+	}
+	if err != nil {
+		s.failed = true
+		return s.warn(fileError(p, err))
+	}
+	return s.ack()
+}
+
+func (s *sink) receiveDir(p string, mode os.FileMode, times *fileTimes, depth int) error {
+	local, err := s.resolve(p)
+	if err == nil {
+		err = makeDir(local, mode, s.cmd.PreserveTimes)
+	}
+	if err != nil {
+		return s.fatal(fileError(p, err))
+	}
+
+	err = s.ack()
+	if err != nil {
+		return err
+	}
+	err = s.receive(p, true, depth+1)
+	if err != nil {
+		return err
+	}
+	// The times are set last as adding the entries changes them
+	if times != nil {
+		err = os.Chtimes(local, times.atime, times.mtime)
+		if err != nil {
+			s.failed = true
+			return s.warn(fileError(p, err))
+		}
+	}
+	return nil
+}
+
+// makeDir creates the directory unless it already exists. The mode of an
+// existing directory is only changed if chmod is true.
+func makeDir(local string, mode os.FileMode, chmod bool) error {
+	info, err := os.Stat(local)
+	if err == nil {
+		if !info.IsDir() {
+			return errors.New("Not a directory")
+		}
+		if chmod {
+			return os.Chmod(local, mode)
+		}
+		return nil
+	}
+	// The directory must be writable to receive its entries
+	return os.Mkdir(local, mode|0700)
+}
+
+// parseEntry parses the "<mode> <size> <name>" of a C or D message
+func parseEntry(entry string) (os.FileMode, int64, string, error) {
+	fields := strings.SplitN(entry, " ", 3)
+	if len(fields) != 3 {
+		return 0, 0, "", fmt.Errorf("Protocol error: invalid entry %q", entry)
+	}
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil || mode&^0o7777 != 0 {
+		return 0, 0, "", fmt.Errorf("Protocol error: invalid mode %q", fields[0])
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("Protocol error: invalid size %q", fields[1])
+	}
+	// A client can't choose where an entry goes, only its name
+	name := fields[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, 0, "", fmt.Errorf("Protocol error: invalid name %q", name)
+	}
+	return os.FileMode(mode).Perm(), size, name, nil
+}
+
+// parseTimes parses the "<mtime> 0 <atime> 0" of a T message
+func parseTimes(times string) (*fileTimes, error) {
+	fields := strings.Fields(times)
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("Protocol error: invalid times %q", times)
+	}
+	mtime, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Protocol error: invalid mtime %q", fields[0])
+	}
+	atime, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Protocol error: invalid atime %q", fields[2])
+	}
+	return &fileTimes{mtime: time.Unix(mtime, 0), atime: time.Unix(atime, 0)}, nil
+}
+
+// errWriter records the first write error and discards everything after it
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *errWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.w.Write(p)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,235 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A source sends files to the client (scp -f)
+type source struct {
+	*conn
+	cmd     *Command
+	resolve Resolver
+	failed  bool
+}
+
+func (s *source) run() error {
+	// The client is ready once it acknowledges
+	err := s.readAck()
+	if err != nil {
+		return err
+	}
+	for _, p := range s.cmd.Paths {
+		err = s.sendPattern(p)
+		if err != nil {
+			return err
+		}
+	}
+	if s.failed {
+		return errTransfer
+	}
+	return nil
+}
+
+// sendPattern sends the files matching p. Without a remote shell to expand
+// them, wildcards are supported in the last path element.
+func (s *source) sendPattern(p string) error {
+	dir, pattern := path.Split(p)
+	if strings.ContainsAny(dir, "*?[") || !strings.ContainsAny(pattern, "*?[") {
+		return s.send(p)
+	}
+
+	local, err := s.resolve(dir)
+	if err != nil {
+		return s.skip(p, err)
+	}
+	matches, err := filepath.Glob(filepath.Join(local, pattern))
+	if err != nil {
+		return s.skip(p, err)
+	}
+	if len(matches) == 0 {
+		return s.skip(p, errors.New("No such file or directory"))
+	}
+	for _, match := range matches {
+		err = s.send(path.Join(dir, filepath.Base(match)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skip reports a file that can't be sent to the client
+func (s *source) skip(p string, err error) error {
+	s.failed = true
+	return s.warn(fileError(p, err))
+}
+
+// send sends the file or directory. All paths are the client's paths, so
+// every entry is resolved and can't escape through a symbolic link.
+func (s *source) send(p string) error {
+	local, err := s.resolve(p)
+	if err != nil {
+		return s.skip(p, err)
+	}
+	info, err := os.Stat(local)
+	if err != nil {
+		return s.skip(p, err)
+	}
+	if info.IsDir() {
+		if !s.cmd.Recursive {
+			return s.skip(p, errors.New("not a regular file"))
+		}
+		return s.sendDir(p, local, info)
+	}
+	if !info.Mode().IsRegular() {
+		return s.skip(p, errors.New("not a regular file"))
+	}
+	return s.sendFile(p, local, info)
+}
+
+// entryName returns the name the client gives to an entry
+func entryName(p, local string) string {
+	name := path.Base(p)
+	if name == "." || name == ".." || name == "/" || name == "~" {
+		return filepath.Base(local)
+	}
+	return name
+}
+
+// sendTimes sends the entry's times if they're being preserved
+func (s *source) sendTimes(info os.FileInfo) error {
+	if !s.cmd.PreserveTimes {
+		return nil
+	}
+	mtime := info.ModTime().Unix()
+	_, err := fmt.Fprintf(s.w, "T%d 0 %d 0\n", mtime, mtime)
+	if err != nil {
+		return err
+	}
+	return s.readAck()
+}
+
+// declined returns true if the client declined an entry and returns the
+// error if the transfer can't continue
+func declined(err error) (bool, error) {
+	if rerr, ok := err.(*remoteError); ok && !rerr.fatal {
+		return true, nil
+	}
+	return false, err
+}
+
+func (s *source) sendFile(p, local string, info os.FileInfo) error {
+	file, err := os.Open(local)
+	if err != nil {
+		return s.skip(p, err)
+	}
+	defer file.Close()
+
+	err = s.sendTimes(info)
+	if skipped, err := declined(err); skipped || err != nil {
+		return err
+	}
+	size := info.Size()
+	_, err = fmt.Fprintf(s.w, "C%04o %d %s\n", info.Mode().Perm(), size, entryName(p, local))
+	if err != nil {
+		return err
+	}
+	err = s.readAck()
+	if skipped, err := declined(err); skipped || err != nil {
+		return err
+	}
+
+	// The client expects exactly size bytes so a file that can't be read is
+	// padded and reported afterwards
+	reader := &errReader{r: file}
+	n, err := io.Copy(s.w, io.LimitReader(reader, size))
+	if err != nil {
+		return err
+	}
+	if n < size {
+		_, err = io.CopyN(s.w, zeroReader{}, size-n)
+		if err != nil {
+			return err
+		}
+		if reader.err == nil {
+			reader.err = io.ErrUnexpectedEOF
+		}
+	}
+	if reader.err != nil {
+		err = s.skip(p, reader.err)
+	} else {
+		err = s.ack()
+	}
+	if err != nil {
+		return err
+	}
+	_, err = declined(s.readAck())
+	return err
+}
+
+func (s *source) sendDir(p, local string, info os.FileInfo) error {
+	entries, err := os.ReadDir(local)
+	if err != nil {
+		return s.skip(p, err)
+	}
+
+	err = s.sendTimes(info)
+	if skipped, err := declined(err); skipped || err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.w, "D%04o 0 %s\n", info.Mode().Perm(), entryName(p, local))
+	if err != nil {
+		return err
+	}
+	err = s.readAck()
+	if skipped, err := declined(err); skipped || err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		err = s.send(path.Join(p, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprint(s.w, "E\n")
+	if err != nil {
+		return err
+	}
+	_, err = declined(s.readAck())
+	return err
+}
+
+// errReader records the first read error and then reports end-of-file
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, io.EOF
+	}
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+		err = io.EOF
+	}
+	return n, err
+}
+
+// zeroReader reads an endless stream of zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
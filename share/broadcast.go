@@ -0,0 +1,206 @@
+// Package share lets guests watch a terminal that's running on the host.
+// The host's shell runs in a PTY managed by gmash and its output is sent to
+// the host's own terminal and to every guest that's watching.
+package share
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// DefaultMaxPending is the default amount of output a viewer can fall behind
+// by before it's dropped
+const DefaultMaxPending = 1 << 20
+
+// ErrSlowViewer is returned to viewers that were dropped for falling too far
+// behind
+var ErrSlowViewer = errors.New("Fell too far behind the host's terminal")
+
+// A Broadcaster copies everything written to it to each of its viewers.
+// Writes never block. Each viewer is written to by its own goroutine so a
+// slow viewer only delays itself, and a viewer that falls too far behind is
+// dropped.
+type Broadcaster struct {
+	mutex      sync.Mutex
+	viewers    map[*Viewer]struct{}
+	maxPending int
+	closed     bool
+}
+
+// A Viewer receives the output of a Broadcaster
+type Viewer struct {
+	broadcaster *Broadcaster
+	writer      io.Writer
+	// pending is the output that hasn't been written yet. Guarded by the
+	// broadcaster's mutex.
+	pending      [][]byte
+	pendingBytes int
+	ready        chan struct{}
+	done         chan struct{}
+	err          error
+	removed      bool
+}
+
+// NewBroadcaster creates a Broadcaster that drops viewers once they're
+// maxPending bytes behind
+func NewBroadcaster(maxPending int) *Broadcaster {
+	return &Broadcaster{
+		viewers:    map[*Viewer]struct{}{},
+		maxPending: maxPending,
+	}
+}
+
+// Add starts sending output to the writer
+func (b *Broadcaster) Add(writer io.Writer) *Viewer {
+	v := &Viewer{
+		broadcaster: b,
+		writer:      writer,
+		ready:       make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		v.removed = true
+		close(v.done)
+		return v
+	}
+	b.viewers[v] = struct{}{}
+	go v.run()
+	return v
+}
+
+// Len returns the number of viewers
+func (b *Broadcaster) Len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.viewers)
+}
+
+// Write queues a copy of p for each viewer
+func (b *Broadcaster) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	chunk := make([]byte, len(p))
+	copy(chunk, p)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for v := range b.viewers {
+		if v.pendingBytes+len(chunk) > b.maxPending {
+			b.remove(v, ErrSlowViewer)
+			continue
+		}
+		v.pending = append(v.pending, chunk)
+		v.pendingBytes += len(chunk)
+		select {
+		case v.ready <- struct{}{}:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// Close removes all of the viewers once they've been sent the output that's
+// already been written
+func (b *Broadcaster) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	for v := range b.viewers {
+		delete(b.viewers, v)
+		select {
+		case v.ready <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// remove stops sending output to the viewer. The broadcaster's mutex must be
+// held.
+func (b *Broadcaster) remove(v *Viewer, err error) {
+	if v.removed {
+		return
+	}
+	delete(b.viewers, v)
+	v.removed = true
+	v.err = err
+	v.pending = nil
+	v.pendingBytes = 0
+	close(v.done)
+}
+
+// Remove stops sending output to the viewer
+func (v *Viewer) Remove() {
+	v.broadcaster.mutex.Lock()
+	defer v.broadcaster.mutex.Unlock()
+	v.broadcaster.remove(v, nil)
+}
+
+// Done is closed once the viewer has been removed or all of the output has
+// been sent after the broadcaster was closed
+func (v *Viewer) Done() <-chan struct{} {
+	return v.done
+}
+
+// Err returns why the viewer was removed. It's nil unless the viewer was
+// dropped or writing to it failed.
+func (v *Viewer) Err() error {
+	v.broadcaster.mutex.Lock()
+	defer v.broadcaster.mutex.Unlock()
+	return v.err
+}
+
+// next waits for the viewer's pending output. It returns false once there's
+// nothing more to write.
+func (v *Viewer) next() ([][]byte, bool) {
+	for {
+		b := v.broadcaster
+		b.mutex.Lock()
+		if v.removed {
+			b.mutex.Unlock()
+			return nil, false
+		}
+		if len(v.pending) != 0 {
+			pending := v.pending
+			v.pending = nil
+			v.pendingBytes = 0
+			b.mutex.Unlock()
+			return pending, true
+		}
+		if _, ok := b.viewers[v]; !ok {
+			// The broadcaster was closed and everything has been written
+			b.remove(v, nil)
+			b.mutex.Unlock()
+			return nil, false
+		}
+		b.mutex.Unlock()
+
+		select {
+		case <-v.ready:
+		case <-v.done:
+		}
+	}
+}
+
+func (v *Viewer) run() {
+	for {
+		pending, ok := v.next()
+		if !ok {
+			return
+		}
+		for _, chunk := range pending {
+			_, err := v.writer.Write(chunk)
+			if err != nil {
+				v.broadcaster.mutex.Lock()
+				v.broadcaster.remove(v, err)
+				v.broadcaster.mutex.Unlock()
+				return
+			}
+		}
+	}
+}
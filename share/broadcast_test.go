@@ -0,0 +1,136 @@
+package share
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is a bytes.Buffer that can be used from multiple goroutines
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+// blockedWriter blocks every write until it's unblocked
+type blockedWriter struct {
+	unblock chan struct{}
+}
+
+func (w blockedWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return len(p), nil
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("broken")
+}
+
+func waitForDone(t *testing.T, viewer *Viewer) {
+	select {
+	case <-viewer.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("The viewer wasn't removed")
+	}
+}
+
+func TestBroadcaster_SendsOutputToEveryViewer(t *testing.T) {
+	b := NewBroadcaster(DefaultMaxPending)
+	first, second := &syncBuffer{}, &syncBuffer{}
+	v1 := b.Add(first)
+	v2 := b.Add(second)
+	assert.Equal(t, 2, b.Len())
+
+	_, err := b.Write([]byte("hello "))
+	assert.NoError(t, err)
+	_, err = b.Write([]byte("world"))
+	assert.NoError(t, err)
+	assert.NoError(t, b.Close())
+
+	waitForDone(t, v1)
+	waitForDone(t, v2)
+	assert.Equal(t, "hello world", first.String())
+	assert.Equal(t, "hello world", second.String())
+	assert.NoError(t, v1.Err())
+	assert.Equal(t, 0, b.Len())
+}
+
+func TestBroadcaster_DropsSlowViewersWithoutBlocking(t *testing.T) {
+	b := NewBroadcaster(10)
+	slow := blockedWriter{unblock: make(chan struct{})}
+	defer close(slow.unblock)
+	fast := &syncBuffer{}
+	slowViewer := b.Add(slow)
+	fastViewer := b.Add(fast)
+
+	for i := 0; i < 5; i++ {
+		_, err := b.Write([]byte("12345"))
+		assert.NoError(t, err)
+		// Give the fast viewer a chance to keep up
+		assert.Eventually(t, func() bool { return len(fast.String()) == 5*(i+1) }, 5*time.Second, time.Millisecond)
+	}
+
+	waitForDone(t, slowViewer)
+	assert.Equal(t, ErrSlowViewer, slowViewer.Err())
+	assert.Equal(t, 1, b.Len())
+
+	assert.NoError(t, b.Close())
+	waitForDone(t, fastViewer)
+	assert.NoError(t, fastViewer.Err())
+}
+
+func TestBroadcaster_RemovesViewersThatFail(t *testing.T) {
+	b := NewBroadcaster(DefaultMaxPending)
+	viewer := b.Add(failingWriter{})
+
+	_, err := b.Write([]byte("hello"))
+	assert.NoError(t, err)
+
+	waitForDone(t, viewer)
+	assert.EqualError(t, viewer.Err(), "broken")
+	assert.Equal(t, 0, b.Len())
+}
+
+func TestViewer_Remove(t *testing.T) {
+	b := NewBroadcaster(DefaultMaxPending)
+	output := &syncBuffer{}
+	viewer := b.Add(output)
+
+	viewer.Remove()
+	viewer.Remove()
+	_, err := b.Write([]byte("hello"))
+	assert.NoError(t, err)
+
+	waitForDone(t, viewer)
+	assert.NoError(t, viewer.Err())
+	assert.Equal(t, 0, b.Len())
+	assert.Empty(t, output.String())
+}
+
+func TestBroadcaster_AddAfterCloseIsDone(t *testing.T) {
+	b := NewBroadcaster(DefaultMaxPending)
+	assert.NoError(t, b.Close())
+
+	viewer := b.Add(&syncBuffer{})
+
+	waitForDone(t, viewer)
+	assert.Equal(t, 0, b.Len())
+}
@@ -0,0 +1,386 @@
+package share
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/efarrer/gmash/ptyutils"
+
+	"golang.org/x/term"
+)
+
+// The size of the PTY when the host's terminal size is unknown
+const (
+	defaultWidth  = 80
+	defaultHeight = 24
+)
+
+// HandOffKey passes the keyboard to the next participant when collaborating
+const HandOffKey = 0x1c
+
+// HandOffKeyName is how HandOffKey is shown to the participants
+const HandOffKeyName = "Ctrl-\\"
+
+// A participant is the host or a guest who can be handed the keyboard
+type participant struct {
+	name string
+}
+
+// A Terminal is the host's shell running in a PTY that guests can watch.
+// Guests see the output live but their keystrokes are discarded unless
+// they're collaborating and have been handed the keyboard.
+type Terminal struct {
+	output    *Broadcaster
+	hostMutex sync.Mutex
+	host      io.Writer
+	raw       bool
+	done      chan struct{}
+	err       error
+
+	// Who is typing into the PTY. Guarded by controlMutex.
+	controlMutex  sync.Mutex
+	ptyFile       *os.File
+	collaborate   bool
+	guestsHandOff bool
+	owner         *participant
+	guests        []*participant
+	driver        *participant
+	lastGuest     *participant
+}
+
+// NewTerminal creates a Terminal that's shown on the host's stdout. Guests
+// can join before it's started.
+func NewTerminal(stdout io.Writer) *Terminal {
+	owner := &participant{name: "The host"}
+	return &Terminal{
+		output: NewBroadcaster(DefaultMaxPending),
+		host:   stdout,
+		done:   make(chan struct{}),
+		owner:  owner,
+		driver: owner,
+	}
+}
+
+// Collaborate lets the host hand the keyboard to guests with HandOffKey.
+// If guestsHandOff is true the guest who is driving can pass it on too.
+// It must be called before guests join.
+func (t *Terminal) Collaborate(guestsHandOff bool) {
+	t.controlMutex.Lock()
+	defer t.controlMutex.Unlock()
+	t.collaborate = true
+	t.guestsHandOff = guestsHandOff
+}
+
+// Driver returns the name of whoever has the keyboard
+func (t *Terminal) Driver() string {
+	t.controlMutex.Lock()
+	defer t.controlMutex.Unlock()
+	return t.driver.name
+}
+
+// terminalFd returns the file descriptor if the stream is a terminal
+func terminalFd(stream interface{}) (int, bool) {
+	file, ok := stream.(*os.File)
+	if !ok || !term.IsTerminal(int(file.Fd())) {
+		return 0, false
+	}
+	return int(file.Fd()), true
+}
+
+// Start runs the command in a PTY attached to the host's terminal. If stdin
+// is a terminal it's put in raw mode until the command exits, and the PTY
+// follows the size of stdout if it's a terminal.
+func (t *Terminal) Start(cmd *exec.Cmd, stdin io.Reader) error {
+	width, height := defaultWidth, defaultHeight
+	outFd, outIsTerminal := terminalFd(t.host)
+	if outIsTerminal {
+		if w, h, err := term.GetSize(outFd); err == nil {
+			width, height = w, h
+		}
+	}
+
+	ptyFile, err := ptyutils.StartWithSize(cmd, width, height, 0, 0)
+	if err != nil {
+		return fmt.Errorf("Unable to start %s (%s)", cmd.Path, err)
+	}
+	t.controlMutex.Lock()
+	t.ptyFile = ptyFile
+	t.controlMutex.Unlock()
+
+	raw := false
+	restore := func() {}
+	if inFd, ok := terminalFd(stdin); ok {
+		state, err := term.MakeRaw(inFd)
+		if err != nil {
+			_ = ptyFile.Close()
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+			return fmt.Errorf("Unable to put the terminal in raw mode (%s)", err)
+		}
+		raw = true
+		restore = func() { _ = term.Restore(inFd, state) }
+	}
+
+	t.hostMutex.Lock()
+	t.raw = raw
+	t.hostMutex.Unlock()
+
+	// The PTY follows the size of the host's terminal
+	resized := make(chan os.Signal, 1)
+	if outIsTerminal {
+		signal.Notify(resized, syscall.SIGWINCH)
+		go func() {
+			for range resized {
+				if w, h, err := term.GetSize(outFd); err == nil {
+					_ = ptyutils.SetWindowSize(ptyFile, w, h)
+				}
+			}
+		}()
+	}
+
+	go t.readKeys(t.owner, stdin)
+
+	go func() {
+		buffer := make([]byte, 32*1024)
+		for {
+			n, err := ptyFile.Read(buffer)
+			if n > 0 {
+				t.hostMutex.Lock()
+				_, _ = t.host.Write(buffer[:n])
+				t.hostMutex.Unlock()
+				_, _ = t.output.Write(buffer[:n])
+			}
+			// Reading from the pty fails once the shell (and anything else
+			// attached to the pty) has exited
+			if err != nil {
+				break
+			}
+		}
+
+		t.err = cmd.Wait()
+		_ = ptyFile.Close()
+		signal.Stop(resized)
+		close(resized)
+		restore()
+		t.hostMutex.Lock()
+		t.raw = false
+		t.hostMutex.Unlock()
+		close(t.done)
+		_ = t.output.Close()
+	}()
+	return nil
+}
+
+// Done is closed once the host's shell has exited
+func (t *Terminal) Done() <-chan struct{} {
+	return t.done
+}
+
+// Err returns the result of waiting for the host's shell once it has exited
+func (t *Terminal) Err() error {
+	<-t.done
+	return t.err
+}
+
+// Messages returns a writer for gmash's messages to the host. They're shown
+// on the host's terminal but not to guests, and stay readable while the
+// host's terminal is in raw mode.
+func (t *Terminal) Messages() io.Writer {
+	return hostMessages{t}
+}
+
+type hostMessages struct {
+	t *Terminal
+}
+
+func (m hostMessages) Write(p []byte) (int, error) {
+	m.t.hostMutex.Lock()
+	defer m.t.hostMutex.Unlock()
+	text := p
+	if m.t.raw {
+		// The terminal doesn't return the cursor to the start of the line
+		// in raw mode
+		text = bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))
+	}
+	_, err := m.t.host.Write(text)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// announce tells the host and the guests. The controlMutex must be held.
+func (t *Terminal) announce(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	fmt.Fprintf(t.Messages(), "\n[gmash] %s\n", message)
+	_, _ = fmt.Fprintf(t.output, "\r\n[gmash] %s\r\n", message)
+}
+
+// nextGuest returns the guest after the one who drove last
+func (t *Terminal) nextGuest(after *participant) *participant {
+	for i, guest := range t.guests {
+		if guest == after {
+			return t.guests[(i+1)%len(t.guests)]
+		}
+	}
+	if len(t.guests) == 0 {
+		return nil
+	}
+	return t.guests[0]
+}
+
+// handOff is called when someone presses HandOffKey. The host takes the
+// keyboard back from a guest or passes it to the next guest, and the guest
+// who is driving passes it to the next guest (or back to the host) if guests
+// are allowed to.
+func (t *Terminal) handOff(from *participant) {
+	t.controlMutex.Lock()
+	defer t.controlMutex.Unlock()
+
+	var to *participant
+	switch {
+	case from == t.owner && t.driver != t.owner:
+		to = t.owner
+	case from == t.owner:
+		to = t.nextGuest(t.lastGuest)
+		if to == nil {
+			fmt.Fprintf(t.Messages(), "\n[gmash] There's nobody to hand the keyboard to\n")
+			return
+		}
+	case from == t.driver && t.guestsHandOff:
+		to = t.owner
+		if t.guests[len(t.guests)-1] != from {
+			to = t.nextGuest(from)
+		}
+	default:
+		return
+	}
+	t.drive(to)
+}
+
+// drive hands the keyboard to the participant. The controlMutex must be
+// held.
+func (t *Terminal) drive(to *participant) {
+	t.driver = to
+	if to != t.owner {
+		t.lastGuest = to
+	}
+	t.announce("%s is driving (%s hands over the keyboard)", to.name, HandOffKeyName)
+}
+
+// typed sends what the participant typed to the shell if they're driving
+func (t *Terminal) typed(from *participant, keys []byte) {
+	for len(keys) != 0 {
+		t.controlMutex.Lock()
+		collaborate, ptyFile, driving := t.collaborate, t.ptyFile, t.driver == from
+		t.controlMutex.Unlock()
+
+		end := len(keys)
+		handOff := false
+		if collaborate {
+			if i := bytes.IndexByte(keys, HandOffKey); i >= 0 {
+				end = i
+				handOff = true
+			}
+		}
+		if driving && ptyFile != nil && end != 0 {
+			_, _ = ptyFile.Write(keys[:end])
+		}
+
+		if handOff {
+			t.handOff(from)
+			end++
+		}
+		keys = keys[end:]
+	}
+}
+
+// readKeys passes what the participant types to the terminal
+func (t *Terminal) readKeys(from *participant, keyboard io.Reader) {
+	buffer := make([]byte, 1024)
+	for {
+		n, err := keyboard.Read(buffer)
+		if n > 0 {
+			t.typed(from, buffer[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// join adds a guest who can be handed the keyboard
+func (t *Terminal) join(name string) *participant {
+	t.controlMutex.Lock()
+	defer t.controlMutex.Unlock()
+	guest := &participant{name: name}
+	if t.collaborate {
+		t.guests = append(t.guests, guest)
+	}
+	return guest
+}
+
+// leave removes the guest. The host gets the keyboard back if they were
+// driving.
+func (t *Terminal) leave(guest *participant) {
+	t.controlMutex.Lock()
+	defer t.controlMutex.Unlock()
+	for i, g := range t.guests {
+		if g == guest {
+			t.guests = append(t.guests[:i], t.guests[i+1:]...)
+			break
+		}
+	}
+	if t.lastGuest == guest {
+		t.lastGuest = nil
+	}
+	if t.driver == guest {
+		t.drive(t.owner)
+	}
+}
+
+// Join shows the terminal to the guest until the guest leaves or the host's
+// shell exits. Everything the guest types is discarded unless the guest is
+// collaborating and has the keyboard.
+func (t *Terminal) Join(name string, channel io.ReadWriter) error {
+	t.controlMutex.Lock()
+	collaborate := t.collaborate
+	t.controlMutex.Unlock()
+	welcome := "gmash: You're watching the host's terminal, your keystrokes are ignored. Press Enter then ~. to leave\r\n"
+	if collaborate {
+		welcome = fmt.Sprintf("gmash: You're sharing the host's terminal, your keystrokes are ignored until you're handed the keyboard with %s. Press Enter then ~. to leave\r\n", HandOffKeyName)
+	}
+	_, err := io.WriteString(channel, welcome)
+	if err != nil {
+		return err
+	}
+	guest := t.join(name)
+	viewer := t.output.Add(channel)
+	fmt.Fprintf(t.Messages(), "\n[gmash] %s started watching (%d watching)\n", name, t.output.Len())
+
+	go func() {
+		t.readKeys(guest, channel)
+		t.leave(guest)
+		viewer.Remove()
+	}()
+
+	<-viewer.Done()
+	err = viewer.Err()
+	select {
+	case <-t.done:
+		// Everyone stops watching when the host's shell exits
+	default:
+		if err == ErrSlowViewer {
+			fmt.Fprintf(t.Messages(), "\n[gmash] Disconnected %s for falling too far behind\n", name)
+		} else {
+			fmt.Fprintf(t.Messages(), "\n[gmash] %s stopped watching\n", name)
+		}
+	}
+	return err
+}
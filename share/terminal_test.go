@@ -0,0 +1,216 @@
+package share
+
+import (
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// guestChannel is what a guest types and sees
+type guestChannel struct {
+	io.Reader
+	io.Writer
+}
+
+func newGuest() (*guestChannel, *io.PipeWriter, *syncBuffer) {
+	keys, typed := io.Pipe()
+	screen := &syncBuffer{}
+	return &guestChannel{keys, screen}, typed, screen
+}
+
+func joinAsync(terminal *Terminal, guest string, channel io.ReadWriter) <-chan error {
+	joined := make(chan error, 1)
+	go func() {
+		joined <- terminal.Join(guest, channel)
+	}()
+	return joined
+}
+
+func TestTerminal_GuestsWatchButCantType(t *testing.T) {
+	stdin, hostTyped := io.Pipe()
+	host := &syncBuffer{}
+	terminal := NewTerminal(host)
+	channel, typed, screen := newGuest()
+	joined := joinAsync(terminal, "alice@127.0.0.1", channel)
+	assert.Eventually(t, func() bool { return terminal.output.Len() == 1 }, 5*time.Second, time.Millisecond)
+
+	assert.NoError(t, terminal.Start(exec.Command("cat"), stdin))
+
+	_, err := typed.Write([]byte("rm -rf /\n"))
+	assert.NoError(t, err)
+	_, err = hostTyped.Write([]byte("hello\n"))
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return len(host.String()) > 0 }, 5*time.Second, time.Millisecond)
+
+	// Ctrl-D makes cat exit
+	_, err = hostTyped.Write([]byte{4})
+	assert.NoError(t, err)
+	select {
+	case err = <-joined:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The guest was still watching after the shell exited")
+	}
+	assert.NoError(t, terminal.Err())
+
+	assert.Contains(t, screen.String(), "keystrokes are ignored")
+	assert.Contains(t, screen.String(), "hello")
+	assert.NotContains(t, screen.String(), "rm -rf")
+	assert.NotContains(t, host.String(), "rm -rf")
+	assert.NotContains(t, host.String(), "keystrokes are ignored")
+}
+
+func TestTerminal_TellsHostWhenGuestsComeAndGo(t *testing.T) {
+	stdin, hostTyped := io.Pipe()
+	defer func() { _ = hostTyped.Close() }()
+	host := &syncBuffer{}
+	terminal := NewTerminal(host)
+	assert.NoError(t, terminal.Start(exec.Command("cat"), stdin))
+
+	channel, typed, _ := newGuest()
+	joined := joinAsync(terminal, "alice@127.0.0.1", channel)
+	assert.Eventually(t, func() bool { return terminal.output.Len() == 1 }, 5*time.Second, time.Millisecond)
+
+	// The guest disconnecting ends their input
+	assert.NoError(t, typed.Close())
+	select {
+	case err := <-joined:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The guest was still watching after disconnecting")
+	}
+	assert.Contains(t, host.String(), "[gmash] alice@127.0.0.1 started watching (1 watching)")
+	assert.Contains(t, host.String(), "[gmash] alice@127.0.0.1 stopped watching")
+
+	_, err := hostTyped.Write([]byte{4})
+	assert.NoError(t, err)
+	select {
+	case <-terminal.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("The shell didn't exit")
+	}
+}
+
+func TestTerminal_StartFailsForMissingCommand(t *testing.T) {
+	terminal := NewTerminal(&syncBuffer{})
+	stdin, _ := io.Pipe()
+
+	err := terminal.Start(exec.Command("/does/not/exist"), stdin)
+
+	assert.Error(t, err)
+}
+
+// press types the keys and waits until they've been handled. Writes to a
+// pipe return once they've been read, so the empty write returns once the
+// keys have been handled and the next read has started.
+func press(t *testing.T, keyboard io.Writer, keys string) {
+	_, err := keyboard.Write([]byte(keys))
+	assert.NoError(t, err)
+	_, err = keyboard.Write(nil)
+	assert.NoError(t, err)
+}
+
+func TestTerminal_HostHandsTheKeyboardToGuests(t *testing.T) {
+	stdin, hostTyped := io.Pipe()
+	host := &syncBuffer{}
+	terminal := NewTerminal(host)
+	terminal.Collaborate(false)
+	assert.NoError(t, terminal.Start(exec.Command("cat"), stdin))
+	channel, typed, screen := newGuest()
+	joined := joinAsync(terminal, "alice", channel)
+	assert.Eventually(t, func() bool { return terminal.output.Len() == 1 }, 5*time.Second, time.Millisecond)
+
+	press(t, typed, "before\n")
+	press(t, hostTyped, string(rune(HandOffKey)))
+	assert.Equal(t, "alice", terminal.Driver())
+	press(t, typed, "from-alice\n")
+	assert.Eventually(t, func() bool { return strings.Contains(screen.String(), "from-alice") }, 5*time.Second, time.Millisecond)
+
+	// The host takes the keyboard back
+	press(t, hostTyped, "ignored\n"+string(rune(HandOffKey)))
+	assert.Equal(t, "The host", terminal.Driver())
+	press(t, typed, "after\n")
+	press(t, hostTyped, "\x04")
+	select {
+	case <-joined:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The guest was still watching after the shell exited")
+	}
+
+	assert.Contains(t, host.String(), "[gmash] alice is driving")
+	assert.Contains(t, host.String(), "[gmash] The host is driving")
+	assert.Contains(t, screen.String(), "[gmash] alice is driving")
+	assert.Contains(t, screen.String(), "handed the keyboard")
+	assert.NotContains(t, host.String(), "before")
+	assert.NotContains(t, host.String(), "ignored")
+	assert.NotContains(t, host.String(), "after")
+}
+
+func TestTerminal_GuestsCanPassTheKeyboardOn(t *testing.T) {
+	terminal := NewTerminal(&syncBuffer{})
+	terminal.Collaborate(true)
+	alice := terminal.join("alice")
+	bob := terminal.join("bob")
+
+	// Only the driver can pass the keyboard on
+	terminal.typed(alice, []byte{HandOffKey})
+	assert.Equal(t, "The host", terminal.Driver())
+
+	terminal.typed(terminal.owner, []byte{HandOffKey})
+	assert.Equal(t, "alice", terminal.Driver())
+	terminal.typed(bob, []byte{HandOffKey})
+	assert.Equal(t, "alice", terminal.Driver())
+	terminal.typed(alice, []byte{HandOffKey})
+	assert.Equal(t, "bob", terminal.Driver())
+	terminal.typed(bob, []byte{HandOffKey})
+	assert.Equal(t, "The host", terminal.Driver())
+
+	// The host carries on from the last guest who drove
+	terminal.typed(terminal.owner, []byte{HandOffKey})
+	assert.Equal(t, "alice", terminal.Driver())
+}
+
+func TestTerminal_OnlyTheHostPassesTheKeyboardByDefault(t *testing.T) {
+	terminal := NewTerminal(&syncBuffer{})
+	terminal.Collaborate(false)
+	alice := terminal.join("alice")
+	terminal.join("bob")
+
+	terminal.typed(terminal.owner, []byte{HandOffKey})
+	assert.Equal(t, "alice", terminal.Driver())
+	terminal.typed(alice, []byte{HandOffKey})
+	assert.Equal(t, "alice", terminal.Driver())
+	terminal.typed(terminal.owner, []byte{HandOffKey})
+	assert.Equal(t, "The host", terminal.Driver())
+	terminal.typed(terminal.owner, []byte{HandOffKey})
+	assert.Equal(t, "bob", terminal.Driver())
+}
+
+func TestTerminal_HostGetsTheKeyboardBackWhenTheDriverLeaves(t *testing.T) {
+	host := &syncBuffer{}
+	terminal := NewTerminal(host)
+	terminal.Collaborate(false)
+	alice := terminal.join("alice")
+	terminal.typed(terminal.owner, []byte{HandOffKey})
+	assert.Equal(t, "alice", terminal.Driver())
+
+	terminal.leave(alice)
+
+	assert.Equal(t, "The host", terminal.Driver())
+	terminal.typed(terminal.owner, []byte{HandOffKey})
+	assert.Equal(t, "The host", terminal.Driver())
+	assert.Contains(t, host.String(), "nobody to hand the keyboard to")
+}
+
+func TestTerminal_WatchersCantBeHandedTheKeyboard(t *testing.T) {
+	terminal := NewTerminal(&syncBuffer{})
+	terminal.join("alice")
+
+	terminal.typed(terminal.owner, []byte{HandOffKey})
+
+	assert.Equal(t, "The host", terminal.Driver())
+}
@@ -0,0 +1,83 @@
+package sshd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+
+	"github.com/efarrer/gmash/audit"
+	"github.com/efarrer/gmash/auth"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// agentChannelType is the channel agent connections are forwarded over (See
+// OpenSSH's PROTOCOL.agent)
+const agentChannelType = "auth-agent@openssh.com"
+
+// An agentForward is the socket a session's commands use to reach the
+// client's agent
+type agentForward struct {
+	dir      string
+	listener net.Listener
+}
+
+// socketPath returns the path for SSH_AUTH_SOCK
+func (a *agentForward) socketPath() string {
+	return path.Join(a.dir, "agent.sock")
+}
+
+// close stops forwarding and removes the socket
+func (a *agentForward) close() {
+	_ = a.listener.Close()
+	_ = os.RemoveAll(a.dir)
+}
+
+// forwardAgent listens on a socket in a private directory and forwards its
+// connections to the client's agent
+func (s *session) forwardAgent() error {
+	dir, err := ioutil.TempDir("", "gmash-agent-")
+	if err != nil {
+		return fmt.Errorf("Unable to create the agent socket (%s)", err)
+	}
+	agent := &agentForward{dir: dir}
+	agent.listener, err = net.Listen("unix", agent.socketPath())
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return fmt.Errorf("Unable to create the agent socket (%s)", err)
+	}
+	s.agent = agent
+	s.env = append(s.env, "SSH_AUTH_SOCK="+agent.socketPath())
+
+	go func() {
+		for {
+			local, err := agent.listener.Accept()
+			if err != nil {
+				return
+			}
+			go openForwardChannel(s.conn, s.shellConf, local, agentChannelType, nil, audit.Event{Listen: agent.socketPath()})
+		}
+	}()
+	return nil
+}
+
+func _handleAgentRequest(sess *session, req *ssh.Request) error {
+	if !sess.shellConf.AgentForwarding() {
+		return declinedRequest{fmt.Errorf("Unable to forward %s's agent, agent forwarding isn't enabled", sess.guest())}
+	}
+	if !auth.Permitted(sess.permissions(), auth.PermitAgentForwarding) {
+		return fmt.Errorf("Unable to forward %s's agent, it isn't permitted for this key", sess.guest())
+	}
+	if sess.shellConf.SharedTerminal() != nil {
+		return fmt.Errorf("Unable to forward %s's agent, guests can only watch the shared terminal", sess.guest())
+	}
+	if sess.started() {
+		return fmt.Errorf("Unable to forward %s's agent after the session has started", sess.guest())
+	}
+	if sess.agent != nil {
+		return fmt.Errorf("Unable to forward %s's agent, it's already forwarded", sess.guest())
+	}
+	return sess.forwardAgent()
+}
@@ -0,0 +1,99 @@
+package sshd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/efarrer/gmash/auth"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// agentSocket returns SSH_AUTH_SOCK from the session's environment
+func agentSocket(sess *session) string {
+	for _, env := range sess.env {
+		if strings.HasPrefix(env, "SSH_AUTH_SOCK=") {
+			return strings.TrimPrefix(env, "SSH_AUTH_SOCK=")
+		}
+	}
+	return ""
+}
+
+func TestHandleAgentRequest_FailsIfAgentForwardingIsDisabled(t *testing.T) {
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, newShellConf())
+
+	err := handleAgentRequest(sess, &ssh.Request{})
+
+	assert.Error(t, err)
+	assert.IsType(t, declinedRequest{}, err)
+	assert.Nil(t, sess.agent)
+	assert.Empty(t, agentSocket(sess))
+}
+
+func TestHandleAgentRequest_FailsIfAgentForwardingIsNotPermitted(t *testing.T) {
+	sc := newShellConf()
+	sc.agent = true
+	sess := newSession(newFakeChannel([]byte{}, nil), restrictedConn("", auth.PermitPortForwarding), sc)
+
+	err := handleAgentRequest(sess, &ssh.Request{})
+
+	assert.Error(t, err)
+	assert.Nil(t, sess.agent)
+}
+
+func TestHandleAgentRequest_CreatesAPrivateSocket(t *testing.T) {
+	sc := newShellConf()
+	sc.agent = true
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, sc)
+
+	err := handleAgentRequest(sess, &ssh.Request{})
+	assert.NoError(t, err)
+	assert.Error(t, handleAgentRequest(sess, &ssh.Request{}))
+
+	socketPath := agentSocket(sess)
+	info, err := os.Stat(path.Dir(socketPath))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	_, err = os.Stat(socketPath)
+	assert.NoError(t, err)
+
+	// The socket is removed when the session closes
+	sess.hangup()
+	_, err = os.Stat(path.Dir(socketPath))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAgentForwarding_ForwardsToTheClientsAgent(t *testing.T) {
+	port, closer, err := createTestServer("/bin/bash", WithAgentForwarding())
+	assert.NoError(t, err)
+	defer closer()
+	client, err := ssh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &ssh.ClientConfig{
+		User:            "guest",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	keyring := agent.NewKeyring()
+	assert.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: private, Comment: "guest-key"}))
+	assert.NoError(t, agent.ForwardToAgent(client, keyring))
+
+	session, err := client.NewSession()
+	assert.NoError(t, err)
+	defer session.Close()
+	assert.NoError(t, agent.RequestAgentForwarding(session))
+	output, err := session.Output("ssh-add -l")
+
+	assert.NoError(t, err)
+	assert.Contains(t, string(output), "guest-key")
+}
@@ -0,0 +1,97 @@
+package sshd
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/efarrer/gmash/audit"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// auditEvent fills in the connection's details and sends the event to the
+// audit log
+func auditEvent(shellConf ShellConf, conn *ssh.ServerConn, event audit.Event) {
+	if conn != nil && conn.Conn != nil {
+		event.ConnectionID = audit.ConnectionID(conn)
+		event.User = conn.User()
+		event.RemoteAddr = conn.RemoteAddr().String()
+	}
+	shellConf.Audit(event)
+}
+
+// byteCounter counts the bytes received from and sent to a client
+type byteCounter struct {
+	in  int64
+	out int64
+}
+
+func (c *byteCounter) received(n int) {
+	atomic.AddInt64(&c.in, int64(n))
+}
+
+func (c *byteCounter) sent(n int) {
+	atomic.AddInt64(&c.out, int64(n))
+}
+
+// totals returns the bytes received and sent so far
+func (c *byteCounter) totals() (int64, int64) {
+	return atomic.LoadInt64(&c.in), atomic.LoadInt64(&c.out)
+}
+
+// countingConn is a net.Conn that counts the bytes that pass through it
+type countingConn struct {
+	net.Conn
+	*byteCounter
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.received(n)
+	return n, err
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.sent(n)
+	return n, err
+}
+
+// countingChannel is a ssh.Channel that counts the bytes that pass through it
+// including what's written to stderr
+type countingChannel struct {
+	ssh.Channel
+	*byteCounter
+}
+
+func (c countingChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	c.received(n)
+	return n, err
+}
+
+func (c countingChannel) Write(p []byte) (int, error) {
+	n, err := c.Channel.Write(p)
+	c.sent(n)
+	return n, err
+}
+
+func (c countingChannel) Stderr() io.ReadWriter {
+	stderr := c.Channel.Stderr()
+	if stderr == nil {
+		return nil
+	}
+	return countingStderr{stderr, c.byteCounter}
+}
+
+type countingStderr struct {
+	io.ReadWriter
+	*byteCounter
+}
+
+func (c countingStderr) Write(p []byte) (int, error) {
+	n, err := c.ReadWriter.Write(p)
+	c.sent(n)
+	return n, err
+}
@@ -0,0 +1,62 @@
+package sshd
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// The environment variables guests may set with env requests unless an
+// EnvAllowList is given. TERM is only used when there's no PTY.
+var defaultAcceptEnv = []string{"LANG", "LC_*", "TERM"}
+
+// An EnvAllowList holds the environment variables guests may set with env
+// requests. A nil EnvAllowList allows none.
+type EnvAllowList struct {
+	patterns []string
+}
+
+// NewEnvAllowList parses environment variable name patterns. The patterns
+// may contain wildcards (See path.Match).
+func NewEnvAllowList(patterns []string) (*EnvAllowList, error) {
+	list := &EnvAllowList{}
+	for _, pattern := range patterns {
+		if pattern == "" || strings.ContainsAny(pattern, "=/") {
+			return nil, fmt.Errorf("Unable to parse environment variable %q (it must be a name)", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Unable to parse environment variable %s (%s)", pattern, err)
+		}
+		list.patterns = append(list.patterns, pattern)
+	}
+	return list, nil
+}
+
+// Allow returns an error unless a pattern matches the name
+func (l *EnvAllowList) Allow(name string) error {
+	if l != nil && acceptEnv(l.patterns, name) {
+		return nil
+	}
+	return fmt.Errorf("Ignoring environment variable %s", name)
+}
+
+// acceptEnv returns true if name matches one of the patterns
+func acceptEnv(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseEnv checks that the variables are NAME=VALUE pairs
+func ParseEnv(vars []string) ([]string, error) {
+	for _, v := range vars {
+		name, _, found := strings.Cut(v, "=")
+		if !found || name == "" {
+			return nil, fmt.Errorf("Unable to parse environment variable %q (it must be NAME=VALUE)", v)
+		}
+	}
+	return vars, nil
+}
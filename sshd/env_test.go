@@ -0,0 +1,41 @@
+package sshd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewEnvAllowList_RejectsInvalidPatterns(t *testing.T) {
+	for _, pattern := range []string{"", "LANG=C", "/LANG", "LC_["} {
+		_, err := NewEnvAllowList([]string{pattern})
+		assert.Error(t, err, pattern)
+	}
+}
+
+func TestEnvAllowList_AllowsMatchingNames(t *testing.T) {
+	list, err := NewEnvAllowList([]string{"LANG", "GIT_*"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, list.Allow("LANG"))
+	assert.NoError(t, list.Allow("GIT_AUTHOR_NAME"))
+	assert.Error(t, list.Allow("LANGUAGE"))
+	assert.Error(t, list.Allow("LD_PRELOAD"))
+}
+
+func TestEnvAllowList_NilAllowsNothing(t *testing.T) {
+	var list *EnvAllowList
+
+	assert.Error(t, list.Allow("LANG"))
+}
+
+func TestParseEnv(t *testing.T) {
+	env, err := ParseEnv([]string{"EDITOR=vim", "EMPTY="})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"EDITOR=vim", "EMPTY="}, env)
+
+	_, err = ParseEnv([]string{"EDITOR"})
+	assert.Error(t, err)
+	_, err = ParseEnv([]string{"=vim"})
+	assert.Error(t, err)
+}
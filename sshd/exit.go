@@ -0,0 +1,81 @@
+package sshd
+
+import (
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Signal names as defined in RFC 4254 6.10
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "ABRT",
+	syscall.SIGALRM: "ALRM",
+	syscall.SIGFPE:  "FPE",
+	syscall.SIGHUP:  "HUP",
+	syscall.SIGILL:  "ILL",
+	syscall.SIGINT:  "INT",
+	syscall.SIGKILL: "KILL",
+	syscall.SIGPIPE: "PIPE",
+	syscall.SIGQUIT: "QUIT",
+	syscall.SIGSEGV: "SEGV",
+	syscall.SIGTERM: "TERM",
+	syscall.SIGUSR1: "USR1",
+	syscall.SIGUSR2: "USR2",
+}
+
+// signalName returns the RFC 4254 name of the signal. Signals without a
+// standard name use the same name OpenSSH does.
+func signalName(sig syscall.Signal) string {
+	name, ok := signalNames[sig]
+	if !ok {
+		return "SIG@openssh.com"
+	}
+	return name
+}
+
+type exitStatusMsg struct {
+	ExitStatus uint32
+}
+
+type exitSignalMsg struct {
+	SignalName   string
+	CoreDumped   bool
+	ErrorMessage string
+	LanguageTag  string
+}
+
+// exitStatusRequest converts the result of exec.Cmd.Wait into either an
+// exit-status or exit-signal request
+func exitStatusRequest(waitErr error) (string, []byte) {
+	if waitErr == nil {
+		return "exit-status", ssh.Marshal(&exitStatusMsg{0})
+	}
+
+	exitErr, ok := waitErr.(*exec.ExitError)
+	if !ok {
+		// The command didn't run to completion so there is no real status
+		return "exit-status", ssh.Marshal(&exitStatusMsg{255})
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return "exit-status", ssh.Marshal(&exitStatusMsg{255})
+	}
+
+	if status.Signaled() {
+		return "exit-signal", ssh.Marshal(&exitSignalMsg{
+			SignalName:   signalName(status.Signal()),
+			CoreDumped:   status.CoreDump(),
+			ErrorMessage: status.Signal().String(),
+		})
+	}
+	return "exit-status", ssh.Marshal(&exitStatusMsg{uint32(status.ExitStatus())})
+}
+
+// sendExitStatus sends the exit-status or exit-signal for the result of
+// exec.Cmd.Wait to the client
+func sendExitStatus(channel ssh.Channel, waitErr error) error {
+	name, payload := exitStatusRequest(waitErr)
+	_, err := channel.SendRequest(name, false, payload)
+	return err
+}
@@ -0,0 +1,55 @@
+package sshd
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitStatusRequest_Success(t *testing.T) {
+	name, payload := exitStatusRequest(exec.Command("/bin/sh", "-c", "exit 0").Run())
+
+	msg := exitStatusMsg{}
+	assert.NoError(t, ssh.Unmarshal(payload, &msg))
+	assert.Equal(t, "exit-status", name)
+	assert.Equal(t, uint32(0), msg.ExitStatus)
+}
+
+func TestExitStatusRequest_NonZeroExit(t *testing.T) {
+	name, payload := exitStatusRequest(exec.Command("/bin/sh", "-c", "exit 3").Run())
+
+	msg := exitStatusMsg{}
+	assert.NoError(t, ssh.Unmarshal(payload, &msg))
+	assert.Equal(t, "exit-status", name)
+	assert.Equal(t, uint32(3), msg.ExitStatus)
+}
+
+func TestExitStatusRequest_KilledBySignal(t *testing.T) {
+	name, payload := exitStatusRequest(exec.Command("/bin/sh", "-c", "kill -TERM $$").Run())
+
+	msg := exitSignalMsg{}
+	assert.NoError(t, ssh.Unmarshal(payload, &msg))
+	assert.Equal(t, "exit-signal", name)
+	assert.Equal(t, "TERM", msg.SignalName)
+	assert.False(t, msg.CoreDumped)
+	assert.Equal(t, syscall.SIGTERM.String(), msg.ErrorMessage)
+}
+
+func TestExitStatusRequest_OtherErrors(t *testing.T) {
+	name, payload := exitStatusRequest(errors.New("some error"))
+
+	msg := exitStatusMsg{}
+	assert.NoError(t, ssh.Unmarshal(payload, &msg))
+	assert.Equal(t, "exit-status", name)
+	assert.Equal(t, uint32(255), msg.ExitStatus)
+}
+
+func TestSignalName_UsesRFCNames(t *testing.T) {
+	assert.Equal(t, "KILL", signalName(syscall.SIGKILL))
+	assert.Equal(t, "SIG@openssh.com", signalName(syscall.SIGWINCH))
+}
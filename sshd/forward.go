@@ -0,0 +1,212 @@
+package sshd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/efarrer/gmash/audit"
+	"github.com/efarrer/gmash/auth"
+	"github.com/efarrer/gmash/payload"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// forwardDialTimeout is how long connecting to a forwarded destination can take
+const forwardDialTimeout = 10 * time.Second
+
+type forwardPattern struct {
+	host string
+	// "*" or a port number
+	port string
+}
+
+// A ForwardAllowList holds the destinations guests may forward connections to.
+// An empty list doesn't allow any.
+type ForwardAllowList struct {
+	patterns []forwardPattern
+}
+
+// NewForwardAllowList parses host:port patterns. The host may contain
+// wildcards (See path.Match) and the port may be "*" to allow any port.
+func NewForwardAllowList(patterns []string) (*ForwardAllowList, error) {
+	list := &ForwardAllowList{}
+	for _, pattern := range patterns {
+		host, port, err := net.SplitHostPort(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse forwarding destination %s (%s)", pattern, err)
+		}
+		if _, err := path.Match(host, ""); err != nil || host == "" {
+			return nil, fmt.Errorf("Unable to parse forwarding destination %s (invalid host)", pattern)
+		}
+		if number, err := strconv.ParseUint(port, 10, 16); port != "*" && (err != nil || number == 0) {
+			return nil, fmt.Errorf("Unable to parse forwarding destination %s (invalid port)", pattern)
+		}
+		list.patterns = append(list.patterns, forwardPattern{host: strings.ToLower(host), port: port})
+	}
+	return list, nil
+}
+
+// Allow returns an error unless a pattern matches the destination
+func (l *ForwardAllowList) Allow(host string, port uint32) error {
+	destination := forwardAddress(host, port)
+	if l == nil {
+		return fmt.Errorf("Unable to forward to %s, forwarding isn't enabled", destination)
+	}
+	for _, pattern := range l.patterns {
+		matched, _ := path.Match(pattern.host, strings.ToLower(host))
+		if matched && (pattern.port == "*" || pattern.port == strconv.FormatUint(uint64(port), 10)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unable to forward to %s, it isn't an allowed destination", destination)
+}
+
+// forwardAddress joins the address and port
+func forwardAddress(address string, port uint32) string {
+	return net.JoinHostPort(address, strconv.FormatUint(uint64(port), 10))
+}
+
+// rejectChannel refuses to open the channel and reports why
+func rejectChannel(newChannel ssh.NewChannel, conn *ssh.ServerConn, shellConf ShellConf, event audit.Event, reason ssh.RejectionReason, err error) {
+	shellConf.ErrorHandler(err)
+	event.Event = audit.ChannelRejected
+	event.Error = err.Error()
+	auditEvent(shellConf, conn, event)
+	rerr := newChannel.Reject(reason, err.Error())
+	if rerr != nil {
+		shellConf.ErrorHandler(rerr)
+	}
+}
+
+// connectionPermissions returns the permissions granted when the client
+// authenticated
+func connectionPermissions(conn *ssh.ServerConn) *ssh.Permissions {
+	if conn == nil {
+		return nil
+	}
+	return conn.Permissions
+}
+
+// _handleDirectTCPIP connects a direct-tcpip channel (See RFC 4254 7.2) to
+// its destination if the destination is allowed
+func _handleDirectTCPIP(newChannel ssh.NewChannel, conn *ssh.ServerConn, shellConf ShellConf) {
+	event := audit.Event{ChannelType: newChannel.ChannelType()}
+	req, err := payload.ParseDirectTCPIP(newChannel.ExtraData())
+	if err != nil {
+		rejectChannel(newChannel, conn, shellConf, event, ssh.ConnectionFailed, fmt.Errorf("Unable to parse direct-tcpip request (%s)", err))
+		return
+	}
+	event.Destination = forwardAddress(req.Host, req.Port)
+	event.Originator = forwardAddress(req.OriginatorIP, req.OriginatorPort)
+	dialForward(newChannel, conn, shellConf, event, "tcp", shellConf.AllowForward(req.Host, req.Port))
+}
+
+// dialForward connects the channel to the event's destination if the client
+// may forward to it. notAllowed is the host's reason for refusing it.
+func dialForward(newChannel ssh.NewChannel, conn *ssh.ServerConn, shellConf ShellConf, event audit.Event, network string, notAllowed error) {
+	if !auth.Permitted(connectionPermissions(conn), auth.PermitPortForwarding) {
+		rejectChannel(newChannel, conn, shellConf, event, ssh.Prohibited, fmt.Errorf("Unable to forward to %s, port forwarding isn't permitted for this key", event.Destination))
+		return
+	}
+	if notAllowed != nil {
+		rejectChannel(newChannel, conn, shellConf, event, ssh.Prohibited, notAllowed)
+		return
+	}
+	target, err := net.DialTimeout(network, event.Destination, forwardDialTimeout)
+	if err != nil {
+		rejectChannel(newChannel, conn, shellConf, event, ssh.ConnectionFailed, fmt.Errorf("Unable to connect to %s (%s)", event.Destination, err))
+		return
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		_ = target.Close()
+		shellConf.ErrorHandler(fmt.Errorf("could not accept channel: %v", err))
+		return
+	}
+	forwardAudited(channel, requests, target, conn, shellConf, event)
+}
+
+// openForwardChannel forwards the connection to the client over a new channel
+func openForwardChannel(conn *ssh.ServerConn, shellConf ShellConf, local net.Conn, channelType string, extraData []byte, event audit.Event) {
+	event.ChannelType = channelType
+	channel, requests, err := conn.OpenChannel(channelType, extraData)
+	if err != nil {
+		_ = local.Close()
+		err = fmt.Errorf("Unable to forward a connection from %s to the client (%s)", event.Listen, err)
+		shellConf.ErrorHandler(err)
+		event.Event = audit.ChannelRejected
+		event.Error = err.Error()
+		auditEvent(shellConf, conn, event)
+		return
+	}
+	forwardAudited(channel, requests, local, conn, shellConf, event)
+}
+
+// forwardAudited forwards between the channel and the connection. The
+// channel opening and closing are sent to the audit log.
+func forwardAudited(channel ssh.Channel, requests <-chan *ssh.Request, target net.Conn, conn *ssh.ServerConn, shellConf ShellConf, event audit.Event) {
+	// The requests stop once the client closes the channel
+	channelClosed := make(chan struct{})
+	go func() {
+		ssh.DiscardRequests(requests)
+		close(channelClosed)
+	}()
+
+	event.Event = audit.ChannelOpened
+	event.ChannelID = newSessionID()
+	auditEvent(shellConf, conn, event)
+	opened := time.Now()
+
+	counter := &byteCounter{}
+	forward(countingChannel{channel, counter}, target, channelClosed)
+
+	event.Event = audit.ChannelClosed
+	bytesIn, bytesOut := counter.totals()
+	event.Closed(bytesIn, bytesOut, opened)
+	auditEvent(shellConf, conn, event)
+}
+
+// closeWrite closes the writing side of the connection if it can be half
+// closed otherwise it closes the connection
+func closeWrite(conn io.Closer) {
+	if halfCloser, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = halfCloser.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
+
+// forward copies between the channel and the connection until both sides are
+// done. A side that finishes sending is half closed so the other can still
+// reply.
+func forward(channel ssh.Channel, target net.Conn, channelClosed <-chan struct{}) {
+	received := make(chan struct{})
+	sent := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(target, channel)
+		closeWrite(target)
+		close(received)
+	}()
+	go func() {
+		_, _ = io.Copy(channel, target)
+		_ = channel.CloseWrite()
+		close(sent)
+	}()
+
+	// Everything the client sent is passed on before giving up on the
+	// connection once the client has closed the channel
+	<-received
+	select {
+	case <-sent:
+	case <-channelClosed:
+	}
+	_ = channel.Close()
+	_ = target.Close()
+	<-sent
+}
@@ -0,0 +1,170 @@
+package sshd
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/efarrer/gmash/audit"
+	"github.com/efarrer/gmash/auth"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewForwardAllowList_RejectsInvalidPatterns(t *testing.T) {
+	for _, pattern := range []string{"localhost", "localhost:http", "localhost:0", "localhost:65536", ":80", "[:80"} {
+		_, err := NewForwardAllowList([]string{pattern})
+		assert.Error(t, err, pattern)
+	}
+}
+
+func TestForwardAllowList_AllowsMatchingDestinations(t *testing.T) {
+	list, err := NewForwardAllowList([]string{"localhost:3000", "*.internal:*", "[::1]:8080"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, list.Allow("localhost", 3000))
+	assert.NoError(t, list.Allow("LocalHost", 3000))
+	assert.NoError(t, list.Allow("db.internal", 5432))
+	assert.NoError(t, list.Allow("::1", 8080))
+	assert.Error(t, list.Allow("localhost", 3001))
+	assert.Error(t, list.Allow("127.0.0.1", 3000))
+	assert.Error(t, list.Allow("internal", 5432))
+}
+
+func TestForwardAllowList_DeniesEverythingByDefault(t *testing.T) {
+	var list *ForwardAllowList
+	assert.Error(t, list.Allow("localhost", 3000))
+
+	list, err := NewForwardAllowList(nil)
+	assert.NoError(t, err)
+	assert.Error(t, list.Allow("localhost", 3000))
+}
+
+// fakeDirectTCPIPChannel is a direct-tcpip ssh.NewChannel
+type fakeDirectTCPIPChannel struct {
+	extraData []byte
+	channel   *fakeChannel
+	requests  chan *ssh.Request
+	rejected  ssh.RejectionReason
+}
+
+func newFakeDirectTCPIPChannel(destination string, toRead []byte) *fakeDirectTCPIPChannel {
+	host, port, _ := net.SplitHostPort(destination)
+	portNumber, _ := strconv.Atoi(port)
+	return &fakeDirectTCPIPChannel{
+		extraData: ssh.Marshal(struct {
+			Host           string
+			Port           uint32
+			OriginatorIP   string
+			OriginatorPort uint32
+		}{host, uint32(portNumber), "10.0.0.1", 54321}),
+		channel:  newFakeChannel(toRead, nil),
+		requests: make(chan *ssh.Request),
+	}
+}
+
+func (fc *fakeDirectTCPIPChannel) ChannelType() string {
+	return "direct-tcpip"
+}
+
+func (fc *fakeDirectTCPIPChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	return fc.channel, fc.requests, nil
+}
+
+func (fc *fakeDirectTCPIPChannel) Reject(reason ssh.RejectionReason, message string) error {
+	fc.rejected = reason
+	return nil
+}
+
+func (fc *fakeDirectTCPIPChannel) ExtraData() []byte {
+	return fc.extraData
+}
+
+// startEchoServer starts a TCP server that echoes what it receives
+func startEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestHandleDirectTCPIP_ForwardsToTheDestination(t *testing.T) {
+	sc := newShellConf()
+	listener := startEchoServer(t)
+	defer listener.Close()
+	newChannel := newFakeDirectTCPIPChannel(listener.Addr().String(), []byte("hello"))
+	defer close(newChannel.requests)
+
+	handleDirectTCPIP(newChannel, nil, sc)
+
+	assert.NoError(t, sc.err)
+	assert.Equal(t, "hello", string(newChannel.channel.Bytes()))
+	assert.Equal(t, []string{audit.ChannelOpened, audit.ChannelClosed}, sc.auditEvents())
+	closed := sc.audited[1]
+	assert.Equal(t, listener.Addr().String(), closed.Destination)
+	assert.Equal(t, "10.0.0.1:54321", closed.Originator)
+	assert.Equal(t, sc.audited[0].ChannelID, closed.ChannelID)
+	assert.Equal(t, int64(5), *closed.BytesIn)
+	assert.Equal(t, int64(5), *closed.BytesOut)
+}
+
+func TestHandleDirectTCPIP_RejectsDestinationsThatArentAllowed(t *testing.T) {
+	sc := newShellConf()
+	sc.forward = errors.New("not allowed")
+	newChannel := newFakeDirectTCPIPChannel("localhost:3000", nil)
+
+	handleDirectTCPIP(newChannel, nil, sc)
+
+	assert.Equal(t, sc.forward, sc.err)
+	assert.Equal(t, ssh.Prohibited, newChannel.rejected)
+	assert.Equal(t, []string{audit.ChannelRejected}, sc.auditEvents())
+	assert.Equal(t, "localhost:3000", sc.audited[0].Destination)
+}
+
+func TestHandleDirectTCPIP_RejectsKeysWithoutPortForwarding(t *testing.T) {
+	sc := newShellConf()
+	newChannel := newFakeDirectTCPIPChannel("localhost:3000", nil)
+
+	handleDirectTCPIP(newChannel, restrictedConn("", auth.PermitPty), sc)
+
+	assert.Error(t, sc.err)
+	assert.Equal(t, ssh.Prohibited, newChannel.rejected)
+}
+
+func TestHandleDirectTCPIP_RejectsUnreachableDestinations(t *testing.T) {
+	sc := newShellConf()
+	listener := startEchoServer(t)
+	listener.Close()
+	newChannel := newFakeDirectTCPIPChannel(listener.Addr().String(), nil)
+
+	handleDirectTCPIP(newChannel, nil, sc)
+
+	assert.Error(t, sc.err)
+	assert.Equal(t, ssh.ConnectionFailed, newChannel.rejected)
+}
+
+func TestHandleDirectTCPIP_RejectsInvalidRequests(t *testing.T) {
+	sc := newShellConf()
+	newChannel := newFakeDirectTCPIPChannel("localhost:3000", nil)
+	newChannel.extraData = newChannel.extraData[:6]
+
+	handleDirectTCPIP(newChannel, nil, sc)
+
+	assert.Error(t, sc.err)
+	assert.Equal(t, ssh.ConnectionFailed, newChannel.rejected)
+}
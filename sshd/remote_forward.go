@@ -0,0 +1,152 @@
+package sshd
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/efarrer/gmash/audit"
+	"github.com/efarrer/gmash/auth"
+	"github.com/efarrer/gmash/payload"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The most ports and sockets a connection can listen on at once
+const maxRemoteForwards = 10
+
+// Ports below this need root and belong to system services
+const firstUnprivilegedPort = 1024
+
+// remoteForwards holds the listeners for a connection's remote forwards (See
+// RFC 4254 7.1). Global requests are handled sequentially so it isn't locked.
+type remoteForwards struct {
+	conn      *ssh.ServerConn
+	shellConf ShellConf
+	// The listeners by the address and port the client asked for
+	listeners map[string]net.Listener
+	// The Unix socket listeners by path
+	sockets map[string]net.Listener
+}
+
+func newRemoteForwards(conn *ssh.ServerConn, shellConf ShellConf) *remoteForwards {
+	return &remoteForwards{
+		conn:      conn,
+		shellConf: shellConf,
+		listeners: map[string]net.Listener{},
+		sockets:   map[string]net.Listener{},
+	}
+}
+
+// bindAddress returns the address to listen on for the address the client
+// asked for. Like OpenSSH's GatewayPorts forwards only listen on the loopback
+// interface unless gateway ports are allowed.
+func bindAddress(requested string, gatewayPorts bool) string {
+	if !gatewayPorts {
+		return "127.0.0.1"
+	}
+	if requested == "*" {
+		return ""
+	}
+	return requested
+}
+
+// listen starts listening for connections to forward to the client. It
+// returns the address it's listening on and the reply to the request.
+func (f *remoteForwards) listen(req *ssh.Request) (string, []byte, error) {
+	forwardReq, err := payload.ParseTCPIPForward(req.Payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to parse tcpip-forward request (%s)", err)
+	}
+	requested := forwardAddress(forwardReq.Address, forwardReq.Port)
+	err = f.mayListen(requested)
+	if err != nil {
+		return requested, nil, err
+	}
+	if forwardReq.Port > 65535 {
+		return requested, nil, fmt.Errorf("Unable to listen on %s (invalid port)", requested)
+	}
+	if forwardReq.Port != 0 && forwardReq.Port < firstUnprivilegedPort {
+		return requested, nil, fmt.Errorf("Unable to listen on %s, privileged ports can't be forwarded", requested)
+	}
+	if _, ok := f.listeners[requested]; ok {
+		return requested, nil, fmt.Errorf("Unable to listen on %s, it's already being forwarded", requested)
+	}
+
+	listener, err := net.Listen("tcp", forwardAddress(bindAddress(forwardReq.Address, f.shellConf.GatewayPorts()), forwardReq.Port))
+	if err != nil {
+		return requested, nil, fmt.Errorf("Unable to listen on %s (%s)", requested, err)
+	}
+	// Port 0 asks for any port so the client is told which one was used
+	port := uint32(listener.Addr().(*net.TCPAddr).Port)
+	var reply []byte
+	if forwardReq.Port == 0 {
+		reply = ssh.Marshal(struct{ Port uint32 }{port})
+	}
+	listening := forwardAddress(forwardReq.Address, port)
+	f.listeners[listening] = listener
+
+	go f.accept(listener, func(tcpConn net.Conn) {
+		originator := tcpConn.RemoteAddr().(*net.TCPAddr)
+		event := audit.Event{Listen: listening, Originator: originator.String()}
+		// See RFC 4254 7.2
+		openForwardChannel(f.conn, f.shellConf, tcpConn, "forwarded-tcpip", ssh.Marshal(struct {
+			Address        string
+			Port           uint32
+			OriginatorIP   string
+			OriginatorPort uint32
+		}{forwardReq.Address, port, originator.IP.String(), uint32(originator.Port)}), event)
+	})
+	return listening, reply, nil
+}
+
+// mayListen returns an error if the client can't listen for connections
+func (f *remoteForwards) mayListen(listen string) error {
+	if !auth.Permitted(connectionPermissions(f.conn), auth.PermitPortForwarding) {
+		return fmt.Errorf("Unable to listen on %s, port forwarding isn't permitted for this key", listen)
+	}
+	if f.shellConf.SharedTerminal() != nil {
+		return fmt.Errorf("Unable to listen on %s, guests can only watch the shared terminal", listen)
+	}
+	if len(f.listeners)+len(f.sockets) >= maxRemoteForwards {
+		return fmt.Errorf("Unable to listen on %s, a connection can only forward %d ports and sockets", listen, maxRemoteForwards)
+	}
+	return nil
+}
+
+// accept opens the listener's connections until it's closed
+func (f *remoteForwards) accept(listener net.Listener, open func(net.Conn)) {
+	for {
+		local, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go open(local)
+	}
+}
+
+// cancel stops listening. It returns the address it was listening on.
+func (f *remoteForwards) cancel(req *ssh.Request) (string, error) {
+	forwardReq, err := payload.ParseTCPIPForward(req.Payload)
+	if err != nil {
+		return "", fmt.Errorf("Unable to parse cancel-tcpip-forward request (%s)", err)
+	}
+	listening := forwardAddress(forwardReq.Address, forwardReq.Port)
+	listener, ok := f.listeners[listening]
+	if !ok {
+		return listening, fmt.Errorf("Unable to cancel forwarding %s, it isn't being forwarded", listening)
+	}
+	delete(f.listeners, listening)
+	return listening, listener.Close()
+}
+
+// closeAll stops listening for all of the forwards
+func (f *remoteForwards) closeAll() {
+	for listening, listener := range f.listeners {
+		_ = listener.Close()
+		delete(f.listeners, listening)
+	}
+	for socketPath, listener := range f.sockets {
+		_ = listener.Close()
+		delete(f.sockets, socketPath)
+	}
+}
@@ -0,0 +1,193 @@
+package sshd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/efarrer/gmash/auth"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createForwardingClient(t *testing.T, options ...ShellOption) (*ssh.Client, func()) {
+	port, closer, err := createTestServer("/bin/bash", options...)
+	assert.NoError(t, err)
+
+	client, err := ssh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &ssh.ClientConfig{
+		User:            "guest",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+
+	return client, func() {
+		_ = client.Close()
+		closer()
+	}
+}
+
+// echo echoes what's sent over the listener's connections
+func echo(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer func() { _ = conn.Close() }()
+			_, _ = io.Copy(conn, conn)
+		}()
+	}
+}
+
+// assertEchoes asserts that a connection to the address is echoed
+func assertEchoes(t *testing.T, network, addr string) {
+	conn, err := net.Dial(network, addr)
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.(interface{ CloseWrite() error }).CloseWrite())
+	data, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestRemoteForward_ForwardsConnectionsToTheClient(t *testing.T) {
+	client, closer := createForwardingClient(t)
+	defer closer()
+
+	remote, err := client.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer remote.Close()
+	go echo(remote)
+
+	assertEchoes(t, "tcp", remote.Addr().String())
+	assertEchoes(t, "tcp", remote.Addr().String())
+}
+
+func TestRemoteForward_CancelStopsListening(t *testing.T) {
+	client, closer := createForwardingClient(t)
+	defer closer()
+
+	remote, err := client.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := remote.Addr().String()
+	assert.NoError(t, remote.Close())
+
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+}
+
+func TestRemoteForward_StopsListeningWhenTheConnectionDrops(t *testing.T) {
+	client, closer := createForwardingClient(t)
+	defer closer()
+
+	remote, err := client.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := remote.Addr().String()
+	assert.NoError(t, client.Close())
+
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return true
+		}
+		_ = conn.Close()
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRemoteForward_RefusesSharedTerminalGuests(t *testing.T) {
+	client, closer := createForwardingClient(t, WithSharedTerminal(&fakeTerminal{}))
+	defer closer()
+
+	_, err := client.Listen("tcp", "127.0.0.1:0")
+	assert.Error(t, err)
+}
+
+func TestRemoteForward_RefusesKeysWithoutPortForwarding(t *testing.T) {
+	sc := newShellConf()
+	forwards := newRemoteForwards(restrictedConn("", auth.PermitPty), sc)
+
+	_, _, err := forwards.listen(&ssh.Request{Payload: ssh.Marshal(struct {
+		Address string
+		Port    uint32
+	}{"127.0.0.1", 0})})
+
+	assert.Error(t, err)
+	assert.Empty(t, forwards.listeners)
+}
+
+func tcpipForwardReq(address string, port uint32) *ssh.Request {
+	return &ssh.Request{Payload: ssh.Marshal(struct {
+		Address string
+		Port    uint32
+	}{address, port})}
+}
+
+func TestRemoteForward_RefusesPrivilegedPorts(t *testing.T) {
+	forwards := newRemoteForwards(nil, newShellConf())
+
+	_, _, err := forwards.listen(tcpipForwardReq("127.0.0.1", 80))
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "privileged")
+	assert.Empty(t, forwards.listeners)
+}
+
+func TestRemoteForward_RefusesDuplicateForwards(t *testing.T) {
+	forwards := newRemoteForwards(nil, newShellConf())
+	defer forwards.closeAll()
+
+	listening, _, err := forwards.listen(tcpipForwardReq("127.0.0.1", 0))
+	assert.NoError(t, err)
+	_, port, err := net.SplitHostPort(listening)
+	assert.NoError(t, err)
+	portNum, err := strconv.Atoi(port)
+	assert.NoError(t, err)
+
+	_, _, err = forwards.listen(tcpipForwardReq("127.0.0.1", uint32(portNum)))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "already being forwarded")
+	assert.Len(t, forwards.listeners, 1)
+}
+
+func TestRemoteForward_LimitsForwardsPerConnection(t *testing.T) {
+	forwards := newRemoteForwards(nil, newShellConf())
+	defer forwards.closeAll()
+
+	for i := 0; i < maxRemoteForwards; i++ {
+		_, _, err := forwards.listen(tcpipForwardReq("127.0.0.1", 0))
+		assert.NoError(t, err)
+	}
+	_, _, err := forwards.listen(tcpipForwardReq("127.0.0.1", 0))
+	assert.Error(t, err)
+	assert.Len(t, forwards.listeners, maxRemoteForwards)
+}
+
+func TestRemoteForward_RefusesToCancelUnknownForwards(t *testing.T) {
+	forwards := newRemoteForwards(nil, newShellConf())
+
+	listening, err := forwards.cancel(&ssh.Request{Payload: ssh.Marshal(struct {
+		Address string
+		Port    uint32
+	}{"127.0.0.1", 8080})})
+
+	assert.Error(t, err)
+	assert.Equal(t, "127.0.0.1:8080", listening)
+}
+
+func TestBindAddress_OnlyListensOnLoopbackByDefault(t *testing.T) {
+	assert.Equal(t, "127.0.0.1", bindAddress("0.0.0.0", false))
+	assert.Equal(t, "127.0.0.1", bindAddress("", false))
+	assert.Equal(t, "0.0.0.0", bindAddress("0.0.0.0", true))
+	assert.Equal(t, "", bindAddress("*", true))
+	assert.Equal(t, "localhost", bindAddress("localhost", true))
+}
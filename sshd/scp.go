@@ -0,0 +1,73 @@
+package sshd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/efarrer/gmash/scp"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SCPCommandHandler creates a CommandHandler that serves "scp -t" and
+// "scp -f" commands in process so scp clients work even if scp isn't
+// installed. If root isn't empty transfers are restricted to the files under
+// root, which is also used as the home directory, and other scp commands are
+// refused instead of being run by the shell where they could reach any file.
+func SCPCommandHandler(root string) (CommandHandler, error) {
+	resolve, err := scpResolver(root)
+	if err != nil {
+		return nil, err
+	}
+	return func(command string) Subsystem {
+		cmd, ok := scp.ParseCommand(command)
+		if !ok && root != "" && scp.IsCommand(command) {
+			return func(channel ssh.Channel) error {
+				err := fmt.Errorf("Unable to run %s, only scp -t and -f transfers are allowed with an scp root", command)
+				_, _ = fmt.Fprintf(channel.Stderr(), "scp: %s\n", err)
+				return err
+			}
+		}
+		if !ok {
+			return nil
+		}
+		return func(channel ssh.Channel) error {
+			return scp.Serve(cmd, channel, resolve)
+		}
+	}, nil
+}
+
+// scpResolver creates the scp.Resolver for root. Without a remote shell "~"
+// has to be expanded by the resolver.
+func scpResolver(root string) (scp.Resolver, error) {
+	if root == "" {
+		return func(p string) (string, error) {
+			if p != "~" && !strings.HasPrefix(p, "~/") {
+				return p, nil
+			}
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", err
+			}
+			return filepath.Join(home, strings.TrimPrefix(p, "~")), nil
+		}, nil
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find the scp root %s (%s)", root, err)
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find the scp root %s (%s)", root, err)
+	}
+	fs := &rootedFS{root: root}
+	return func(p string) (string, error) {
+		if p == "~" || strings.HasPrefix(p, "~/") {
+			p = p[1:]
+		}
+		return fs.resolve(p, true)
+	}, nil
+}
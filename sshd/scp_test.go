@@ -0,0 +1,130 @@
+package sshd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// runSCP runs the legacy scp client against a server that can only run scp in
+// process
+func runSCP(t *testing.T, root string, args ...string) ([]byte, error) {
+	handler, err := SCPCommandHandler(root)
+	assert.NoError(t, err)
+	port, closer, err := createTestServer("/bin/false", WithCommandHandler(handler))
+	assert.NoError(t, err)
+	defer closer()
+
+	args = append([]string{"-O", "-o", "UserKnownHostsFile=/dev/null", "-o", "StrictHostKeyChecking=no", "-P", strconv.Itoa(port)}, args...)
+	return exec.Command("/usr/bin/scp", args...).CombinedOutput()
+}
+
+func TestSCPCommandHandler_FailsWithMissingRoot(t *testing.T) {
+	handler, err := SCPCommandHandler("/does/not/exist")
+	assert.Nil(t, handler)
+	assert.Error(t, err)
+}
+
+func TestSCPCommandHandler_IgnoresOtherCommands(t *testing.T) {
+	handler, err := SCPCommandHandler("")
+	assert.NoError(t, err)
+	assert.Nil(t, handler("ls -l"))
+	assert.NotNil(t, handler("scp -t ."))
+	assert.Nil(t, handler("scp -x -t ."))
+}
+
+// stderrChannel is a fakeChannel that records what's written to stderr
+type stderrChannel struct {
+	*fakeChannel
+	stderr *bytes.Buffer
+}
+
+func (c stderrChannel) Stderr() io.ReadWriter {
+	return c.stderr
+}
+
+func TestSCPCommandHandler_RefusesOtherSCPCommandsWithRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "scp-root")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(root) }()
+	handler, err := SCPCommandHandler(root)
+	assert.NoError(t, err)
+
+	assert.Nil(t, handler("ls -l"))
+	for _, command := range []string{"scp -x -t .", "/usr/bin/scp -t", "scp -f 'unterminated"} {
+		subsystem := handler(command)
+		assert.NotNil(t, subsystem, command)
+		if subsystem == nil {
+			continue
+		}
+		channel := stderrChannel{newFakeChannel([]byte{}, nil), &bytes.Buffer{}}
+		assert.Error(t, subsystem(channel), command)
+		assert.Contains(t, channel.stderr.String(), "only scp -t and -f transfers are allowed", command)
+	}
+}
+
+func TestIntegration_SCPCopiesFiles(t *testing.T) {
+	local, err := ioutil.TempDir("", "scp-local")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(local) }()
+	remote, err := ioutil.TempDir("", "scp-remote")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(remote) }()
+
+	assert.NoError(t, os.Mkdir(path.Join(local, "dir"), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(local, "dir", "a file.txt"), []byte("hello"), 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(local, "dir", "b.txt"), []byte("hello"), 0644))
+
+	output, err := runSCP(t, "", "-r", "-p", path.Join(local, "dir"), "localhost:"+remote)
+	assert.NoError(t, err, string(output))
+	data, err := ioutil.ReadFile(path.Join(remote, "dir", "a file.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	output, err = runSCP(t, "", "localhost:"+path.Join(remote, "dir", "b.txt"), path.Join(local, "copy.txt"))
+	assert.NoError(t, err, string(output))
+	data, err = ioutil.ReadFile(path.Join(local, "copy.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestIntegration_SCPIsRestrictedToRoot(t *testing.T) {
+	local, err := ioutil.TempDir("", "scp-local")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(local) }()
+	root, err := ioutil.TempDir("", "scp-root")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(root) }()
+
+	assert.NoError(t, ioutil.WriteFile(path.Join(local, "a.txt"), []byte("hello"), 0644))
+	assert.NoError(t, os.Symlink(local, path.Join(root, "escape")))
+	assert.NoError(t, os.Symlink(path.Join(local, "created.txt"), path.Join(root, "dangling.txt")))
+
+	// Absolute paths are within root
+	output, err := runSCP(t, root, path.Join(local, "a.txt"), "localhost:/b.txt")
+	assert.NoError(t, err, string(output))
+	data, err := ioutil.ReadFile(path.Join(root, "b.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	// Paths can't escape root
+	_, err = runSCP(t, root, "localhost:../"+path.Base(local)+"/a.txt", path.Join(local, "c.txt"))
+	assert.Error(t, err)
+	_, err = runSCP(t, root, "localhost:escape/a.txt", path.Join(local, "c.txt"))
+	assert.Error(t, err)
+	_, err = os.Stat(path.Join(local, "c.txt"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Dangling symbolic links can't be used to create files outside of root
+	_, err = runSCP(t, root, path.Join(local, "a.txt"), "localhost:/dangling.txt")
+	assert.Error(t, err)
+	_, err = os.Lstat(path.Join(local, "created.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,428 @@
+package sshd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/efarrer/gmash/auth"
+	"github.com/efarrer/gmash/payload"
+	"github.com/efarrer/gmash/ptyutils"
+	"github.com/efarrer/gmash/recording"
+
+	"github.com/kr/pty"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The size of a recording when the client doesn't give the PTY's size
+const (
+	defaultRecordingWidth  = 80
+	defaultRecordingHeight = 24
+)
+
+type sessionState int
+
+const (
+	// The client is configuring the session with pty-req and env requests
+	sessionSetup sessionState = iota
+	// A shell, command, or subsystem has been started
+	sessionRunning
+)
+
+// A session holds the state of a single "session" channel (See RFC 4254 6).
+// Requests are handled sequentially so the state isn't locked.
+type session struct {
+	id        string
+	channel   ssh.Channel
+	conn      *ssh.ServerConn
+	shellConf ShellConf
+	state     sessionState
+	ptyReq    *payload.PtyConfig
+	// The variables the client set with env requests
+	clientEnv []string
+	// The variables set for the session's own features
+	env      []string
+	ptyFile  *os.File
+	cmd      *exec.Cmd
+	recorder *recording.Recorder
+	// The socket for the client's agent if it's forwarded
+	agent *agentForward
+	// The display for the client's X server if it's forwarded
+	x11 *x11Forward
+}
+
+// newSessionID returns a unique ID for a session that sorts by when the
+// session started
+func newSessionID() string {
+	random := make([]byte, 4)
+	_, _ = rand.Read(random)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(random)
+}
+
+func newSession(channel ssh.Channel, conn *ssh.ServerConn, shellConf ShellConf) *session {
+	return &session{
+		id:        newSessionID(),
+		channel:   channel,
+		conn:      conn,
+		shellConf: shellConf,
+		state:     sessionSetup,
+	}
+}
+
+// started returns true once a shell, command, or subsystem has been started
+func (s *session) started() bool {
+	return s.state != sessionSetup
+}
+
+// permissions returns the permissions granted when the client authenticated
+func (s *session) permissions() *ssh.Permissions {
+	return connectionPermissions(s.conn)
+}
+
+// forcedCommand returns the command the client is restricted to or "" if the
+// client can run any command
+func (s *session) forcedCommand() string {
+	perms := s.permissions()
+	if perms == nil {
+		return ""
+	}
+	return perms.CriticalOptions[auth.ForceCommand]
+}
+
+// environ returns the environment for commands started by the session. Later
+// variables replace earlier ones so the client can't replace the variables
+// that are set by gmash.
+func (s *session) environ() []string {
+	env := append(os.Environ(), s.clientEnv...)
+	if s.ptyReq != nil && s.ptyReq.TtyType != "" {
+		env = append(env, "TERM="+s.ptyReq.TtyType)
+	}
+	env = append(env, s.env...)
+	env = append(env, s.shellConf.Env()...)
+	return append(env, "GMASH_SESSION_ID="+s.id, "GMASH_GUEST="+s.guest())
+}
+
+// start runs the command attached to a PTY if one was requested otherwise
+// the command's stdin, stdout, and stderr are connected with pipes
+func (s *session) start(cmd *exec.Cmd) error {
+	if s.started() {
+		return fmt.Errorf("Unable to start %s the session has already started", cmd.Path)
+	}
+
+	cmd.Env = s.environ()
+	var err error
+	if s.ptyReq != nil {
+		err = s.startPty(cmd)
+	} else {
+		err = s.startPipes(cmd)
+	}
+	if err != nil {
+		return err
+	}
+	s.cmd = cmd
+	s.state = sessionRunning
+	return nil
+}
+
+// startSubsystem serves the subsystem over the channel
+func (s *session) startSubsystem(name string, subsystem Subsystem) error {
+	if s.started() {
+		return fmt.Errorf("Unable to start subsystem %s the session has already started", name)
+	}
+	s.state = sessionRunning
+
+	go func() {
+		err := subsystem(s.channel)
+		if err != nil {
+			s.shellConf.ErrorHandler(fmt.Errorf("Subsystem %s failed (%s)", name, err))
+		}
+		s.exit(err)
+	}()
+	return nil
+}
+
+// guest describes the client for the host
+func (s *session) guest() string {
+	if s.conn == nil || s.conn.Conn == nil {
+		return "guest"
+	}
+	return fmt.Sprintf("%s@%s", s.conn.User(), s.conn.RemoteAddr())
+}
+
+// joinTerminal shows the shared terminal to the client
+func (s *session) joinTerminal(terminal SharedTerminal) error {
+	if s.started() {
+		return fmt.Errorf("Unable to join the shared terminal the session has already started")
+	}
+	s.state = sessionRunning
+
+	go func() {
+		s.exit(terminal.Join(s.guest(), s.channel))
+	}()
+	return nil
+}
+
+// record starts recording the session if recording is enabled
+func (s *session) record(cmd *exec.Cmd) error {
+	conf := s.shellConf.Recording()
+	if conf.Dir == "" {
+		return nil
+	}
+	header := recording.Header{
+		Width:  int(s.ptyReq.WidthChars),
+		Height: int(s.ptyReq.HeightRows),
+		Title:  s.guest(),
+		Env:    map[string]string{"SHELL": cmd.Path},
+	}
+	if header.Width == 0 || header.Height == 0 {
+		header.Width, header.Height = defaultRecordingWidth, defaultRecordingHeight
+	}
+	if s.ptyReq.TtyType != "" {
+		header.Env["TERM"] = s.ptyReq.TtyType
+	}
+	recorder, err := recording.Create(conf.Dir, s.id, header)
+	if err != nil {
+		return err
+	}
+	s.recorder = recorder
+	return nil
+}
+
+func (s *session) startPty(cmd *exec.Cmd) error {
+	// Sessions are only started if they can be recorded
+	err := s.record(cmd)
+	if err != nil {
+		return err
+	}
+
+	var ptyFile *os.File
+	// Per RFC 4254 6.2 zero dimensions are ignored
+	if s.ptyReq.WidthChars == 0 || s.ptyReq.HeightRows == 0 {
+		ptyFile, err = pty.Start(cmd)
+	} else {
+		ptyFile, err = ptyutils.StartWithSize(cmd, int(s.ptyReq.WidthChars), int(s.ptyReq.HeightRows), int(s.ptyReq.WidthPixels), int(s.ptyReq.HeightPixels))
+	}
+	if err != nil {
+		if s.recorder != nil {
+			_ = s.recorder.Close()
+			_ = os.Remove(s.recorder.Path())
+			s.recorder = nil
+		}
+		return fmt.Errorf("Unable to create pty request (%s)", err)
+	}
+	s.ptyFile = ptyFile
+
+	var output io.Writer = s.channel
+	var input io.Reader = s.channel
+	if s.recorder != nil {
+		output = io.MultiWriter(s.channel, s.recorder.Output())
+		if s.shellConf.Recording().Input {
+			input = io.TeeReader(s.channel, s.recorder.Input())
+		}
+	}
+
+	outputDoneCh := make(chan struct{})
+	// Note that channel is a ReadWriter to handling the requests stdin and
+	// stdout. Stderr is with channel.Stderr()
+	go func() {
+		_, _ = io.Copy(output, ptyFile)
+		close(outputDoneCh)
+	}()
+	// A PTY can't be half closed so the client closing stdin doesn't end the
+	// session. The session ends once the command exits or the channel is closed.
+	go func() {
+		_, _ = io.Copy(ptyFile, input)
+	}()
+
+	go func() {
+		// Reading from the pty fails once the command (and anything else
+		// attached to the pty) has exited.
+		<-outputDoneCh
+		s.exit(cmd.Wait())
+		ptyFile.Close()
+	}()
+
+	return nil
+}
+
+func (s *session) startPipes(cmd *exec.Cmd) error {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("Unable to create stdin pipe (%s)", err)
+	}
+	// exec.Cmd copies stdout and stderr and Wait won't return until all of
+	// the output has been sent
+	cmd.Stdout = s.channel
+	cmd.Stderr = s.channel.Stderr()
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("Unable to start %s (%s)", cmd.Path, err)
+	}
+
+	// Pass on the client's EOF by closing stdin
+	go func() {
+		_, _ = io.Copy(stdin, s.channel)
+		stdin.Close()
+	}()
+
+	go func() {
+		s.exit(cmd.Wait())
+	}()
+
+	return nil
+}
+
+// exit finishes the recording, reports the commands exit status and closes
+// the channel
+func (s *session) exit(waitErr error) {
+	end := SessionEnd{ID: s.id, Guest: s.guest(), Err: waitErr}
+	if s.recorder != nil {
+		end.Recording = s.recorder.Path()
+		err := s.recorder.Close()
+		if err != nil {
+			s.shellConf.ErrorHandler(err)
+		}
+	}
+	s.shellConf.SessionEnded(end)
+
+	_ = s.channel.CloseWrite()
+	_ = sendExitStatus(s.channel, waitErr)
+	_ = s.channel.Close()
+}
+
+// hangup stops the command once the channel has been closed by the client
+func (s *session) hangup() {
+	if s.agent != nil {
+		s.agent.close()
+	}
+	if s.x11 != nil {
+		s.x11.close()
+	}
+	if s.ptyFile != nil {
+		s.ptyFile.Close()
+		return
+	}
+	if s.cmd != nil {
+		_ = s.cmd.Process.Signal(syscall.SIGHUP)
+		return
+	}
+	// Subsystems use the channel directly so they are stopped by the channel
+	// closing
+}
+
+// setWindowSize resizes the PTY. Per RFC 4254 6.2 zero dimensions are
+// ignored so a PTY is only resized if the character dimensions are set.
+func setWindowSize(ptyFile *os.File, widthChars, heightRows, widthPixels, heightPixels uint32) error {
+	if widthChars == 0 || heightRows == 0 {
+		return nil
+	}
+	return ptyutils.SetWindowGeometry(ptyFile, int(widthChars), int(heightRows), int(widthPixels), int(heightPixels))
+}
+
+func _handlePtyRequest(sess *session, req *ssh.Request) error {
+	if sess.started() {
+		return fmt.Errorf("Unable to allocate a pty after the session has started")
+	}
+	if !auth.Permitted(sess.permissions(), auth.PermitPty) {
+		return fmt.Errorf("Unable to allocate a pty, it isn't permitted for this key")
+	}
+	ptyReq, err := payload.ParsePtyReq(req.Payload)
+	if err != nil {
+		return fmt.Errorf("Unable to parse pty request (%s)", err)
+	}
+	sess.ptyReq = ptyReq
+	return nil
+}
+
+func _handleEnvRequest(sess *session, req *ssh.Request) error {
+	if sess.started() {
+		return fmt.Errorf("Unable to set the environment after the session has started")
+	}
+	envReq, err := payload.ParseEnvReq(req.Payload)
+	if err != nil {
+		return fmt.Errorf("Unable to parse env request (%s)", err)
+	}
+	// Clients send LANG and LC_* by default so refusals aren't reported
+	err = sess.shellConf.AllowEnv(envReq.Name)
+	if err != nil {
+		return declinedRequest{err}
+	}
+	sess.clientEnv = append(sess.clientEnv, envReq.Name+"="+envReq.Value)
+	return nil
+}
+
+func _handleShellRequest(sess *session, req *ssh.Request) error {
+	if forced := sess.forcedCommand(); forced != "" {
+		return sess.start(exec.Command(sess.shellConf.Shell(), "-c", forced))
+	}
+	if terminal := sess.shellConf.SharedTerminal(); terminal != nil {
+		return sess.joinTerminal(terminal)
+	}
+	return sess.start(exec.Command(sess.shellConf.Shell()))
+}
+
+func _handleExecRequest(sess *session, req *ssh.Request) error {
+	execReq, err := payload.ParseExecReq(req.Payload)
+	if err != nil {
+		return fmt.Errorf("Unable to parse exec request (%s)", err)
+	}
+	// Like sshd the client's command is available to a forced command
+	if forced := sess.forcedCommand(); forced != "" && !sess.started() {
+		sess.env = append(sess.env, "SSH_ORIGINAL_COMMAND="+execReq.Command)
+		return sess.start(exec.Command(sess.shellConf.Shell(), "-c", forced))
+	}
+	if sess.shellConf.SharedTerminal() != nil {
+		return fmt.Errorf("Unable to run %s, guests can only watch the shared terminal", execReq.Command)
+	}
+	if handler := sess.shellConf.Command(execReq.Command); handler != nil {
+		return sess.startSubsystem(execReq.Command, handler)
+	}
+	return sess.start(exec.Command(sess.shellConf.Shell(), "-c", execReq.Command))
+}
+
+func _handleSubsystemRequest(sess *session, req *ssh.Request) error {
+	subsystemReq, err := payload.ParseSubsystemReq(req.Payload)
+	if err != nil {
+		return fmt.Errorf("Unable to parse subsystem request (%s)", err)
+	}
+	if sess.forcedCommand() != "" {
+		return fmt.Errorf("Unable to start subsystem %s, only a forced command is permitted", subsystemReq.Name)
+	}
+	if sess.shellConf.SharedTerminal() != nil {
+		return fmt.Errorf("Unable to start subsystem %s, guests can only watch the shared terminal", subsystemReq.Name)
+	}
+	subsystem := sess.shellConf.Subsystem(subsystemReq.Name)
+	if subsystem == nil {
+		return fmt.Errorf("Unsupported subsystem %s", subsystemReq.Name)
+	}
+	return sess.startSubsystem(subsystemReq.Name, subsystem)
+}
+
+func _handleWindowChange(sess *session, req *ssh.Request) error {
+	if sess.shellConf.SharedTerminal() != nil {
+		// The shared terminal is the size of the host's terminal
+		return nil
+	}
+	if sess.ptyFile == nil {
+		return fmt.Errorf("Unable to change window size without a pty")
+	}
+	windowChange, err := payload.ParseWindowChange(req.Payload)
+	if err != nil {
+		return fmt.Errorf("Unable to parse window-change request (%s)", err)
+	}
+	err = setWindowSize(sess.ptyFile, windowChange.WidthChars, windowChange.HeightRows, windowChange.WidthPixels, windowChange.HeightPixels)
+	if err != nil {
+		return fmt.Errorf("Unable to change window size (%s)", err)
+	}
+	if sess.recorder != nil && windowChange.WidthChars != 0 && windowChange.HeightRows != 0 {
+		sess.recorder.Resize(int(windowChange.WidthChars), int(windowChange.HeightRows))
+	}
+	return nil
+}
@@ -0,0 +1,568 @@
+package sshd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/efarrer/gmash/auth"
+	"github.com/efarrer/gmash/payload"
+	"github.com/efarrer/gmash/ptyutils"
+	"github.com/efarrer/gmash/recording"
+
+	"github.com/kr/pty"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var ptyPayload = []byte{
+	0x0, 0x0, 0x0, 0x1, 0x3b, // tty type
+	0x0, 0x0, 0x0, 0x0A, // width chars
+	0x0, 0x0, 0x0, 0xA0, // height columns
+	0x0, 0x0, 0x0, 0x0, // width pixels
+	0x0, 0x0, 0x0, 0x0, // terminal modes
+}
+
+func execPayload(command string) []byte {
+	return ssh.Marshal(&struct{ Command string }{command})
+}
+
+func TestHandlePtyRequest_WithInvalidPtyPayloadReturnsError(t *testing.T) {
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, newShellConf())
+
+	err := handlePtyRequest(sess, &ssh.Request{})
+
+	assert.Error(t, err)
+	assert.Nil(t, sess.ptyReq)
+}
+
+func TestHandlePtyRequest_RecordsPtyConfig(t *testing.T) {
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, newShellConf())
+
+	err := handlePtyRequest(sess, &ssh.Request{Payload: ptyPayload})
+
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(10), sess.ptyReq.WidthChars)
+	assert.Equal(t, uint32(160), sess.ptyReq.HeightRows)
+	assert.False(t, sess.started())
+}
+
+func TestHandlePtyRequest_FailsAfterSessionStarted(t *testing.T) {
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, newShellConf())
+	sess.state = sessionRunning
+
+	err := handlePtyRequest(sess, &ssh.Request{Payload: ptyPayload})
+
+	assert.Error(t, err)
+}
+
+func TestHandleShellRequest_WithoutPtyUsesPipes(t *testing.T) {
+	channel := newFakeChannel([]byte("echo hi\n"), nil)
+	sess := newSession(channel, nil, newShellConf())
+
+	err := handleShellRequest(sess, &ssh.Request{})
+	assert.NoError(t, err)
+
+	<-channel.closed
+	assert.Nil(t, sess.ptyFile)
+	assert.Equal(t, "hi\n", string(channel.Bytes()))
+	assert.Equal(t, []string{"exit-status"}, channel.Requests())
+}
+
+func TestHandleShellRequest_SetsTermFromPtyRequest(t *testing.T) {
+	channel := newFakeChannel([]byte{}, nil)
+	sess := newSession(channel, nil, newShellConf())
+	assert.NoError(t, handlePtyRequest(sess, &ssh.Request{Payload: ptyPayload}))
+
+	err := handleExecRequest(sess, &ssh.Request{Payload: execPayload("echo $TERM")})
+	assert.NoError(t, err)
+
+	<-channel.closed
+	assert.Contains(t, string(channel.Bytes()), ";")
+}
+
+func TestHandleShellRequest_WithInvalidShellReturnsError(t *testing.T) {
+	sc := newShellConf()
+	sc.shell = "/"
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, sc)
+	assert.NoError(t, handlePtyRequest(sess, &ssh.Request{Payload: ptyPayload}))
+
+	err := handleShellRequest(sess, &ssh.Request{})
+
+	assert.Error(t, err)
+	assert.False(t, sess.started())
+}
+
+func TestHandleShellRequest_HappyPath(t *testing.T) {
+	bin, closer, err := createTestBinary()
+	assert.NoError(t, err)
+	defer closer()
+
+	sc := newShellConf()
+	sc.shell = bin
+	channel := newFakeChannel([]byte{}, nil)
+	sess := newSession(channel, nil, sc)
+	assert.NoError(t, handlePtyRequest(sess, &ssh.Request{Payload: ptyPayload}))
+
+	err = handleShellRequest(sess, &ssh.Request{})
+	assert.NoError(t, err)
+	assert.True(t, sess.started())
+
+	<-channel.closed
+	assert.Contains(t, string(channel.Bytes()), "hi")
+	assert.Equal(t, []string{"exit-status"}, channel.Requests())
+}
+
+func TestHandleExecRequest_WithInvalidPayloadReturnsError(t *testing.T) {
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, newShellConf())
+
+	err := handleExecRequest(sess, &ssh.Request{})
+
+	assert.Error(t, err)
+	assert.False(t, sess.started())
+}
+
+func TestHandleExecRequest_RunsCommandWithoutPty(t *testing.T) {
+	channel := newFakeChannel([]byte("from stdin"), nil)
+	sess := newSession(channel, nil, newShellConf())
+
+	err := handleExecRequest(sess, &ssh.Request{Payload: execPayload("cat; exit 3")})
+	assert.NoError(t, err)
+
+	<-channel.closed
+	assert.Nil(t, sess.ptyFile)
+	assert.Equal(t, "from stdin", string(channel.Bytes()))
+	assert.Equal(t, []string{"exit-status"}, channel.Requests())
+}
+
+func TestHandleExecRequest_RunsCommandWithPty(t *testing.T) {
+	channel := newFakeChannel([]byte{}, nil)
+	sess := newSession(channel, nil, newShellConf())
+	assert.NoError(t, handlePtyRequest(sess, &ssh.Request{Payload: ptyPayload}))
+
+	err := handleExecRequest(sess, &ssh.Request{Payload: execPayload("stty size")})
+	assert.NoError(t, err)
+
+	<-channel.closed
+	assert.NotNil(t, sess.ptyFile)
+	assert.Contains(t, string(channel.Bytes()), "160 10")
+}
+
+func TestHandleExecRequest_FailsIfAlreadyStarted(t *testing.T) {
+	channel := newFakeChannel([]byte{}, nil)
+	sess := newSession(channel, nil, newShellConf())
+	assert.NoError(t, handleExecRequest(sess, &ssh.Request{Payload: execPayload("true")}))
+
+	err := handleExecRequest(sess, &ssh.Request{Payload: execPayload("true")})
+
+	assert.Error(t, err)
+	<-channel.closed
+}
+
+func envPayload(name, value string) []byte {
+	return ssh.Marshal(&struct{ Name, Value string }{name, value})
+}
+
+func TestHandleEnvRequest_WithInvalidPayloadReturnsError(t *testing.T) {
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, newShellConf())
+
+	err := handleEnvRequest(sess, &ssh.Request{})
+
+	assert.Error(t, err)
+	assert.Empty(t, sess.clientEnv)
+}
+
+func TestHandleEnvRequest_IgnoresUnacceptedVariables(t *testing.T) {
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, newShellConf())
+
+	err := handleEnvRequest(sess, &ssh.Request{Payload: envPayload("LD_PRELOAD", "evil.so")})
+
+	assert.Error(t, err)
+	assert.Empty(t, sess.clientEnv)
+}
+
+func TestHandleEnvRequest_FailsAfterSessionStarted(t *testing.T) {
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, newShellConf())
+	sess.state = sessionRunning
+
+	err := handleEnvRequest(sess, &ssh.Request{Payload: envPayload("LANG", "C")})
+
+	assert.Error(t, err)
+	assert.Empty(t, sess.clientEnv)
+}
+
+func TestHandleEnvRequest_PassesVariablesToCommand(t *testing.T) {
+	channel := newFakeChannel([]byte{}, nil)
+	sess := newSession(channel, nil, newShellConf())
+	assert.NoError(t, handleEnvRequest(sess, &ssh.Request{Payload: envPayload("LANG", "en_US.UTF-8")}))
+	assert.NoError(t, handleEnvRequest(sess, &ssh.Request{Payload: envPayload("LC_ALL", "C")}))
+
+	err := handleExecRequest(sess, &ssh.Request{Payload: execPayload("echo $LANG $LC_ALL")})
+	assert.NoError(t, err)
+
+	<-channel.closed
+	assert.Equal(t, "en_US.UTF-8 C\n", string(channel.Bytes()))
+}
+
+func TestHandleEnvRequest_UsesTheClientsTermWithoutAPty(t *testing.T) {
+	channel := newFakeChannel([]byte{}, nil)
+	sess := newSession(channel, nil, newShellConf())
+	assert.NoError(t, handleEnvRequest(sess, &ssh.Request{Payload: envPayload("TERM", "xterm-256color")}))
+
+	err := handleExecRequest(sess, &ssh.Request{Payload: execPayload("echo $TERM")})
+	assert.NoError(t, err)
+
+	<-channel.closed
+	assert.Equal(t, "xterm-256color\n", string(channel.Bytes()))
+}
+
+func TestEnviron_ThePtyTermReplacesTheClientsTerm(t *testing.T) {
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, newShellConf())
+	sess.ptyReq = &payload.PtyConfig{TtyType: "vt100"}
+	assert.NoError(t, handleEnvRequest(sess, &ssh.Request{Payload: envPayload("TERM", "xterm-256color")}))
+
+	env := sess.environ()
+
+	assert.Equal(t, "TERM=vt100", lastEnv(env, "TERM"))
+}
+
+func TestEnviron_SetsTheHostsVariablesLast(t *testing.T) {
+	sc := newShellConf()
+	sc.env = []string{"LANG=C.UTF-8", "EDITOR=vim"}
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, sc)
+	assert.NoError(t, handleEnvRequest(sess, &ssh.Request{Payload: envPayload("LANG", "en_US.UTF-8")}))
+	assert.NoError(t, handleEnvRequest(sess, &ssh.Request{Payload: envPayload("LC_GMASH", "x")}))
+
+	env := sess.environ()
+
+	assert.Equal(t, "LANG=C.UTF-8", lastEnv(env, "LANG"))
+	assert.Equal(t, "EDITOR=vim", lastEnv(env, "EDITOR"))
+	assert.Equal(t, "LC_GMASH=x", lastEnv(env, "LC_GMASH"))
+	assert.Equal(t, "GMASH_SESSION_ID="+sess.id, lastEnv(env, "GMASH_SESSION_ID"))
+	assert.Equal(t, "GMASH_GUEST=guest", lastEnv(env, "GMASH_GUEST"))
+}
+
+// lastEnv returns the last NAME=VALUE for the name, which is the one commands
+// see
+func lastEnv(env []string, name string) string {
+	last := ""
+	for _, v := range env {
+		if strings.HasPrefix(v, name+"=") {
+			last = v
+		}
+	}
+	return last
+}
+
+func subsystemPayload(name string) []byte {
+	return ssh.Marshal(&struct{ Name string }{name})
+}
+
+func TestHandleSubsystemRequest_WithInvalidPayloadReturnsError(t *testing.T) {
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, newShellConf())
+
+	err := handleSubsystemRequest(sess, &ssh.Request{})
+
+	assert.Error(t, err)
+	assert.False(t, sess.started())
+}
+
+func TestHandleSubsystemRequest_WithUnknownSubsystemReturnsError(t *testing.T) {
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, newShellConf())
+
+	err := handleSubsystemRequest(sess, &ssh.Request{Payload: subsystemPayload("bogus")})
+
+	assert.Error(t, err)
+	assert.False(t, sess.started())
+}
+
+func TestHandleSubsystemRequest_ServesSubsystem(t *testing.T) {
+	sc := newShellConf()
+	sc.subsystems = map[string]Subsystem{
+		"echo": func(channel ssh.Channel) error {
+			_, err := io.Copy(channel, channel)
+			return err
+		},
+	}
+	channel := newFakeChannel([]byte("hi"), nil)
+	sess := newSession(channel, nil, sc)
+
+	err := handleSubsystemRequest(sess, &ssh.Request{Payload: subsystemPayload("echo")})
+	assert.NoError(t, err)
+	assert.True(t, sess.started())
+
+	<-channel.closed
+	assert.Equal(t, "hi", string(channel.Bytes()))
+	assert.Equal(t, []string{"exit-status"}, channel.Requests())
+
+	// Only one subsystem, shell, or command can be started per session
+	err = handleExecRequest(sess, &ssh.Request{Payload: execPayload("true")})
+	assert.Error(t, err)
+}
+
+var windowChangePayload = []byte{
+	0x0, 0x0, 0x0, 0x50, // width chars
+	0x0, 0x0, 0x0, 0x18, // height rows
+	0x0, 0x0, 0x0, 0x0, // width pixels
+	0x0, 0x0, 0x0, 0x0, // height pixels
+}
+
+func TestHandleWindowChange_WithoutPtyReturnsError(t *testing.T) {
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, newShellConf())
+
+	err := handleWindowChange(sess, &ssh.Request{Payload: windowChangePayload})
+
+	assert.Error(t, err)
+}
+
+func TestHandleWindowChange_WithInvalidPayloadReturnsError(t *testing.T) {
+	_pty, tty, err := pty.Open()
+	assert.NoError(t, err)
+	defer func() { _ = _pty.Close() }()
+	defer func() { _ = tty.Close() }()
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, newShellConf())
+	sess.ptyFile = _pty
+
+	err = handleWindowChange(sess, &ssh.Request{Payload: []byte{0x0}})
+
+	assert.Error(t, err)
+}
+
+func TestHandleWindowChange_ResizesPty(t *testing.T) {
+	_pty, tty, err := pty.Open()
+	assert.NoError(t, err)
+	defer func() { _ = _pty.Close() }()
+	defer func() { _ = tty.Close() }()
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, newShellConf())
+	sess.ptyFile = _pty
+
+	err = handleWindowChange(sess, &ssh.Request{Payload: windowChangePayload})
+	assert.NoError(t, err)
+
+	rows, cols, err := pty.Getsize(_pty)
+	assert.NoError(t, err)
+	assert.Equal(t, 80, cols)
+	assert.Equal(t, 24, rows)
+}
+
+func TestHandleWindowChange_IgnoresZeroDimensions(t *testing.T) {
+	_pty, tty, err := pty.Open()
+	assert.NoError(t, err)
+	defer func() { _ = _pty.Close() }()
+	defer func() { _ = tty.Close() }()
+	assert.NoError(t, ptyutils.SetWindowSize(_pty, 100, 50))
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, newShellConf())
+	sess.ptyFile = _pty
+
+	err = handleWindowChange(sess, &ssh.Request{Payload: make([]byte, 16)})
+	assert.NoError(t, err)
+
+	rows, cols, err := pty.Getsize(_pty)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, cols)
+	assert.Equal(t, 50, rows)
+}
+
+func restrictedConn(command string, extensions ...string) *ssh.ServerConn {
+	perms := &ssh.Permissions{
+		CriticalOptions: map[string]string{},
+		Extensions:      map[string]string{},
+	}
+	if command != "" {
+		perms.CriticalOptions[auth.ForceCommand] = command
+	}
+	for _, extension := range extensions {
+		perms.Extensions[extension] = ""
+	}
+	return &ssh.ServerConn{Permissions: perms}
+}
+
+func TestHandlePtyRequest_FailsIfPtyIsNotPermitted(t *testing.T) {
+	sess := newSession(newFakeChannel([]byte{}, nil), restrictedConn(""), newShellConf())
+
+	err := handlePtyRequest(sess, &ssh.Request{Payload: ptyPayload})
+
+	assert.Error(t, err)
+	assert.Nil(t, sess.ptyReq)
+}
+
+func TestHandlePtyRequest_SucceedsIfPtyIsPermitted(t *testing.T) {
+	sess := newSession(newFakeChannel([]byte{}, nil), restrictedConn("", auth.PermitPty), newShellConf())
+
+	err := handlePtyRequest(sess, &ssh.Request{Payload: ptyPayload})
+
+	assert.NoError(t, err)
+	assert.NotNil(t, sess.ptyReq)
+}
+
+func TestHandleExecRequest_RunsForcedCommand(t *testing.T) {
+	channel := newFakeChannel([]byte{}, nil)
+	sess := newSession(channel, restrictedConn("echo forced $SSH_ORIGINAL_COMMAND"), newShellConf())
+
+	err := handleExecRequest(sess, &ssh.Request{Payload: execPayload("ls")})
+	assert.NoError(t, err)
+
+	<-channel.closed
+	assert.Equal(t, "forced ls\n", string(channel.Bytes()))
+}
+
+func TestHandleShellRequest_RunsForcedCommand(t *testing.T) {
+	channel := newFakeChannel([]byte{}, nil)
+	sess := newSession(channel, restrictedConn("echo forced"), newShellConf())
+
+	err := handleShellRequest(sess, &ssh.Request{})
+	assert.NoError(t, err)
+
+	<-channel.closed
+	assert.Equal(t, "forced\n", string(channel.Bytes()))
+}
+
+func TestHandleSubsystemRequest_FailsWithForcedCommand(t *testing.T) {
+	sc := newShellConf()
+	sc.subsystems = map[string]Subsystem{"test": func(ssh.Channel) error { return nil }}
+	sess := newSession(newFakeChannel([]byte{}, nil), restrictedConn("echo forced"), sc)
+
+	err := handleSubsystemRequest(sess, &ssh.Request{Payload: subsystemPayload("test")})
+
+	assert.Error(t, err)
+	assert.False(t, sess.started())
+}
+
+// fakeTerminal is a SharedTerminal that echoes what the guest types
+type fakeTerminal struct {
+	guests []string
+}
+
+func (ft *fakeTerminal) Join(guest string, channel io.ReadWriter) error {
+	ft.guests = append(ft.guests, guest)
+	_, err := io.Copy(channel, channel)
+	return err
+}
+
+func TestHandleShellRequest_JoinsSharedTerminal(t *testing.T) {
+	sc := newShellConf()
+	terminal := &fakeTerminal{}
+	sc.terminal = terminal
+	channel := newFakeChannel([]byte("hi"), nil)
+	sess := newSession(channel, nil, sc)
+
+	err := handleShellRequest(sess, &ssh.Request{})
+	assert.NoError(t, err)
+	assert.True(t, sess.started())
+
+	<-channel.closed
+	assert.Equal(t, []string{"guest"}, terminal.guests)
+	assert.Equal(t, "hi", string(channel.Bytes()))
+	assert.Equal(t, []string{"exit-status"}, channel.Requests())
+}
+
+func TestHandleShellRequest_RunsForcedCommandInsteadOfSharedTerminal(t *testing.T) {
+	sc := newShellConf()
+	terminal := &fakeTerminal{}
+	sc.terminal = terminal
+	channel := newFakeChannel([]byte{}, nil)
+	sess := newSession(channel, restrictedConn("echo forced"), sc)
+
+	err := handleShellRequest(sess, &ssh.Request{})
+	assert.NoError(t, err)
+
+	<-channel.closed
+	assert.Empty(t, terminal.guests)
+	assert.Equal(t, "forced\n", string(channel.Bytes()))
+}
+
+func TestSharedTerminal_RefusesCommandsAndSubsystems(t *testing.T) {
+	sc := newShellConf()
+	sc.terminal = &fakeTerminal{}
+	sc.subsystems = map[string]Subsystem{"test": func(ssh.Channel) error { return nil }}
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, sc)
+
+	assert.Error(t, handleExecRequest(sess, &ssh.Request{Payload: execPayload("true")}))
+	assert.Error(t, handleSubsystemRequest(sess, &ssh.Request{Payload: subsystemPayload("test")}))
+	assert.False(t, sess.started())
+
+	// The shared terminal is the host's size so resizing is ignored
+	assert.NoError(t, handleWindowChange(sess, &ssh.Request{Payload: windowChangePayload}))
+}
+
+func TestHandleExecRequest_RecordsPtySession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recordings")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	sc := newShellConf()
+	sc.recording = RecordingConf{Dir: dir, Input: true}
+	channel := newFakeChannel([]byte("typed\n"), nil)
+	sess := newSession(channel, nil, sc)
+	assert.NoError(t, handlePtyRequest(sess, &ssh.Request{Payload: ptyPayload}))
+
+	err = handleExecRequest(sess, &ssh.Request{Payload: execPayload("head -n 1")})
+	assert.NoError(t, err)
+
+	<-channel.closed
+	assert.Len(t, sc.ended, 1)
+	assert.Equal(t, sess.id, sc.ended[0].ID)
+	assert.Equal(t, path.Join(dir, sess.id+recording.Extension), sc.ended[0].Recording)
+	data, err := ioutil.ReadFile(sc.ended[0].Recording)
+	assert.NoError(t, err)
+	lines := strings.Split(string(data), "\n")
+	assert.Contains(t, lines[0], `"width":10,"height":160`)
+	assert.Contains(t, lines[0], `"TERM":";"`)
+	assert.Contains(t, string(data), `"i","typed\n"]`)
+	assert.Contains(t, string(data), `"o","typed`)
+}
+
+func TestHandleExecRequest_ReportsSessionEndWithoutRecording(t *testing.T) {
+	sc := newShellConf()
+	channel := newFakeChannel([]byte{}, nil)
+	sess := newSession(channel, nil, sc)
+
+	err := handleExecRequest(sess, &ssh.Request{Payload: execPayload("exit 3")})
+	assert.NoError(t, err)
+
+	<-channel.closed
+	assert.Len(t, sc.ended, 1)
+	assert.Equal(t, "guest", sc.ended[0].Guest)
+	assert.Empty(t, sc.ended[0].Recording)
+	assert.Error(t, sc.ended[0].Err)
+}
+
+func TestHandleShellRequest_RefusesSessionsThatCantBeRecorded(t *testing.T) {
+	file, err := ioutil.TempFile("", "recordings")
+	assert.NoError(t, err)
+	defer func() { _ = os.Remove(file.Name()) }()
+	sc := newShellConf()
+	sc.recording = RecordingConf{Dir: file.Name()}
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, sc)
+	assert.NoError(t, handlePtyRequest(sess, &ssh.Request{Payload: ptyPayload}))
+
+	err = handleShellRequest(sess, &ssh.Request{})
+
+	assert.Error(t, err)
+	assert.False(t, sess.started())
+}
+
+func TestHandleWindowChange_RecordsResize(t *testing.T) {
+	_pty, tty, err := pty.Open()
+	assert.NoError(t, err)
+	defer func() { _ = _pty.Close() }()
+	defer func() { _ = tty.Close() }()
+	var cast bytes.Buffer
+	recorder, err := recording.NewRecorder(&cast, recording.Header{Width: 10, Height: 10})
+	assert.NoError(t, err)
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, newShellConf())
+	sess.ptyFile = _pty
+	sess.recorder = recorder
+
+	assert.NoError(t, handleWindowChange(sess, &ssh.Request{Payload: windowChangePayload}))
+	assert.NoError(t, handleWindowChange(sess, &ssh.Request{Payload: make([]byte, 16)}))
+
+	assert.NoError(t, recorder.Close())
+	assert.Equal(t, 1, strings.Count(cast.String(), `"r"`))
+	assert.Contains(t, cast.String(), `"r","80x24"]`)
+}
@@ -0,0 +1,245 @@
+package sshd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTPSubsystem creates a Subsystem that serves the files under root over
+// SFTP. If readOnly is true clients can't modify any files.
+func SFTPSubsystem(root string, readOnly bool) (Subsystem, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find the SFTP root %s (%s)", root, err)
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find the SFTP root %s (%s)", root, err)
+	}
+
+	fs := &rootedFS{root: root, readOnly: readOnly}
+	handlers := sftp.Handlers{
+		FileGet:  fs,
+		FilePut:  fs,
+		FileCmd:  fs,
+		FileList: fs,
+	}
+	return func(channel ssh.Channel) error {
+		server := sftp.NewRequestServer(channel, handlers)
+		err := server.Serve()
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}, nil
+}
+
+// rootedFS implements the sftp handlers for the files under root. SFTP paths
+// are absolute paths within root.
+type rootedFS struct {
+	root     string
+	readOnly bool
+}
+
+// within returns true if the local path p is root or is under root
+func (fs *rootedFS) within(p string) bool {
+	return p == fs.root || strings.HasPrefix(p, fs.root+string(filepath.Separator))
+}
+
+// resolve converts the SFTP path to a local path. Symbolic links are resolved
+// so they can't be used to escape root. If follow is false a symbolic link at
+// the end of the path isn't followed. A dangling symbolic link at the end of
+// the path is refused because creating the file would follow it.
+func (fs *rootedFS) resolve(p string, follow bool) (string, error) {
+	local := filepath.Join(fs.root, filepath.FromSlash(path.Clean("/"+p)))
+	if local == fs.root {
+		return local, nil
+	}
+
+	dir, err := filepath.EvalSymlinks(filepath.Dir(local))
+	if err != nil {
+		return "", err
+	}
+	local = filepath.Join(dir, filepath.Base(local))
+	if follow {
+		resolved, err := filepath.EvalSymlinks(local)
+		if err == nil {
+			local = resolved
+		} else if !os.IsNotExist(err) {
+			return "", err
+		} else if info, lerr := os.Lstat(local); lerr == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", sftp.ErrSSHFxPermissionDenied
+		}
+	}
+	if !fs.within(local) {
+		return "", sftp.ErrSSHFxPermissionDenied
+	}
+	return local, nil
+}
+
+func (fs *rootedFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	local, err := fs.resolve(r.Filepath, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(local)
+}
+
+func (fs *rootedFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if fs.readOnly {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	local, err := fs.resolve(r.Filepath, true)
+	if err != nil {
+		return nil, err
+	}
+
+	pflags := r.Pflags()
+	flags := os.O_WRONLY
+	if pflags.Read {
+		flags = os.O_RDWR
+	}
+	if pflags.Append {
+		flags |= os.O_APPEND
+	}
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	return os.OpenFile(local, flags, 0644)
+}
+
+func (fs *rootedFS) Filecmd(r *sftp.Request) error {
+	if fs.readOnly {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+
+	switch r.Method {
+	case "Setstat":
+		return fs.setstat(r)
+	case "Rename":
+		from, err := fs.resolve(r.Filepath, false)
+		if err != nil {
+			return err
+		}
+		to, err := fs.resolve(r.Target, false)
+		if err != nil {
+			return err
+		}
+		return os.Rename(from, to)
+	case "Rmdir", "Remove":
+		local, err := fs.resolve(r.Filepath, false)
+		if err != nil {
+			return err
+		}
+		return os.Remove(local)
+	case "Mkdir":
+		local, err := fs.resolve(r.Filepath, false)
+		if err != nil {
+			return err
+		}
+		return os.Mkdir(local, 0755)
+	}
+	// Links could point outside of root so they aren't supported
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (fs *rootedFS) setstat(r *sftp.Request) error {
+	local, err := fs.resolve(r.Filepath, true)
+	if err != nil {
+		return err
+	}
+
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+	if flags.Size {
+		err = os.Truncate(local, int64(attrs.Size))
+		if err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		err = os.Chmod(local, attrs.FileMode().Perm())
+		if err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		err = os.Chtimes(local, attrs.AccessTime(), attrs.ModTime())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *rootedFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		local, err := fs.resolve(r.Filepath, true)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := os.ReadDir(local)
+		if err != nil {
+			return nil, err
+		}
+		infos := make([]os.FileInfo, 0, len(entries))
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			infos = append(infos, info)
+		}
+		return listerAt(infos), nil
+	case "Stat":
+		local, err := fs.resolve(r.Filepath, true)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(local)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	case "Lstat":
+		local, err := fs.resolve(r.Filepath, false)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Lstat(local)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// listerAt is a sftp.ListerAt for a slice of FileInfo
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,135 @@
+package sshd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pkg/sftp"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createSFTPClient(t *testing.T, root string, readOnly bool) (*sftp.Client, func()) {
+	subsystem, err := SFTPSubsystem(root, readOnly)
+	assert.NoError(t, err)
+	port, closer, err := createTestServer("/bin/bash", WithSubsystem("sftp", subsystem))
+	assert.NoError(t, err)
+
+	conn, err := ssh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &ssh.ClientConfig{
+		User:            "guest",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	client, err := sftp.NewClient(conn)
+	assert.NoError(t, err)
+
+	return client, func() {
+		_ = client.Close()
+		_ = conn.Close()
+		closer()
+	}
+}
+
+func TestSFTPSubsystem_FailsWithMissingRoot(t *testing.T) {
+	subsystem, err := SFTPSubsystem("/does/not/exist", false)
+	assert.Nil(t, subsystem)
+	assert.Error(t, err)
+}
+
+func TestSFTPSubsystem_ReadsAndWritesFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "sftp")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(root) }()
+	client, closer := createSFTPClient(t, root, false)
+	defer closer()
+
+	file, err := client.Create("/hello.txt")
+	assert.NoError(t, err)
+	_, err = file.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	data, err := ioutil.ReadFile(path.Join(root, "hello.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	file, err = client.Open("hello.txt")
+	assert.NoError(t, err)
+	data, err = ioutil.ReadAll(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	assert.NoError(t, file.Close())
+
+	assert.NoError(t, client.Mkdir("/dir"))
+	assert.NoError(t, client.Rename("/hello.txt", "/dir/hello.txt"))
+	infos, err := client.ReadDir("/dir")
+	assert.NoError(t, err)
+	assert.Len(t, infos, 1)
+	assert.Equal(t, "hello.txt", infos[0].Name())
+
+	assert.NoError(t, client.Chmod("/dir/hello.txt", 0600))
+	info, err := client.Stat("/dir/hello.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	assert.NoError(t, client.Remove("/dir/hello.txt"))
+	assert.NoError(t, client.RemoveDirectory("/dir"))
+	_, err = os.Stat(path.Join(root, "dir"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSFTPSubsystem_CantEscapeRoot(t *testing.T) {
+	parent, err := ioutil.TempDir("", "sftp")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(parent) }()
+	root := path.Join(parent, "root")
+	assert.NoError(t, os.Mkdir(root, 0700))
+	assert.NoError(t, ioutil.WriteFile(path.Join(parent, "secret"), []byte("secret"), 0600))
+	assert.NoError(t, os.Symlink(path.Join(parent, "secret"), path.Join(root, "link")))
+	client, closer := createSFTPClient(t, root, false)
+	defer closer()
+
+	// Parent directories are clamped to root
+	_, err = client.Stat("/../secret")
+	assert.Error(t, err)
+
+	// Symbolic links can't be followed outside of root
+	_, err = client.Open("/link")
+	assert.Error(t, err)
+
+	err = client.Symlink("/etc/passwd", "/passwd")
+	assert.Error(t, err)
+
+	// Dangling symbolic links can't be used to create files outside of root
+	assert.NoError(t, os.Symlink(path.Join(parent, "created"), path.Join(root, "dangling")))
+	_, err = client.Create("/dangling")
+	assert.Error(t, err)
+	_, err = os.Lstat(path.Join(parent, "created"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSFTPSubsystem_ReadOnly(t *testing.T) {
+	root, err := ioutil.TempDir("", "sftp")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(root) }()
+	assert.NoError(t, ioutil.WriteFile(path.Join(root, "hello.txt"), []byte("hello"), 0600))
+	client, closer := createSFTPClient(t, root, true)
+	defer closer()
+
+	file, err := client.Open("/hello.txt")
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	assert.NoError(t, file.Close())
+
+	_, err = client.Create("/new.txt")
+	assert.Error(t, err)
+	assert.Error(t, client.Remove("/hello.txt"))
+	assert.Error(t, client.Mkdir("/dir"))
+}
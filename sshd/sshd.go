@@ -1,25 +1,46 @@
 package sshd
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"os/exec"
+	"sync"
+	"time"
 
+	"github.com/efarrer/gmash/audit"
 	"github.com/efarrer/gmash/payload"
 
-	"github.com/kr/pty"
-
 	"golang.org/x/crypto/ssh"
 )
 
+// errUnsupportedRequest is returned for requests gmash doesn't handle. These
+// are declined without being reported as an error.
+var errUnsupportedRequest = errors.New("unsupported request")
+
+// A declinedRequest is a request that clients routinely send and that's
+// declined for a reason that's only worth auditing, like an environment
+// variable that isn't allowed
+type declinedRequest struct {
+	error
+}
+
 // Using local function vars to facilitate mocks for tests
-var handlePtyRequest func(string, ssh.Channel, *ssh.Request) error
-var handleSSHRequests func(channel ssh.Channel, reqsCh <-chan *ssh.Request, shellConf ShellConf)
-var processSSHChannels func(sshChan <-chan ssh.NewChannel, shellConf ShellConf)
+var handlePtyRequest func(*session, *ssh.Request) error
+var handleShellRequest func(*session, *ssh.Request) error
+var handleExecRequest func(*session, *ssh.Request) error
+var handleSubsystemRequest func(*session, *ssh.Request) error
+var handleEnvRequest func(*session, *ssh.Request) error
+var handleWindowChange func(*session, *ssh.Request) error
+var handleAgentRequest func(*session, *ssh.Request) error
+var handleX11Request func(*session, *ssh.Request) error
+var handleSSHRequests func(channel ssh.Channel, reqsCh <-chan *ssh.Request, conn *ssh.ServerConn, shellConf ShellConf)
+var processSSHChannels func(sshChan <-chan ssh.NewChannel, conn *ssh.ServerConn, shellConf ShellConf)
 var newServerConn func(net.Conn, *ssh.ServerConfig) (*ssh.ServerConn, <-chan ssh.NewChannel, <-chan *ssh.Request, error)
-var discardRequests func(in <-chan *ssh.Request)
-var processSSHConnection func(conn net.Conn, sshConf *ssh.ServerConfig, shellConf ShellConf)
+var handleGlobalRequests func(reqs <-chan *ssh.Request, conn *ssh.ServerConn, shellConf ShellConf)
+var processSSHConnection func(conn net.Conn, sshConf *ssh.ServerConfig, shellConf ShellConf, handshakeDone func())
+var handleDirectTCPIP func(newChannel ssh.NewChannel, conn *ssh.ServerConn, shellConf ShellConf)
+var handleDirectStreamLocal func(newChannel ssh.NewChannel, conn *ssh.ServerConn, shellConf ShellConf)
 
 func init() {
 	setupFunctionPointers()
@@ -27,30 +48,241 @@ func init() {
 
 func setupFunctionPointers() {
 	handlePtyRequest = _handlePtyRequest
+	handleShellRequest = _handleShellRequest
+	handleExecRequest = _handleExecRequest
+	handleSubsystemRequest = _handleSubsystemRequest
+	handleEnvRequest = _handleEnvRequest
+	handleWindowChange = _handleWindowChange
+	handleAgentRequest = _handleAgentRequest
+	handleX11Request = _handleX11Request
 	handleSSHRequests = _handleSSHRequests
 	processSSHChannels = _processSSHChannels
 	newServerConn = _newServerConn
-	discardRequests = _discardRequests
+	handleGlobalRequests = _handleGlobalRequests
 	processSSHConnection = _processSSHConnection
+	handleDirectTCPIP = _handleDirectTCPIP
+	handleDirectStreamLocal = _handleDirectStreamLocal
+}
+
+// A Subsystem serves a subsystem request (See RFC 4254 6.5) over the channel.
+// It returns once the client is done with the subsystem.
+type Subsystem func(channel ssh.Channel) error
+
+// A CommandHandler can serve an exec request (See RFC 4254 6.5) in process
+// instead of running the command with the shell. It returns nil if it doesn't
+// handle the command.
+type CommandHandler func(command string) Subsystem
+
+// DefaultMaxHandshakes is the default number of connections that can be
+// authenticating at once
+const DefaultMaxHandshakes = 16
+
+// handshakeTimeout is how long a client has to authenticate
+const handshakeTimeout = 2 * time.Minute
+
+// A SharedTerminal is a terminal that guests join instead of starting their
+// own shell
+type SharedTerminal interface {
+	// Join shows the terminal to the guest over the channel until the guest
+	// leaves or the terminal closes
+	Join(guest string, channel io.ReadWriter) error
+}
+
+// RecordingConf configures recording PTY sessions
+type RecordingConf struct {
+	// The directory recordings are written to, "" disables recording
+	Dir string
+	// Whether what the guest types is recorded as well as the output
+	Input bool
+}
+
+// SessionEnd describes a session that has ended
+type SessionEnd struct {
+	ID    string
+	Guest string
+	// The file the session was recorded to or "" if it wasn't recorded
+	Recording string
+	Err       error
 }
 
 // A ShellConf has common configuration for a ssh shell
 type ShellConf interface {
 	Shell() string
 	ErrorHandler(error)
+	Subsystem(name string) Subsystem
+	Command(command string) Subsystem
+	AllowConnection(addr net.Addr) error
+	MaxHandshakes() int
+	SharedTerminal() SharedTerminal
+	Recording() RecordingConf
+	SessionEnded(SessionEnd)
+	Audit(audit.Event)
+	AllowForward(host string, port uint32) error
+	GatewayPorts() bool
+	AllowSocket(socketPath string) error
+	AgentForwarding() bool
+	X11Forwarding() bool
+	AllowEnv(name string) error
+	Env() []string
 }
 
 type shellConf struct {
-	shell        string
-	errorHandler func(error)
+	shell            string
+	errorHandler     func(error)
+	subsystems       map[string]Subsystem
+	commandHandlers  []CommandHandler
+	connectionFilter func(addr net.Addr) error
+	maxHandshakes    int
+	sharedTerminal   SharedTerminal
+	recording        RecordingConf
+	sessionEnded     func(SessionEnd)
+	audit            func(audit.Event)
+	forwardAllowList *ForwardAllowList
+	gatewayPorts     bool
+	socketAllowList  *SocketAllowList
+	agentForwarding  bool
+	x11Forwarding    bool
+	envAllowList     *EnvAllowList
+	env              []string
+}
+
+// A ShellOption sets optional ShellConf configuration
+type ShellOption func(*shellConf)
+
+// WithSubsystem registers a subsystem that clients can request by name
+func WithSubsystem(name string, subsystem Subsystem) ShellOption {
+	return func(sc *shellConf) {
+		sc.subsystems[name] = subsystem
+	}
+}
+
+// WithCommandHandler registers a handler for exec requests. Handlers are tried
+// in the order they're registered.
+func WithCommandHandler(handler CommandHandler) ShellOption {
+	return func(sc *shellConf) {
+		sc.commandHandlers = append(sc.commandHandlers, handler)
+	}
+}
+
+// WithConnectionFilter sets a function that can refuse connections before
+// the ssh handshake by returning an error
+func WithConnectionFilter(filter func(addr net.Addr) error) ShellOption {
+	return func(sc *shellConf) {
+		sc.connectionFilter = filter
+	}
+}
+
+// WithMaxHandshakes limits the number of connections that can be
+// authenticating at once. Connections over the limit are dropped. Zero
+// allows any number.
+func WithMaxHandshakes(max int) ShellOption {
+	return func(sc *shellConf) {
+		sc.maxHandshakes = max
+	}
+}
+
+// WithSharedTerminal makes guests join the terminal instead of starting their
+// own shell. Commands and subsystems are refused.
+func WithSharedTerminal(terminal SharedTerminal) ShellOption {
+	return func(sc *shellConf) {
+		sc.sharedTerminal = terminal
+	}
+}
+
+// WithRecording records every PTY session to <dir>/<session-id>.cast in the
+// asciicast v2 format. Sessions that can't be recorded are refused.
+func WithRecording(dir string, input bool) ShellOption {
+	return func(sc *shellConf) {
+		sc.recording = RecordingConf{Dir: dir, Input: input}
+	}
+}
+
+// WithSessionEndHandler sets a function that's called when each session ends
+func WithSessionEndHandler(handler func(SessionEnd)) ShellOption {
+	return func(sc *shellConf) {
+		sc.sessionEnded = handler
+	}
+}
+
+// WithAuditHandler sets a function that's called with each audit event
+func WithAuditHandler(handler func(audit.Event)) ShellOption {
+	return func(sc *shellConf) {
+		sc.audit = handler
+	}
+}
+
+// WithForwardAllowList lets guests forward connections (ssh -L) to the
+// destinations in the list. Forwarding is refused without one.
+func WithForwardAllowList(list *ForwardAllowList) ShellOption {
+	return func(sc *shellConf) {
+		sc.forwardAllowList = list
+	}
+}
+
+// WithGatewayPorts lets guests' remote forwards (ssh -R) listen on any
+// address instead of only the loopback interface
+func WithGatewayPorts() ShellOption {
+	return func(sc *shellConf) {
+		sc.gatewayPorts = true
+	}
+}
+
+// WithSocketAllowList lets guests forward connections to the Unix sockets in
+// the list and listen on them. Socket forwarding is refused without one.
+func WithSocketAllowList(list *SocketAllowList) ShellOption {
+	return func(sc *shellConf) {
+		sc.socketAllowList = list
+	}
+}
+
+// WithAgentForwarding lets guests forward their ssh agent so the commands
+// they run can use their keys
+func WithAgentForwarding() ShellOption {
+	return func(sc *shellConf) {
+		sc.agentForwarding = true
+	}
+}
+
+// WithX11Forwarding lets guests forward their X11 display so they can run
+// graphical programs
+func WithX11Forwarding() ShellOption {
+	return func(sc *shellConf) {
+		sc.x11Forwarding = true
+	}
+}
+
+// WithEnvAllowList replaces the environment variables guests may set with
+// env requests
+func WithEnvAllowList(list *EnvAllowList) ShellOption {
+	return func(sc *shellConf) {
+		sc.envAllowList = list
+	}
+}
+
+// WithEnv sets NAME=VALUE environment variables for every session. They
+// replace the variables guests set.
+func WithEnv(env []string) ShellOption {
+	return func(sc *shellConf) {
+		sc.env = env
+	}
 }
 
 // DefaultShellConf creates the standard ShellConf
-func DefaultShellConf(shell string, errorHandler func(error)) ShellConf {
-	return &shellConf{
-		shell:        shell,
-		errorHandler: errorHandler,
+func DefaultShellConf(shell string, errorHandler func(error), options ...ShellOption) ShellConf {
+	sc := &shellConf{
+		shell:            shell,
+		errorHandler:     errorHandler,
+		subsystems:       map[string]Subsystem{},
+		connectionFilter: func(net.Addr) error { return nil },
+		maxHandshakes:    DefaultMaxHandshakes,
+		sessionEnded:     func(SessionEnd) {},
+		audit:            func(audit.Event) {},
+		envAllowList:     &EnvAllowList{patterns: defaultAcceptEnv},
 	}
+	for _, option := range options {
+		option(sc)
+	}
+	return sc
 }
 
 func (sc *shellConf) Shell() string {
@@ -61,70 +293,156 @@ func (sc *shellConf) ErrorHandler(err error) {
 	sc.errorHandler(err)
 }
 
-func _handlePtyRequest(shell string, channel ssh.Channel, req *ssh.Request) error {
-	ptyReq, err := payload.ParsePtyReq(req.Payload)
-	if err != nil {
-		return fmt.Errorf("Unable to parse pty request (%s)", err)
-	}
-	_ = ptyReq
-	// TODO set the PTY size from ptyReq
-	ptyFile, err := pty.Start(exec.Command(shell))
-	if err != nil {
-		return fmt.Errorf("Unable to create pty request (%s)", err)
+func (sc *shellConf) Subsystem(name string) Subsystem {
+	return sc.subsystems[name]
+}
+
+func (sc *shellConf) Command(command string) Subsystem {
+	for _, handler := range sc.commandHandlers {
+		if subsystem := handler(command); subsystem != nil {
+			return subsystem
+		}
 	}
+	return nil
+}
 
-	doneCh := make(chan struct{})
-	// Note that channel is a ReadWriter to handling the requests stdin and
-	// stdout. Stderr is with channel.Stderr()
-	go func() {
-		_, _ = io.Copy(channel, ptyFile)
-		doneCh <- struct{}{}
-	}()
-	go func() {
-		_, _ = io.Copy(ptyFile, channel)
-		doneCh <- struct{}{}
-	}()
+func (sc *shellConf) AllowConnection(addr net.Addr) error {
+	return sc.connectionFilter(addr)
+}
 
-	go func() {
-		<-doneCh
-		// TODO get the actual exit status instead of just using 0
-		channel.SendRequest("exit-status", false, ssh.Marshal(&struct{ ExitStatus uint32 }{0}))
-		channel.Close()
-		ptyFile.Close()
-		<-doneCh
-	}()
+func (sc *shellConf) MaxHandshakes() int {
+	return sc.maxHandshakes
+}
 
-	return nil
+func (sc *shellConf) SharedTerminal() SharedTerminal {
+	return sc.sharedTerminal
+}
+
+func (sc *shellConf) Recording() RecordingConf {
+	return sc.recording
+}
+
+func (sc *shellConf) SessionEnded(end SessionEnd) {
+	sc.sessionEnded(end)
+}
+
+func (sc *shellConf) Audit(event audit.Event) {
+	sc.audit(event)
+}
+
+func (sc *shellConf) AllowForward(host string, port uint32) error {
+	return sc.forwardAllowList.Allow(host, port)
+}
+
+func (sc *shellConf) GatewayPorts() bool {
+	return sc.gatewayPorts
+}
+
+func (sc *shellConf) AllowSocket(socketPath string) error {
+	return sc.socketAllowList.Allow(socketPath)
+}
+
+func (sc *shellConf) AgentForwarding() bool {
+	return sc.agentForwarding
 }
 
-func _handleSSHRequests(channel ssh.Channel, reqsCh <-chan *ssh.Request, shellConf ShellConf) {
+func (sc *shellConf) X11Forwarding() bool {
+	return sc.x11Forwarding
+}
+
+func (sc *shellConf) AllowEnv(name string) error {
+	return sc.envAllowList.Allow(name)
+}
+
+func (sc *shellConf) Env() []string {
+	return sc.env
+}
+
+// requestEvent describes the request for the audit log
+func requestEvent(sess *session, req *ssh.Request, err error) audit.Event {
+	event := audit.Event{Event: audit.Request, ChannelID: sess.id, Request: req.Type, Outcome: audit.Success}
+	switch req.Type {
+	case "exec":
+		if execReq, perr := payload.ParseExecReq(req.Payload); perr == nil {
+			event.Command = execReq.Command
+		}
+	case "subsystem":
+		if subsystemReq, perr := payload.ParseSubsystemReq(req.Payload); perr == nil {
+			event.Subsystem = subsystemReq.Name
+		}
+	}
+	if err != nil {
+		event.Outcome = audit.Failure
+		event.Error = err.Error()
+	}
+	return event
+}
+
+func _handleSSHRequests(channel ssh.Channel, reqsCh <-chan *ssh.Request, conn *ssh.ServerConn, shellConf ShellConf) {
+	counter := &byteCounter{}
+	sess := newSession(countingChannel{channel, counter}, conn, shellConf)
+	auditEvent(shellConf, conn, audit.Event{Event: audit.ChannelOpened, ChannelID: sess.id, ChannelType: "session"})
+	opened := time.Now()
 	for req := range reqsCh {
 		var err error
 		switch req.Type {
 		case "pty-req":
-			err = handlePtyRequest(shellConf.Shell(), channel, req)
-			if err != nil {
-				shellConf.ErrorHandler(err)
-				continue
-			}
+			err = handlePtyRequest(sess, req)
+		case "shell":
+			err = handleShellRequest(sess, req)
+		case "exec":
+			err = handleExecRequest(sess, req)
+		case "subsystem":
+			err = handleSubsystemRequest(sess, req)
+		case "env":
+			err = handleEnvRequest(sess, req)
+		case "window-change":
+			err = handleWindowChange(sess, req)
+		case "auth-agent-req@openssh.com":
+			err = handleAgentRequest(sess, req)
+		case "x11-req":
+			err = handleX11Request(sess, req)
+		default:
+			err = errUnsupportedRequest
+		}
+		if _, declined := err.(declinedRequest); err != nil && err != errUnsupportedRequest && !declined {
+			shellConf.ErrorHandler(err)
+		}
+		// Resizing the terminal isn't worth recording
+		if req.Type != "window-change" {
+			auditEvent(shellConf, conn, requestEvent(sess, req, err))
 		}
 		if req.WantReply {
-			err = req.Reply(err == nil, nil)
-			if err != nil {
-				shellConf.ErrorHandler(err)
+			rerr := req.Reply(err == nil, nil)
+			if rerr != nil {
+				shellConf.ErrorHandler(rerr)
 			}
 		}
 	}
+
+	// The channel has been closed so hang up on the command
+	sess.hangup()
+
+	closed := audit.Event{Event: audit.ChannelClosed, ChannelID: sess.id, ChannelType: "session"}
+	bytesIn, bytesOut := counter.totals()
+	closed.Closed(bytesIn, bytesOut, opened)
+	auditEvent(shellConf, conn, closed)
 }
 
-func _processSSHChannels(sshChan <-chan ssh.NewChannel, shellConf ShellConf) {
+func _processSSHChannels(sshChan <-chan ssh.NewChannel, conn *ssh.ServerConn, shellConf ShellConf) {
 	for newChannel := range sshChan {
-		if newChannel.ChannelType() != "session" {
-			shellConf.ErrorHandler(fmt.Errorf("unsupported channel type : %v", newChannel.ChannelType()))
-			err := newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
-			if err != nil {
-				shellConf.ErrorHandler(err)
-			}
+		switch newChannel.ChannelType() {
+		case "session":
+		case "direct-tcpip":
+			// Connecting to the destination can take a while
+			go handleDirectTCPIP(newChannel, conn, shellConf)
+			continue
+		case "direct-streamlocal@openssh.com":
+			go handleDirectStreamLocal(newChannel, conn, shellConf)
+			continue
+		default:
+			event := audit.Event{ChannelType: newChannel.ChannelType()}
+			rejectChannel(newChannel, conn, shellConf, event, ssh.UnknownChannelType, fmt.Errorf("unsupported channel type : %v", newChannel.ChannelType()))
 			continue
 		}
 
@@ -134,7 +452,7 @@ func _processSSHChannels(sshChan <-chan ssh.NewChannel, shellConf ShellConf) {
 			continue
 		}
 
-		go handleSSHRequests(channel, requests, shellConf)
+		go handleSSHRequests(channel, requests, conn, shellConf)
 	}
 }
 
@@ -142,24 +460,79 @@ func _newServerConn(c net.Conn, config *ssh.ServerConfig) (*ssh.ServerConn, <-ch
 	return ssh.NewServerConn(c, config)
 }
 
-func _discardRequests(in <-chan *ssh.Request) {
-	ssh.DiscardRequests(in)
+func _handleGlobalRequests(reqs <-chan *ssh.Request, conn *ssh.ServerConn, shellConf ShellConf) {
+	forwards := newRemoteForwards(conn, shellConf)
+	// The requests stop once the connection drops
+	defer forwards.closeAll()
+	for req := range reqs {
+		var listening string
+		var reply []byte
+		var err error
+		switch req.Type {
+		case "tcpip-forward":
+			listening, reply, err = forwards.listen(req)
+		case "cancel-tcpip-forward":
+			listening, err = forwards.cancel(req)
+		case "streamlocal-forward@openssh.com":
+			listening, err = forwards.listenSocket(req)
+		case "cancel-streamlocal-forward@openssh.com":
+			listening, err = forwards.cancelSocket(req)
+		default:
+			err = errUnsupportedRequest
+		}
+		if err != nil && err != errUnsupportedRequest {
+			shellConf.ErrorHandler(err)
+		}
+		// Keepalives and other requests gmash doesn't handle aren't worth
+		// recording
+		if err != errUnsupportedRequest {
+			event := audit.Event{Event: audit.Request, Request: req.Type, Listen: listening, Outcome: audit.Success}
+			if err != nil {
+				event.Outcome = audit.Failure
+				event.Error = err.Error()
+			}
+			auditEvent(shellConf, conn, event)
+		}
+		if req.WantReply {
+			rerr := req.Reply(err == nil, reply)
+			if rerr != nil {
+				shellConf.ErrorHandler(rerr)
+			}
+		}
+	}
 }
 
-func _processSSHConnection(conn net.Conn, sshConf *ssh.ServerConfig, shellConf ShellConf) {
+func _processSSHConnection(conn net.Conn, sshConf *ssh.ServerConfig, shellConf ShellConf, handshakeDone func()) {
 	defer func() { _ = conn.Close() }()
+	counter := &byteCounter{}
+	conn = countingConn{conn, counter}
+	opened := time.Now()
 
-	// Establish the ssh connection
-	_, sshChan, sshRequest, err := newServerConn(conn, sshConf)
+	// Establish the ssh connection. Clients that don't finish authenticating
+	// in time are dropped so they can't hold on to a handshake slot.
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	serverConn, sshChan, sshRequest, err := newServerConn(conn, sshConf)
+	handshakeDone()
+	_ = conn.SetDeadline(time.Time{})
+	closed := audit.Event{Event: audit.ConnectionClosed}
 	if err != nil {
 		shellConf.ErrorHandler(fmt.Errorf("failed to establish ssh connection (%s)", err))
+		closed.RemoteAddr = conn.RemoteAddr().String()
+		closed.Error = err.Error()
+		bytesIn, bytesOut := counter.totals()
+		closed.Closed(bytesIn, bytesOut, opened)
+		shellConf.Audit(closed)
 		return
 	}
+	auditEvent(shellConf, serverConn, audit.Event{Event: audit.ConnectionOpened})
 
-	// Yea were not going to handle any requests (port/X11 forwarding etc. at this time)
-	go discardRequests(sshRequest)
+	go handleGlobalRequests(sshRequest, serverConn, shellConf)
 
-	processSSHChannels(sshChan, shellConf)
+	processSSHChannels(sshChan, serverConn, shellConf)
+
+	bytesIn, bytesOut := counter.totals()
+	closed.Closed(bytesIn, bytesOut, opened)
+	auditEvent(shellConf, serverConn, closed)
 }
 
 // SSHServer starts an ssh server on the given address
@@ -169,6 +542,7 @@ func SSHServer(addr string, sshConf *ssh.ServerConfig, shellConf ShellConf) (net
 		return nil, fmt.Errorf("failed to listen on %s (%s)", addr, err)
 	}
 
+	handshakes := newHandshakeLimiter(shellConf.MaxHandshakes())
 	go func() {
 		for {
 			conn, err := listener.Accept()
@@ -177,8 +551,56 @@ func SSHServer(addr string, sshConf *ssh.ServerConfig, shellConf ShellConf) (net
 				return
 			}
 
-			go processSSHConnection(conn, sshConf, shellConf)
+			err = shellConf.AllowConnection(conn.RemoteAddr())
+			if err == nil && !handshakes.acquire() {
+				err = errors.New("too many connections are authenticating")
+			}
+			if err != nil {
+				shellConf.ErrorHandler(fmt.Errorf("refused connection from %s (%s)", conn.RemoteAddr(), err))
+				shellConf.Audit(audit.Event{Event: audit.ConnectionRefused, RemoteAddr: conn.RemoteAddr().String(), Error: err.Error()})
+				_ = conn.Close()
+				continue
+			}
+
+			go processSSHConnection(conn, sshConf, shellConf, handshakes.releaser())
 		}
 	}()
 	return listener, nil
 }
+
+// handshakeLimiter caps the number of connections that are authenticating
+type handshakeLimiter chan struct{}
+
+func newHandshakeLimiter(max int) handshakeLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return make(handshakeLimiter, max)
+}
+
+// acquire takes a handshake slot without waiting. It returns false if there
+// are none left.
+func (l handshakeLimiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaser returns a function that gives back the slot the first time it's
+// called
+func (l handshakeLimiter) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if l != nil {
+				<-l
+			}
+		})
+	}
+}
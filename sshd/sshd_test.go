@@ -14,6 +14,7 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/efarrer/gmash/audit"
 	"github.com/efarrer/gmash/auth"
 
 	"golang.org/x/crypto/ssh"
@@ -93,6 +94,9 @@ func (wc *writeCloser) Bytes() []byte {
 type fakeChannel struct {
 	readCloser
 	writeCloser
+	requests  []string
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 func newFakeChannel(toRead []byte, closeError error) *fakeChannel {
@@ -104,6 +108,7 @@ func newFakeChannel(toRead []byte, closeError error) *fakeChannel {
 		writeCloser: writeCloser{
 			closeError: closeError,
 		},
+		closed: make(chan struct{}),
 	}
 }
 
@@ -112,6 +117,7 @@ func (fc *fakeChannel) Close() error {
 	defer fc.readCloser.lock.Unlock()
 	fc.writeCloser.lock.Lock()
 	defer fc.writeCloser.lock.Unlock()
+	fc.closeOnce.Do(func() { close(fc.closed) })
 	return fc.readCloser.closeError
 }
 
@@ -120,16 +126,41 @@ func (fc *fakeChannel) CloseWrite() error {
 }
 
 func (fc *fakeChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	fc.writeCloser.lock.Lock()
+	defer fc.writeCloser.lock.Unlock()
+	fc.requests = append(fc.requests, name)
 	return true, nil
 }
 
+// Requests returns the names of the requests sent on the channel
+func (fc *fakeChannel) Requests() []string {
+	fc.writeCloser.lock.Lock()
+	defer fc.writeCloser.lock.Unlock()
+	return fc.requests
+}
+
 func (fc *fakeChannel) Stderr() io.ReadWriter {
 	return nil
 }
 
 type mockShellConf struct {
-	shell string
-	err   error
+	shell         string
+	err           error
+	subsystems    map[string]Subsystem
+	commands      map[string]Subsystem
+	refuse        error
+	maxHandshakes int
+	terminal      SharedTerminal
+	recording     RecordingConf
+	ended         []SessionEnd
+	forward       error
+	gatewayPorts  bool
+	socket        error
+	agent         bool
+	x11           bool
+	env           []string
+	auditLock     sync.Mutex
+	audited       []audit.Event
 }
 
 func (sc *mockShellConf) Shell() string {
@@ -140,34 +171,81 @@ func (sc *mockShellConf) ErrorHandler(err error) {
 	sc.err = err
 }
 
-func newShellConf() *mockShellConf {
-	return &mockShellConf{shell: "/bin/bash"}
+func (sc *mockShellConf) Subsystem(name string) Subsystem {
+	return sc.subsystems[name]
 }
 
-func TestHandlePtyRequest_WithInvalidPtyPayloadReturnsError(t *testing.T) {
-	channel := newFakeChannel([]byte{}, nil)
+func (sc *mockShellConf) Command(command string) Subsystem {
+	return sc.commands[command]
+}
 
-	err := handlePtyRequest("/bin/bash", channel, &ssh.Request{})
+func (sc *mockShellConf) AllowConnection(addr net.Addr) error {
+	return sc.refuse
+}
 
-	assert.Error(t, err)
+func (sc *mockShellConf) MaxHandshakes() int {
+	return sc.maxHandshakes
 }
 
-var ptyPayload = []byte{
-	0x0, 0x0, 0x0, 0x1, 0x3b, // tty type
-	0x0, 0x0, 0x0, 0x0A, // width chars
-	0x0, 0x0, 0x0, 0xA0, // height columns
-	0x0, 0x0, 0x0, 0x0, // width pixels
-	0x0, 0x0, 0x0, 0x0, // terminal modes
+func (sc *mockShellConf) SharedTerminal() SharedTerminal {
+	return sc.terminal
 }
 
-func TestHandlePtyRequest_WithInvalidShellReturnsError(t *testing.T) {
-	channel := newFakeChannel([]byte{}, nil)
+func (sc *mockShellConf) Recording() RecordingConf {
+	return sc.recording
+}
 
-	err := handlePtyRequest("/", channel, &ssh.Request{
-		Payload: ptyPayload,
-	})
+func (sc *mockShellConf) SessionEnded(end SessionEnd) {
+	sc.ended = append(sc.ended, end)
+}
 
-	assert.Error(t, err)
+func (sc *mockShellConf) Audit(event audit.Event) {
+	sc.auditLock.Lock()
+	defer sc.auditLock.Unlock()
+	sc.audited = append(sc.audited, event)
+}
+
+func (sc *mockShellConf) AllowForward(host string, port uint32) error {
+	return sc.forward
+}
+
+func (sc *mockShellConf) GatewayPorts() bool {
+	return sc.gatewayPorts
+}
+
+func (sc *mockShellConf) AllowSocket(socketPath string) error {
+	return sc.socket
+}
+
+func (sc *mockShellConf) AgentForwarding() bool {
+	return sc.agent
+}
+
+func (sc *mockShellConf) X11Forwarding() bool {
+	return sc.x11
+}
+
+func (sc *mockShellConf) AllowEnv(name string) error {
+	return (&EnvAllowList{patterns: defaultAcceptEnv}).Allow(name)
+}
+
+func (sc *mockShellConf) Env() []string {
+	return sc.env
+}
+
+// auditEvents returns the kinds of the events sent to the audit log
+func (sc *mockShellConf) auditEvents() []string {
+	sc.auditLock.Lock()
+	defer sc.auditLock.Unlock()
+	var events []string
+	for _, event := range sc.audited {
+		events = append(events, event.Event)
+	}
+	return events
+}
+
+func newShellConf() *mockShellConf {
+	return &mockShellConf{shell: "/bin/bash"}
 }
 
 func createTestBinary() (string, func(), error) {
@@ -199,20 +277,6 @@ func createTestBinary() (string, func(), error) {
 	}, nil
 }
 
-func TestHandlePtyRequest_HappyPath(t *testing.T) {
-	bin, closer, err := createTestBinary()
-	assert.NoError(t, err)
-	defer closer()
-
-	channel := newFakeChannel([]byte{}, nil)
-
-	err = handlePtyRequest(bin, channel, &ssh.Request{
-		Payload: ptyPayload,
-	})
-
-	assert.NoError(t, err)
-}
-
 func startReqChan(req *ssh.Request) chan *ssh.Request {
 	reqCh := make(chan *ssh.Request)
 	go func() {
@@ -228,7 +292,7 @@ func TestHandleSshRequests_HandlesEmptyRequests(t *testing.T) {
 	reqCh := startReqChan(nil)
 	<-reqCh // Swallow the req
 
-	handleSSHRequests(channel, reqCh, sc)
+	handleSSHRequests(channel, reqCh, nil, sc)
 
 	assert.NoError(t, sc.err)
 }
@@ -238,7 +302,7 @@ func TestHandleSshRequests_SkipsBogusRequesets(t *testing.T) {
 	channel := newFakeChannel([]byte{}, nil)
 	reqCh := startReqChan(&ssh.Request{Type: "bogus", WantReply: false})
 
-	handleSSHRequests(channel, reqCh, sc)
+	handleSSHRequests(channel, reqCh, nil, sc)
 
 	assert.NoError(t, sc.err)
 }
@@ -248,16 +312,110 @@ func TestHandleSshRequests_HandlesPtyRequestErrors(t *testing.T) {
 	channel := newFakeChannel([]byte{}, nil)
 	reqCh := startReqChan(&ssh.Request{Type: "pty-req"})
 	// override handlePtyRequest then restore it later
-	handlePtyRequest = func(string, ssh.Channel, *ssh.Request) error {
+	handlePtyRequest = func(*session, *ssh.Request) error {
+		return errors.New("some error")
+	}
+	defer setupFunctionPointers()
+
+	handleSSHRequests(channel, reqCh, nil, sc)
+
+	assert.Error(t, sc.err)
+}
+
+func TestHandleSshRequests_HandlesShellRequestErrors(t *testing.T) {
+	sc := newShellConf()
+	channel := newFakeChannel([]byte{}, nil)
+	reqCh := startReqChan(&ssh.Request{Type: "shell"})
+	// override handleShellRequest then restore it later
+	handleShellRequest = func(*session, *ssh.Request) error {
+		return errors.New("some error")
+	}
+	defer setupFunctionPointers()
+
+	handleSSHRequests(channel, reqCh, nil, sc)
+
+	assert.Error(t, sc.err)
+}
+
+func TestHandleSshRequests_HandlesExecRequestErrors(t *testing.T) {
+	sc := newShellConf()
+	channel := newFakeChannel([]byte{}, nil)
+	reqCh := startReqChan(&ssh.Request{Type: "exec"})
+	// override handleExecRequest then restore it later
+	handleExecRequest = func(*session, *ssh.Request) error {
+		return errors.New("some error")
+	}
+	defer setupFunctionPointers()
+
+	handleSSHRequests(channel, reqCh, nil, sc)
+
+	assert.Error(t, sc.err)
+}
+
+func TestHandleSshRequests_HandlesWindowChangeErrors(t *testing.T) {
+	sc := newShellConf()
+	channel := newFakeChannel([]byte{}, nil)
+	reqCh := startReqChan(&ssh.Request{Type: "window-change"})
+	// override handleWindowChange then restore it later
+	handleWindowChange = func(*session, *ssh.Request) error {
 		return errors.New("some error")
 	}
 	defer setupFunctionPointers()
 
-	handleSSHRequests(channel, reqCh, sc)
+	handleSSHRequests(channel, reqCh, nil, sc)
 
 	assert.Error(t, sc.err)
 }
 
+func TestHandleSshRequests_AuditsTheChannel(t *testing.T) {
+	sc := newShellConf()
+	channel := newFakeChannel([]byte{}, nil)
+	reqCh := startReqChan(&ssh.Request{Type: "exec", Payload: ssh.Marshal(struct{ Command string }{"ls"})})
+	// override handleExecRequest then restore it later
+	handleExecRequest = func(sess *session, req *ssh.Request) error {
+		_, err := sess.channel.Write([]byte("hi"))
+		return err
+	}
+	defer setupFunctionPointers()
+
+	handleSSHRequests(channel, reqCh, nil, sc)
+
+	assert.Equal(t, []string{audit.ChannelOpened, audit.Request, audit.ChannelClosed}, sc.auditEvents())
+	request := sc.audited[1]
+	assert.Equal(t, "exec", request.Request)
+	assert.Equal(t, "ls", request.Command)
+	assert.Equal(t, audit.Success, request.Outcome)
+	assert.Equal(t, sc.audited[0].ChannelID, request.ChannelID)
+	assert.Equal(t, int64(2), *sc.audited[2].BytesOut)
+}
+
+func TestHandleSshRequests_AuditsFailedRequests(t *testing.T) {
+	sc := newShellConf()
+	channel := newFakeChannel([]byte{}, nil)
+	reqCh := startReqChan(&ssh.Request{Type: "subsystem", Payload: ssh.Marshal(struct{ Name string }{"bogus"})})
+
+	handleSSHRequests(channel, reqCh, nil, sc)
+
+	request := sc.audited[1]
+	assert.Equal(t, "bogus", request.Subsystem)
+	assert.Equal(t, audit.Failure, request.Outcome)
+	assert.Equal(t, "Unsupported subsystem bogus", request.Error)
+}
+
+func TestHandleSshRequests_DeclinesUnallowedEnvQuietly(t *testing.T) {
+	sc := newShellConf()
+	channel := newFakeChannel([]byte{}, nil)
+	reqCh := startReqChan(&ssh.Request{Type: "env", Payload: ssh.Marshal(struct{ Name, Value string }{"LD_PRELOAD", "evil.so"})})
+
+	handleSSHRequests(channel, reqCh, nil, sc)
+
+	assert.NoError(t, sc.err)
+	request := sc.audited[1]
+	assert.Equal(t, "env", request.Request)
+	assert.Equal(t, audit.Failure, request.Outcome)
+	assert.Equal(t, "Ignoring environment variable LD_PRELOAD", request.Error)
+}
+
 type fakeNewChannel struct {
 	channelType string
 	acceptError error
@@ -294,16 +452,36 @@ func TestProcessSshChannels_IgnoresNonSessionChannelTypes(t *testing.T) {
 	sc := newShellConf()
 	newChannelChan := startNewChannelChannel([]fakeNewChannel{{channelType: "bogus", acceptError: nil}})
 
-	processSSHChannels(newChannelChan, sc)
+	processSSHChannels(newChannelChan, nil, sc)
 
 	assert.Error(t, sc.err)
+	assert.Equal(t, []string{audit.ChannelRejected}, sc.auditEvents())
+	assert.Equal(t, "bogus", sc.audited[0].ChannelType)
+}
+
+func TestProcessSshChannels_HandlesDirectTCPIPChannels(t *testing.T) {
+	sc := newShellConf()
+	newChannelChan := startNewChannelChannel([]fakeNewChannel{{channelType: "direct-tcpip", acceptError: nil}})
+
+	// override handleDirectTCPIP then restore it later
+	ch := make(chan struct{})
+	handleDirectTCPIP = func(ssh.NewChannel, *ssh.ServerConn, ShellConf) {
+		ch <- struct{}{}
+	}
+	defer setupFunctionPointers()
+
+	processSSHChannels(newChannelChan, nil, sc)
+	// This will block unless handleDirectTCPIP is called above
+	<-ch
+
+	assert.NoError(t, sc.err)
 }
 
 func TestProcessSshChannels_HandlesErrorsAcceptingChannelRequest(t *testing.T) {
 	sc := newShellConf()
 	newChannelChan := startNewChannelChannel([]fakeNewChannel{{channelType: "session", acceptError: errors.New("")}})
 
-	processSSHChannels(newChannelChan, sc)
+	processSSHChannels(newChannelChan, nil, sc)
 
 	assert.Error(t, sc.err)
 }
@@ -314,12 +492,12 @@ func TestProcessSshChannels_HandlesSessionRequests(t *testing.T) {
 
 	// override handleSSHRequests then restore it later
 	ch := make(chan struct{})
-	handleSSHRequests = func(ssh.Channel, <-chan *ssh.Request, ShellConf) {
+	handleSSHRequests = func(ssh.Channel, <-chan *ssh.Request, *ssh.ServerConn, ShellConf) {
 		ch <- struct{}{}
 	}
 	defer setupFunctionPointers()
 
-	processSSHChannels(newChannelChan, sc)
+	processSSHChannels(newChannelChan, nil, sc)
 	// This will block unless handleSSHRequests is called above
 	<-ch
 
@@ -333,7 +511,11 @@ func TestProcessSSHConnection_HandlesHandshakeErrors(t *testing.T) {
 	_ = cli.Close()
 	_ = srv.Close()
 
-	processSSHConnection(srv, sshConf, sc)
+	handshakeDone := false
+	processSSHConnection(srv, sshConf, sc, func() { handshakeDone = true })
+	assert.True(t, handshakeDone)
+	assert.Equal(t, []string{audit.ConnectionClosed}, sc.auditEvents())
+	assert.NotEmpty(t, sc.audited[0].Error)
 }
 
 func TestProcessSSHConnection_ProcessesChannels(t *testing.T) {
@@ -347,19 +529,20 @@ func TestProcessSSHConnection_ProcessesChannels(t *testing.T) {
 		return nil, startNewChannelChannel([]fakeNewChannel{}), startReqChan(nil), nil
 	}
 	processCalled := false
-	processSSHChannels = func(sshChan <-chan ssh.NewChannel, shellConf ShellConf) {
+	processSSHChannels = func(sshChan <-chan ssh.NewChannel, conn *ssh.ServerConn, shellConf ShellConf) {
 		processCalled = true
 	}
-	discardCalled := make(chan bool)
-	discardRequests = func(<-chan *ssh.Request) {
-		discardCalled <- true
+	globalRequestsCalled := make(chan bool)
+	handleGlobalRequests = func(<-chan *ssh.Request, *ssh.ServerConn, ShellConf) {
+		globalRequestsCalled <- true
 	}
 	defer setupFunctionPointers()
 
-	processSSHConnection(srv, sshConf, sc)
+	processSSHConnection(srv, sshConf, sc, func() {})
 
 	assert.True(t, processCalled)
-	assert.True(t, <-discardCalled)
+	assert.True(t, <-globalRequestsCalled)
+	assert.Equal(t, []string{audit.ConnectionOpened, audit.ConnectionClosed}, sc.auditEvents())
 }
 
 func TestSSHServer_ReturnsErrorWithBadAddress(t *testing.T) {
@@ -373,7 +556,7 @@ func TestSSHServer_ProcessesConnections(t *testing.T) {
 	sshConf := &ssh.ServerConfig{}
 	sc := newShellConf()
 	funcCalled := make(chan bool)
-	processSSHConnection = func(net.Conn, *ssh.ServerConfig, ShellConf) {
+	processSSHConnection = func(net.Conn, *ssh.ServerConfig, ShellConf, func()) {
 		funcCalled <- true
 	}
 	defer setupFunctionPointers()
@@ -386,10 +569,67 @@ func TestSSHServer_ProcessesConnections(t *testing.T) {
 	assert.True(t, <-funcCalled)
 }
 
-func createTestServer(shell string) (int, func(), error) {
+// assertRefused asserts that the server closes the connection without
+// starting the ssh handshake
+func assertRefused(t *testing.T, port int) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestSSHServer_RefusesFilteredConnections(t *testing.T) {
+	sshConf := &ssh.ServerConfig{}
+	sc := newShellConf()
+	sc.refuse = errors.New("banned")
+	processSSHConnection = func(net.Conn, *ssh.ServerConfig, ShellConf, func()) {
+		t.Error("The connection should have been refused")
+	}
+	defer setupFunctionPointers()
+	listener, err := SSHServer("127.0.0.1:", sshConf, sc)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	assertRefused(t, listener.Addr().(*net.TCPAddr).Port)
+	assert.Equal(t, []string{audit.ConnectionRefused}, sc.auditEvents())
+	assert.Equal(t, "banned", sc.audited[0].Error)
+}
+
+func TestSSHServer_LimitsConcurrentHandshakes(t *testing.T) {
+	sshConf := &ssh.ServerConfig{}
+	sc := newShellConf()
+	sc.maxHandshakes = 1
+	handshakes := make(chan func())
+	processSSHConnection = func(conn net.Conn, sshConf *ssh.ServerConfig, shellConf ShellConf, handshakeDone func()) {
+		handshakes <- handshakeDone
+	}
+	defer setupFunctionPointers()
+	listener, err := SSHServer("127.0.0.1:", sshConf, sc)
+	assert.NoError(t, err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	first, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	assert.NoError(t, err)
+	defer first.Close()
+	handshakeDone := <-handshakes
+
+	assertRefused(t, port)
+
+	// Finishing the handshake frees up the slot
+	handshakeDone()
+	handshakeDone()
+	second, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	assert.NoError(t, err)
+	defer second.Close()
+	<-handshakes
+}
+
+func createTestServer(shell string, options ...ShellOption) (int, func(), error) {
 	sshConf := ssh.ServerConfig{NoClientAuth: true}
-	shellConf := DefaultShellConf(shell, func(err error) {})
-	signer, err := auth.TryLoadKeys("/dev/null")
+	shellConf := DefaultShellConf(shell, func(err error) {}, options...)
+	signer, err := auth.GenerateHostKey(auth.KeyTypeEd25519)
 	if err != nil {
 		return 0, func() {}, err
 	}
@@ -424,6 +664,31 @@ func TestIntegration_ServerDisconnects(t *testing.T) {
 	wg.Wait()
 }
 
+// waitForPrompt waits until the remote shell is reading from the terminal.
+// Input sent before then (like Ctrl-D) can be lost when the shell switches
+// the terminal out of canonical mode.
+func waitForPrompt(t *testing.T, stdin io.Writer, stdout io.Reader) {
+	// The quotes keep the terminal's echo of the command from matching
+	_, err := stdin.Write([]byte("echo RE''ADY\n"))
+	assert.NoError(t, err)
+
+	output := []byte{}
+	buffer := make([]byte, 1024)
+	for {
+		n, err := stdout.Read(buffer)
+		if err != nil {
+			assert.NoError(t, err)
+			return
+		}
+		output = append(output, buffer[:n]...)
+		// The shell prints its prompt once it's ready for more input
+		i := bytes.Index(output, []byte("READY\r\n"))
+		if i != -1 && len(output) > i+len("READY\r\n") {
+			return
+		}
+	}
+}
+
 func TestIntegration_ClientDisconnects(t *testing.T) {
 	bin := "/bin/bash"
 
@@ -442,9 +707,17 @@ func TestIntegration_ClientDisconnects(t *testing.T) {
 			go func(exit []byte) {
 				defer wg.Done()
 				cmd := exec.Command("/usr/bin/ssh", "-t", "-t", "-o", "UserKnownHostsFile=/dev/null", "-o", "StrictHostKeyChecking=no", "-p", strconv.Itoa(port), "localhost")
-				cmd.Stdin = bytes.NewBuffer(exit)
-				cmd.Start()
-				err := cmd.Wait()
+				stdin, err := cmd.StdinPipe()
+				assert.NoError(t, err)
+				stdout, err := cmd.StdoutPipe()
+				assert.NoError(t, err)
+				assert.NoError(t, cmd.Start())
+				waitForPrompt(t, stdin, stdout)
+				_, err = stdin.Write(exit)
+				assert.NoError(t, err)
+				assert.NoError(t, stdin.Close())
+				_, _ = io.Copy(ioutil.Discard, stdout)
+				err = cmd.Wait()
 				assert.NoError(t, err)
 			}(exit)
 		}
@@ -472,7 +745,7 @@ func BenchmarkIntegration_ServerDisconnects(b *testing.B) {
 			defer wg.Done()
 			err := exec.Command("/usr/bin/ssh", "-t", "-t", "-o", "UserKnownHostsFile=/dev/null", "-o", "StrictHostKeyChecking=no", "-p", strconv.Itoa(port), "localhost").Run()
 			if err != nil {
-				b.Fatalf("%s\n", err)
+				b.Errorf("%s\n", err)
 			}
 		}()
 	}
@@ -498,7 +771,7 @@ func BenchmarkIntegration_ClientDisconnects(b *testing.B) {
 			cmd.Start()
 			err := cmd.Wait()
 			if err != nil {
-				b.Fatalf("%s\n", err)
+				b.Errorf("%s\n", err)
 			}
 		}()
 	}
@@ -0,0 +1,159 @@
+package sshd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+
+	"github.com/efarrer/gmash/audit"
+	"github.com/efarrer/gmash/payload"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// socketMode is the mode of the sockets guests listen on. Like OpenSSH's
+// StreamLocalBindMask only the host's user can connect to them.
+const socketMode = 0600
+
+// A SocketAllowList holds the Unix sockets guests may forward connections to
+// and listen on. An empty list doesn't allow any.
+type SocketAllowList struct {
+	patterns []string
+}
+
+// NewSocketAllowList parses absolute path patterns. The patterns may contain
+// wildcards (See path.Match).
+func NewSocketAllowList(patterns []string) (*SocketAllowList, error) {
+	list := &SocketAllowList{}
+	for _, pattern := range patterns {
+		if !path.IsAbs(pattern) {
+			return nil, fmt.Errorf("Unable to parse socket path %s (it must be absolute)", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Unable to parse socket path %s (%s)", pattern, err)
+		}
+		list.patterns = append(list.patterns, path.Clean(pattern))
+	}
+	return list, nil
+}
+
+// Allow returns an error unless a pattern matches the socket's path
+func (l *SocketAllowList) Allow(socketPath string) error {
+	if l == nil {
+		return fmt.Errorf("Unable to forward %s, socket forwarding isn't enabled", socketPath)
+	}
+	// Relative paths would depend on gmash's working directory and ".."
+	// could escape the allowed directories
+	if !path.IsAbs(socketPath) || path.Clean(socketPath) != socketPath {
+		return fmt.Errorf("Unable to forward %s, it must be a clean absolute path", socketPath)
+	}
+	for _, pattern := range l.patterns {
+		if matched, _ := path.Match(pattern, socketPath); matched {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unable to forward %s, it isn't an allowed socket", socketPath)
+}
+
+// A socketListener removes its socket when it's closed
+type socketListener struct {
+	net.Listener
+	socketPath string
+}
+
+func (l socketListener) Close() error {
+	err := l.Listener.Close()
+	_ = os.Remove(l.socketPath)
+	return err
+}
+
+// listenUnix listens on a socket that only the host's user can connect to.
+// The socket is created in a private directory and linked into place so no
+// one else can connect before its mode is set. An existing file is never
+// replaced.
+func listenUnix(socketPath string) (net.Listener, error) {
+	dir, err := ioutil.TempDir(path.Dir(socketPath), ".gmash-socket")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	private := path.Join(dir, "socket")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: private, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+	err = os.Chmod(private, socketMode)
+	if err == nil {
+		err = os.Link(private, socketPath)
+	}
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return socketListener{listener, socketPath}, nil
+}
+
+// _handleDirectStreamLocal connects a direct-streamlocal@openssh.com channel
+// to its socket if the socket is allowed
+func _handleDirectStreamLocal(newChannel ssh.NewChannel, conn *ssh.ServerConn, shellConf ShellConf) {
+	event := audit.Event{ChannelType: newChannel.ChannelType()}
+	req, err := payload.ParseDirectStreamLocal(newChannel.ExtraData())
+	if err != nil {
+		rejectChannel(newChannel, conn, shellConf, event, ssh.ConnectionFailed, fmt.Errorf("Unable to parse direct-streamlocal request (%s)", err))
+		return
+	}
+	event.Destination = req.SocketPath
+	dialForward(newChannel, conn, shellConf, event, "unix", shellConf.AllowSocket(req.SocketPath))
+}
+
+// listenSocket starts listening on a Unix socket for connections to forward to
+// the client. It returns the socket's path.
+func (f *remoteForwards) listenSocket(req *ssh.Request) (string, error) {
+	forwardReq, err := payload.ParseStreamLocalForward(req.Payload)
+	if err != nil {
+		return "", fmt.Errorf("Unable to parse streamlocal-forward request (%s)", err)
+	}
+	socketPath := forwardReq.SocketPath
+	err = f.mayListen(socketPath)
+	if err == nil {
+		err = f.shellConf.AllowSocket(socketPath)
+	}
+	if err != nil {
+		return socketPath, err
+	}
+
+	listener, err := listenUnix(socketPath)
+	if err != nil {
+		return socketPath, fmt.Errorf("Unable to listen on %s (%s)", socketPath, err)
+	}
+	f.sockets[socketPath] = listener
+
+	go f.accept(listener, func(local net.Conn) {
+		// See OpenSSH's PROTOCOL 2.4
+		openForwardChannel(f.conn, f.shellConf, local, "forwarded-streamlocal@openssh.com", ssh.Marshal(struct {
+			SocketPath string
+			Reserved   string
+		}{socketPath, ""}), audit.Event{Listen: socketPath})
+	})
+	return socketPath, nil
+}
+
+// cancelSocket stops listening on a Unix socket and removes it. It returns
+// the socket's path.
+func (f *remoteForwards) cancelSocket(req *ssh.Request) (string, error) {
+	forwardReq, err := payload.ParseStreamLocalForward(req.Payload)
+	if err != nil {
+		return "", fmt.Errorf("Unable to parse cancel-streamlocal-forward request (%s)", err)
+	}
+	socketPath := forwardReq.SocketPath
+	listener, ok := f.sockets[socketPath]
+	if !ok {
+		return socketPath, fmt.Errorf("Unable to cancel forwarding %s, it isn't being forwarded", socketPath)
+	}
+	delete(f.sockets, socketPath)
+	return socketPath, listener.Close()
+}
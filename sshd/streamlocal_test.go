@@ -0,0 +1,138 @@
+package sshd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSocketAllowList_RejectsInvalidPatterns(t *testing.T) {
+	for _, pattern := range []string{"docker.sock", "/tmp/[", ""} {
+		_, err := NewSocketAllowList([]string{pattern})
+		assert.Error(t, err, pattern)
+	}
+}
+
+func TestSocketAllowList_AllowsMatchingPaths(t *testing.T) {
+	list, err := NewSocketAllowList([]string{"/var/run/docker.sock", "/tmp/pair/*"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, list.Allow("/var/run/docker.sock"))
+	assert.NoError(t, list.Allow("/tmp/pair/lsp.sock"))
+	assert.Error(t, list.Allow("/tmp/pair/dir/lsp.sock"))
+	assert.Error(t, list.Allow("/tmp/pair/../../etc/passwd"))
+	assert.Error(t, list.Allow("pair/lsp.sock"))
+	assert.Error(t, list.Allow("/var/run/other.sock"))
+}
+
+func TestSocketAllowList_DeniesEverythingByDefault(t *testing.T) {
+	var list *SocketAllowList
+	assert.Error(t, list.Allow("/var/run/docker.sock"))
+}
+
+// createSocketDir creates a directory for sockets that guests may forward
+func createSocketDir(t *testing.T) (string, ShellOption, func()) {
+	dir, err := ioutil.TempDir("", "sockets")
+	assert.NoError(t, err)
+	list, err := NewSocketAllowList([]string{path.Join(dir, "*.sock")})
+	assert.NoError(t, err)
+	return dir, WithSocketAllowList(list), func() { _ = os.RemoveAll(dir) }
+}
+
+func TestDirectStreamLocal_ForwardsToTheSocket(t *testing.T) {
+	dir, option, cleanup := createSocketDir(t)
+	defer cleanup()
+	socketPath := path.Join(dir, "echo.sock")
+	listener, err := net.Listen("unix", socketPath)
+	assert.NoError(t, err)
+	defer listener.Close()
+	go echo(listener)
+	client, closer := createForwardingClient(t, option)
+	defer closer()
+
+	conn, err := client.Dial("unix", socketPath)
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	data := make([]byte, 5)
+	_, err = conn.Read(data)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	_, err = client.Dial("unix", path.Join(dir, "echo.socket"))
+	assert.Error(t, err)
+}
+
+func TestStreamLocalForward_ForwardsConnectionsToTheClient(t *testing.T) {
+	dir, option, cleanup := createSocketDir(t)
+	defer cleanup()
+	client, closer := createForwardingClient(t, option)
+	defer closer()
+	socketPath := path.Join(dir, "remote.sock")
+
+	remote, err := client.ListenUnix(socketPath)
+	assert.NoError(t, err)
+	go echo(remote)
+
+	info, err := os.Stat(socketPath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	assertEchoes(t, "unix", socketPath)
+
+	// Canceling the forward removes the socket
+	assert.NoError(t, remote.Close())
+	_, err = os.Stat(socketPath)
+	assert.True(t, os.IsNotExist(err))
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestStreamLocalForward_RemovesTheSocketWhenTheConnectionDrops(t *testing.T) {
+	dir, option, cleanup := createSocketDir(t)
+	defer cleanup()
+	client, closer := createForwardingClient(t, option)
+	defer closer()
+	socketPath := path.Join(dir, "remote.sock")
+
+	_, err := client.ListenUnix(socketPath)
+	assert.NoError(t, err)
+	assert.NoError(t, client.Close())
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(socketPath)
+		return os.IsNotExist(err)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestStreamLocalForward_RefusesSocketsThatArentAllowed(t *testing.T) {
+	dir, option, cleanup := createSocketDir(t)
+	defer cleanup()
+	client, closer := createForwardingClient(t, option)
+	defer closer()
+
+	_, err := client.ListenUnix(path.Join(dir, "remote.socket"))
+	assert.Error(t, err)
+}
+
+func TestStreamLocalForward_DoesntReplaceExistingFiles(t *testing.T) {
+	dir, option, cleanup := createSocketDir(t)
+	defer cleanup()
+	client, closer := createForwardingClient(t, option)
+	defer closer()
+	socketPath := path.Join(dir, "existing.sock")
+	assert.NoError(t, ioutil.WriteFile(socketPath, []byte("data"), 0644))
+
+	_, err := client.ListenUnix(socketPath)
+	assert.Error(t, err)
+
+	data, err := ioutil.ReadFile(socketPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
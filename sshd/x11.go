@@ -0,0 +1,250 @@
+package sshd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/efarrer/gmash/audit"
+	"github.com/efarrer/gmash/auth"
+	"github.com/efarrer/gmash/payload"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Like OpenSSH's X11DisplayOffset the first displays are left for real X
+// servers
+const (
+	x11DisplayOffset = 10
+	x11MaxDisplays   = 1000
+)
+
+// x11BasePort is the port of display 0, display N listens on x11BasePort + N
+const x11BasePort = 6000
+
+// x11AuthTimeout is how long an X client has to authenticate
+const x11AuthTimeout = 30 * time.Second
+
+// xauthFamilyLocal is the Xauthority address family X clients look up
+// connections to localhost with
+const xauthFamilyLocal = 256
+
+// An x11Forward is the display a session's X clients connect to. Clients are
+// given a fake cookie that's replaced with the guest's real cookie so only
+// the session's clients can reach the guest's X server.
+type x11Forward struct {
+	dir        string
+	listener   net.Listener
+	display    int
+	protocol   string
+	fakeCookie []byte
+	realCookie []byte
+}
+
+// xauthority returns the path for XAUTHORITY
+func (x *x11Forward) xauthority() string {
+	return path.Join(x.dir, "Xauthority")
+}
+
+// close stops forwarding and removes the Xauthority file
+func (x *x11Forward) close() {
+	_ = x.listener.Close()
+	_ = os.RemoveAll(x.dir)
+}
+
+// listenX11 listens on the first free display on the loopback interface. Like
+// OpenSSH's sshd there's no /tmp/.X11-unix socket; that directory belongs to
+// the local X servers and DISPLAY=localhost:n only uses TCP.
+func listenX11() (net.Listener, int, error) {
+	for display := x11DisplayOffset; display < x11DisplayOffset+x11MaxDisplays; display++ {
+		listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", x11BasePort+display))
+		if err == nil {
+			return listener, display, nil
+		}
+	}
+	return nil, 0, errors.New("no displays are free")
+}
+
+// writeXauthority writes an Xauthority file with the cookie for the display
+func writeXauthority(filename string, display int, protocol string, cookie []byte) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	var entry bytes.Buffer
+	_ = binary.Write(&entry, binary.BigEndian, uint16(xauthFamilyLocal))
+	for _, field := range [][]byte{[]byte(hostname), []byte(strconv.Itoa(display)), []byte(protocol), cookie} {
+		_ = binary.Write(&entry, binary.BigEndian, uint16(len(field)))
+		entry.Write(field)
+	}
+	return ioutil.WriteFile(filename, entry.Bytes(), 0600)
+}
+
+// pad4 rounds n up to a multiple of 4
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// spoofAuth reads the X client's connection setup and replaces the fake
+// cookie with the real one (See the X Window System Protocol's Connection
+// Setup). It returns the setup to send to the guest's X server.
+func (x *x11Forward) spoofAuth(client io.Reader) ([]byte, error) {
+	setup := make([]byte, 12)
+	_, err := io.ReadFull(client, setup)
+	if err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch setup[0] {
+	case 'B':
+		order = binary.BigEndian
+	case 'l':
+		order = binary.LittleEndian
+	default:
+		return nil, errors.New("invalid byte order")
+	}
+	protocolLen := int(order.Uint16(setup[6:]))
+	cookieLen := int(order.Uint16(setup[8:]))
+	auth := make([]byte, pad4(protocolLen)+pad4(cookieLen))
+	_, err = io.ReadFull(client, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol := auth[:protocolLen]
+	cookie := auth[pad4(protocolLen) : pad4(protocolLen)+cookieLen]
+	if string(protocol) != x.protocol || subtle.ConstantTimeCompare(cookie, x.fakeCookie) != 1 {
+		return nil, errors.New("the X client's cookie is wrong")
+	}
+	copy(cookie, x.realCookie)
+	return append(setup, auth...), nil
+}
+
+// prefixedConn is a connection that's read from after the prefix. It only
+// embeds net.Conn so io.Copy can't bypass the prefix with TCPConn.WriteTo.
+type prefixedConn struct {
+	net.Conn
+	tcpConn *net.TCPConn
+	reader  io.Reader
+}
+
+func (c prefixedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c prefixedConn) CloseWrite() error {
+	return c.tcpConn.CloseWrite()
+}
+
+// forwardX11 listens on a display and forwards its connections to the
+// client's X server
+func (s *session) forwardX11(req *payload.X11Req) error {
+	realCookie, err := hex.DecodeString(req.AuthCookie)
+	if err != nil || len(realCookie) == 0 {
+		return fmt.Errorf("Unable to forward %s's X11 display, the cookie is invalid", s.guest())
+	}
+	fakeCookie := make([]byte, len(realCookie))
+	_, err = rand.Read(fakeCookie)
+	if err != nil {
+		return fmt.Errorf("Unable to forward %s's X11 display (%s)", s.guest(), err)
+	}
+	dir, err := ioutil.TempDir("", "gmash-x11-")
+	if err != nil {
+		return fmt.Errorf("Unable to forward %s's X11 display (%s)", s.guest(), err)
+	}
+	listener, display, err := listenX11()
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return fmt.Errorf("Unable to forward %s's X11 display (%s)", s.guest(), err)
+	}
+	x11 := &x11Forward{
+		dir:        dir,
+		listener:   listener,
+		display:    display,
+		protocol:   req.AuthProtocol,
+		fakeCookie: fakeCookie,
+		realCookie: realCookie,
+	}
+	err = writeXauthority(x11.xauthority(), display, req.AuthProtocol, fakeCookie)
+	if err != nil {
+		x11.close()
+		return fmt.Errorf("Unable to write the Xauthority file (%s)", err)
+	}
+	s.x11 = x11
+	s.env = append(s.env, fmt.Sprintf("DISPLAY=localhost:%d.%d", display, req.ScreenNumber), "XAUTHORITY="+x11.xauthority())
+
+	go func() {
+		for {
+			local, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if req.SingleConnection {
+				_ = listener.Close()
+			}
+			go s.openX11Channel(local.(*net.TCPConn))
+		}
+	}()
+	return nil
+}
+
+// openX11Channel forwards the X client's connection to the client's X server
+// once the X client has authenticated
+func (s *session) openX11Channel(local *net.TCPConn) {
+	event := audit.Event{Listen: fmt.Sprintf("localhost:%d", s.x11.display), Originator: local.RemoteAddr().String()}
+	_ = local.SetReadDeadline(time.Now().Add(x11AuthTimeout))
+	setup, err := s.x11.spoofAuth(local)
+	_ = local.SetReadDeadline(time.Time{})
+	if err != nil {
+		_ = local.Close()
+		err = fmt.Errorf("Refused an X11 connection to %s's display (%s)", s.guest(), err)
+		s.shellConf.ErrorHandler(err)
+		event.Event = audit.ChannelRejected
+		event.ChannelType = "x11"
+		event.Error = err.Error()
+		auditEvent(s.shellConf, s.conn, event)
+		return
+	}
+
+	originator := local.RemoteAddr().(*net.TCPAddr)
+	// See RFC 4254 6.3.2
+	extraData := ssh.Marshal(struct {
+		OriginatorAddress string
+		OriginatorPort    uint32
+	}{originator.IP.String(), uint32(originator.Port)})
+	openForwardChannel(s.conn, s.shellConf, prefixedConn{local, local, io.MultiReader(bytes.NewReader(setup), local)}, "x11", extraData, event)
+}
+
+func _handleX11Request(sess *session, req *ssh.Request) error {
+	if !sess.shellConf.X11Forwarding() {
+		return declinedRequest{fmt.Errorf("Unable to forward %s's X11 display, X11 forwarding isn't enabled", sess.guest())}
+	}
+	if !auth.Permitted(sess.permissions(), auth.PermitX11Forwarding) {
+		return fmt.Errorf("Unable to forward %s's X11 display, it isn't permitted for this key", sess.guest())
+	}
+	if sess.shellConf.SharedTerminal() != nil {
+		return fmt.Errorf("Unable to forward %s's X11 display, guests can only watch the shared terminal", sess.guest())
+	}
+	if sess.started() {
+		return fmt.Errorf("Unable to forward %s's X11 display after the session has started", sess.guest())
+	}
+	if sess.x11 != nil {
+		return fmt.Errorf("Unable to forward %s's X11 display, it's already forwarded", sess.guest())
+	}
+	x11Req, err := payload.ParseX11Req(req.Payload)
+	if err != nil {
+		return fmt.Errorf("Unable to parse x11-req request (%s)", err)
+	}
+	return sess.forwardX11(x11Req)
+}
@@ -0,0 +1,190 @@
+package sshd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/efarrer/gmash/auth"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testCookie = "00112233445566778899aabbccddeeff"
+
+// x11Setup creates an X client's connection setup
+func x11Setup(protocol string, cookie []byte) []byte {
+	var setup bytes.Buffer
+	setup.Write([]byte{'l', 0})
+	_ = binary.Write(&setup, binary.LittleEndian, []uint16{11, 0, uint16(len(protocol)), uint16(len(cookie)), 0})
+	setup.WriteString(protocol)
+	setup.Write(make([]byte, pad4(len(protocol))-len(protocol)))
+	setup.Write(cookie)
+	setup.Write(make([]byte, pad4(len(cookie))-len(cookie)))
+	return setup.Bytes()
+}
+
+// readXauthorityCookie reads the cookie from an Xauthority file with one entry
+func readXauthorityCookie(t *testing.T, filename string) []byte {
+	data, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	reader := bytes.NewReader(data[2:])
+	var field []byte
+	for i := 0; i < 4; i++ {
+		var length uint16
+		assert.NoError(t, binary.Read(reader, binary.BigEndian, &length))
+		field = make([]byte, length)
+		_, err = io.ReadFull(reader, field)
+		assert.NoError(t, err)
+	}
+	return field
+}
+
+func x11Req() *ssh.Request {
+	return &ssh.Request{Payload: ssh.Marshal(struct {
+		SingleConnection bool
+		AuthProtocol     string
+		AuthCookie       string
+		ScreenNumber     uint32
+	}{false, "MIT-MAGIC-COOKIE-1", testCookie, 0})}
+}
+
+func TestHandleX11Request_FailsIfX11ForwardingIsDisabled(t *testing.T) {
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, newShellConf())
+
+	err := handleX11Request(sess, x11Req())
+
+	assert.Error(t, err)
+	assert.IsType(t, declinedRequest{}, err)
+	assert.Nil(t, sess.x11)
+	assert.Empty(t, sess.env)
+}
+
+func TestHandleX11Request_FailsIfX11ForwardingIsNotPermitted(t *testing.T) {
+	sc := newShellConf()
+	sc.x11 = true
+	sess := newSession(newFakeChannel([]byte{}, nil), restrictedConn("", auth.PermitAgentForwarding), sc)
+
+	err := handleX11Request(sess, x11Req())
+
+	assert.Error(t, err)
+	assert.Nil(t, sess.x11)
+}
+
+func TestHandleX11Request_WritesAnXauthorityFileWithAFakeCookie(t *testing.T) {
+	sc := newShellConf()
+	sc.x11 = true
+	sess := newSession(newFakeChannel([]byte{}, nil), nil, sc)
+
+	err := handleX11Request(sess, x11Req())
+	assert.NoError(t, err)
+	assert.Error(t, handleX11Request(sess, x11Req()))
+
+	assert.Contains(t, sess.env, fmt.Sprintf("DISPLAY=localhost:%d.0", sess.x11.display))
+	assert.Contains(t, sess.env, "XAUTHORITY="+sess.x11.xauthority())
+	info, err := os.Stat(sess.x11.xauthority())
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	fakeCookie := hex.EncodeToString(readXauthorityCookie(t, sess.x11.xauthority()))
+	assert.NotEqual(t, testCookie, fakeCookie)
+
+	if _, err := exec.LookPath("xauth"); err == nil {
+		output, err := exec.Command("xauth", "-f", sess.x11.xauthority(), "list").Output()
+		assert.NoError(t, err)
+		assert.Contains(t, string(output), fmt.Sprintf("/unix:%d  MIT-MAGIC-COOKIE-1  %s", sess.x11.display, fakeCookie))
+	}
+
+	// The display is closed when the session closes
+	dir := path.Dir(sess.x11.xauthority())
+	sess.hangup()
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSpoofAuth_ReplacesTheFakeCookie(t *testing.T) {
+	x11 := &x11Forward{protocol: "MIT-MAGIC-COOKIE-1", fakeCookie: []byte("fake"), realCookie: []byte("real")}
+
+	setup, err := x11.spoofAuth(bytes.NewReader(x11Setup("MIT-MAGIC-COOKIE-1", []byte("fake"))))
+
+	assert.NoError(t, err)
+	assert.Equal(t, x11Setup("MIT-MAGIC-COOKIE-1", []byte("real")), setup)
+}
+
+func TestSpoofAuth_RejectsTheWrongCookie(t *testing.T) {
+	x11 := &x11Forward{protocol: "MIT-MAGIC-COOKIE-1", fakeCookie: []byte("fake"), realCookie: []byte("real")}
+
+	_, err := x11.spoofAuth(bytes.NewReader(x11Setup("MIT-MAGIC-COOKIE-1", []byte("real"))))
+	assert.Error(t, err)
+	_, err = x11.spoofAuth(bytes.NewReader(x11Setup("XDM-AUTHORIZATION-1", []byte("fake"))))
+	assert.Error(t, err)
+	_, err = x11.spoofAuth(bytes.NewReader([]byte("not an X client")))
+	assert.Error(t, err)
+}
+
+func TestX11Forwarding_ForwardsToTheClientsXServer(t *testing.T) {
+	port, closer, err := createTestServer("/bin/bash", WithX11Forwarding())
+	assert.NoError(t, err)
+	defer closer()
+	client, err := ssh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &ssh.ClientConfig{
+		User:            "guest",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	// The client's X server replies with the setup it was sent
+	cookie, _ := hex.DecodeString(testCookie)
+	go func() {
+		for newChannel := range client.HandleChannelOpen("x11") {
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(requests)
+			setup := make([]byte, len(x11Setup("MIT-MAGIC-COOKIE-1", cookie)))
+			_, _ = io.ReadFull(channel, setup)
+			_, _ = channel.Write(setup)
+			_ = channel.Close()
+		}
+	}()
+
+	session, err := client.NewSession()
+	assert.NoError(t, err)
+	defer session.Close()
+	ok, err := session.SendRequest("x11-req", true, x11Req().Payload)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	stdout, err := session.StdoutPipe()
+	assert.NoError(t, err)
+	assert.NoError(t, session.Start("echo $DISPLAY $XAUTHORITY; sleep 5"))
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	assert.NoError(t, err)
+	fields := strings.Fields(line)
+	assert.Len(t, fields, 2)
+	var display, screen int
+	_, err = fmt.Sscanf(fields[0], "localhost:%d.%d", &display, &screen)
+	assert.NoError(t, err)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", x11BasePort+display))
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(x11Setup("MIT-MAGIC-COOKIE-1", readXauthorityCookie(t, fields[1])))
+	assert.NoError(t, err)
+	reply, err := ioutil.ReadAll(conn)
+
+	assert.NoError(t, err)
+	assert.Equal(t, x11Setup("MIT-MAGIC-COOKIE-1", cookie), reply)
+}